@@ -3,6 +3,10 @@ package cfg
 import (
 	"fmt"
 	"os"
+	"sampler/internal/ns"
+	"sampler/internal/throttle"
+	"strings"
+	"time"
 
 	flag "github.com/spf13/pflag"
 
@@ -14,8 +18,64 @@ type Compare struct {
 	Zscore          float64
 	ErrorRate       float64
 	ForceSampleSize int64
+	Recheck         int
+	RecheckDelay    time.Duration
+	Snapshot        bool
+	SrcClusterTime  string
+	TgtClusterTime  string
+	// numerically equal values of different numeric types are a minor mismatch instead of a mismatch
+	NumericEquivalence bool
+	Epsilon            float64
+	// compare server side digests and only fetch the documents whose digests differ
+	Hash bool
+	// limits of a single sample batch and of the batches in flight
+	BatchDocs int
+	BatchMB   int
+	BufferMB  int
+	// sample doc workers of each namespace being compared
+	DocWorkers int
+	// how documents are drawn from the (filtered) collection, one of SampleAggregate or SampleRand
+	SampleMethod string
+	// draw the sample in rounds growing from InitialSample, stopping early while nothing is inconsistent
+	Sequential    bool
+	InitialSample int64
+	// documents read on each side of an inconsistent _id after the sample, 0 to skip focused follow-ups
+	FocusDocs int
+	// selects documents by the hash of their _id and the seed instead of at random, 0 samples at random
+	Seed int64
+	// fraction of the hash space a seeded sample selects, 0 derives it from the sample size and population
+	SeedFraction float64
+	// how the population is split into separately sampled strata, one of the Strata constants or empty for none
+	Strata        string
+	StrataField   string
+	StrataBuckets int
 }
 
+// sampling methods selectable with --sampleMethod
+const (
+	// $sample after the namespace filter's $match
+	SampleAggregate = "sample"
+	// keeps each document matching the filter with probability sampleSize / population using $rand
+	SampleRand = "rand"
+)
+
+// strata selectable with --strata
+const (
+	// one stratum per shard owning chunks of the source collection
+	StrataShard = "shard"
+	// windows of equal length between the oldest and newest ObjectId _id
+	StrataTime = "time"
+	// one stratum per value of --strataField
+	StrataField = "field"
+)
+
+// report sinks selectable with --report
+const (
+	MongoSink  = "mongo"
+	FileSink   = "file"
+	StdoutSink = "stdout"
+)
+
 type MongoOptions struct {
 	URI string
 }
@@ -33,6 +93,39 @@ type Configuration struct {
 	CleanMeta      bool
 	ReportFullDoc  bool
 	SkipDocReports bool
+	Reports        []string
+	ReportFile     string
+	SummaryJSON    string
+	Resume         string
+	ConfigFile     string
+	// per-namespace overrides from the config file, keyed by db.coll
+	Namespaces map[string]NamespaceOptions
+	// namespace mapping rules from --map and the config file, per-namespace targets are applied first
+	Mappings []ns.MappingRule
+	Mapper   *ns.Mapper
+	// namespace patterns selecting what to compare when --ns is not given, parsed into NamespaceFilter
+	Include         []string
+	Exclude         []string
+	NamespaceFilter *ns.Filter
+	// pool sizes and the budgets of the queries sent to each cluster
+	NamespaceWorkers int
+	ReportWorkers    int
+	SourceThrottle   throttle.Options
+	TargetThrottle   throttle.Options
+	// lowers the cap on queries in flight while a cluster is past the pressure thresholds
+	Adaptive bool
+	Pressure throttle.Pressure
+	// run being resumed, parsed from Resume
+	ResumeRun time.Time
+}
+
+func (c *Configuration) HasSink(name string) bool {
+	for _, each := range c.Reports {
+		if each == name {
+			return true
+		}
+	}
+	return false
 }
 
 func Init() Configuration {
@@ -53,6 +146,48 @@ func Init() Configuration {
 
 	flag.Int64Var(&config.Compare.ForceSampleSize, "forceSampleSize", 0, "override sampling logic and specify fixed number of docs to check")
 
+	flag.StringVar(&config.Compare.SampleMethod, "sampleMethod", SampleAggregate, "how documents are sampled from within the namespace filter [ sample | rand ]. sample runs $sample after the filter's $match, rand keeps each matching document with a $rand threshold (requires MongoDB 4.4.2+) and avoids $sample's random sort of large filtered sets, the achieved size varies around the sample size")
+
+	flag.Int64Var(&config.Compare.Seed, "seed", 0, "select the documents whose hash of _id and this seed falls in a seed derived range instead of sampling at random, so runs with the same seed compare the same documents (requires servers that support $toHashedIndexKey). Replaces --sampleMethod, the achieved size varies around the sample size. 0 samples at random")
+	flag.Float64Var(&config.Compare.SeedFraction, "seedFraction", 0, "fraction (0 to 1] of the hash space a --seed sample selects, fixing the sample set regardless of counts. 0 derives it from each namespace's sample size and population, the fraction used is recorded in its collSampleSummary to be passed back to reproduce it")
+	flag.BoolVar(&config.Compare.Sequential, "sequential", false, "sample in rounds starting at --initialSample documents and doubling up to the computed sample size, stopping once a round without inconsistencies meets --errRate at --zscore and jumping to the full size once one is found")
+	flag.Int64Var(&config.Compare.InitialSample, "initialSample", 1000, "documents sampled in the first round of a --sequential sample")
+	flag.IntVar(&config.Compare.FocusDocs, "focusDocs", 0, "after sampling, compare this many documents on each side of every inconsistent _id (in _id order) to characterize the scope of the inconsistencies, they are not counted in the sample's totals")
+
+	flag.StringVar(&config.Compare.Strata, "strata", "", "split each namespace into strata sampled and reported separately [ shard | time | field ]. shard uses the source's config.chunks, time splits ObjectId _ids into --strataBuckets windows, field uses the values of --strataField")
+	flag.StringVar(&config.Compare.StrataField, "strataField", "", "dotted path whose values are the strata of --strata field (e.x: tenantId)")
+	flag.IntVar(&config.Compare.StrataBuckets, "strataBuckets", 10, "number of time windows of --strata time")
+
+	flag.IntVar(&config.Compare.Recheck, "recheck", 0, "number of times to re-read missing and mismatched documents from both clusters before declaring them inconsistent, useful while a replicator is still applying writes")
+	flag.DurationVar(&config.Compare.RecheckDelay, "recheckDelay", 5*time.Second, "time to wait before each recheck pass (e.x: 500ms, 10s, 1m)")
+
+	flag.BoolVar(&config.Compare.Snapshot, "snapshot", false, "read samples and lookups with readConcern snapshot at a fixed cluster time on each side so both clusters are compared at a consistent point in time (requires MongoDB 5.0+)")
+	flag.StringVar(&config.Compare.SrcClusterTime, "srcClusterTime", "", "source cluster time to read at in snapshot mode as <seconds>[,<increment>], defaults to the source's current cluster time")
+	flag.StringVar(&config.Compare.TgtClusterTime, "tgtClusterTime", "", "target cluster time to read at in snapshot mode as <seconds>[,<increment>], e.x: the time the replicator reported it caught up to the source. Defaults to the target's current cluster time")
+
+	flag.BoolVar(&config.Compare.NumericEquivalence, "numericEquivalence", false, "treat numerically equal int32, int64, double and decimal128 values as equal, documents that only differ by numeric type are reported as docMinorMismatch instead of docMismatch")
+	flag.Float64Var(&config.Compare.Epsilon, "epsilon", 0, "largest difference tolerated between two numbers when either is a double, requires --numericEquivalence (e.x: 1e-9)")
+
+	flag.BoolVar(&config.Compare.Hash, "hash", false, "compare a digest of each document computed on the server with $toHashedIndexKey and only fetch the documents whose digests differ, reduces network transfer for large documents")
+
+	flag.IntVar(&config.Compare.BatchDocs, "batchDocs", 1000, "maximum number of sampled documents compared and looked up per batch")
+	flag.IntVar(&config.Compare.BatchMB, "batchMB", 16, "maximum BSON size in MB of the sampled documents of a batch, a single larger document is its own batch")
+	flag.IntVar(&config.Compare.BufferMB, "bufferMB", 256, "maximum BSON size in MB of the sampled batches queued or being compared at once per collection")
+
+	flag.IntVar(&config.NamespaceWorkers, "nsWorkers", 4, "number of namespaces compared at once")
+	flag.IntVar(&config.Compare.DocWorkers, "docWorkers", 4, "number of sample batches compared at once per namespace")
+	flag.IntVar(&config.ReportWorkers, "reportWorkers", 1, "number of reports written at once")
+	flag.IntVar(&config.SourceThrottle.MaxQueries, "srcMaxQueries", 16, "maximum number of queries in flight against the source across every namespace, 0 for no limit")
+	flag.IntVar(&config.TargetThrottle.MaxQueries, "tgtMaxQueries", 16, "maximum number of queries in flight against the target across every namespace, 0 for no limit")
+	flag.Float64Var(&config.SourceThrottle.OpsPerSec, "srcOpsPerSec", 0, "maximum number of queries and getMores started per second against the source, 0 for no limit")
+	flag.Float64Var(&config.TargetThrottle.OpsPerSec, "tgtOpsPerSec", 0, "maximum number of queries and getMores started per second against the target, 0 for no limit")
+	flag.Float64Var(&config.SourceThrottle.DocsPerSec, "srcDocsPerSec", 0, "maximum number of documents read per second from the source, 0 for no limit")
+	flag.Float64Var(&config.TargetThrottle.DocsPerSec, "tgtDocsPerSec", 0, "maximum number of documents read per second from the target, 0 for no limit")
+
+	flag.BoolVar(&config.Adaptive, "adaptive", false, "poll serverStatus and replSetGetStatus on both clusters and halve the queries in flight while a cluster is past --maxQueuedReaders or --maxReplLag, recovering one query at a time once it is not")
+	flag.IntVar(&config.Pressure.MaxQueuedReaders, "maxQueuedReaders", 10, "queued readers (serverStatus globalLock.currentQueue.readers) past which a cluster is under pressure in adaptive mode, 0 to not check")
+	flag.DurationVar(&config.Pressure.MaxReplLag, "maxReplLag", 10*time.Second, "replication lag of the most lagged secondary past which a cluster is under pressure in adaptive mode, 0 to not check")
+
 	flag.StringVar(&config.Verbosity, "verbosity", "info", "log level [ error | warn | info | debug | trace ]")
 	flag.StringVar(&config.LogFile, "log", "", "path where log file should be stored. If not provided, no file is generated. The file name will be sampler-{datetime}.log for each run")
 	flag.StringVar(&config.Filter, "filter", "", "path to filter file containing a list of namespaces to extended JSON filter (e.x: { \"test.test\": { \"ts\": { \"$gt\": { \"$date\": ... } } } })")
@@ -61,13 +196,27 @@ func Init() Configuration {
 	flag.BoolVar(&config.ReportFullDoc, "fulldoc", false, "report the whole document in the metadata.docs collection, using this option will add time to the validator and use additional disk space + load on the destination")
 	flag.BoolVar(&config.SkipDocReports, "nodoc", false, "skips inserting details of doc _ids and whether they were missing or different")
 
+	flag.StringSliceVar(&config.Reports, "report", []string{MongoSink}, "where to write reports, any combination of [ mongo | file | stdout ] (e.x: --report mongo,file). mongo writes to the meta database, file and stdout write JSON lines")
+	flag.StringVar(&config.ReportFile, "reportFile", "", "path of the JSON lines file written by the file report sink, appended to if it already exists")
+
+	flag.StringVar(&config.SummaryJSON, "summary-json", "", "path to write the final verdict and per-namespace totals to as JSON")
+
+	flag.StringVar(&config.Resume, "resume", "", "resume an interrupted run given its start time as logged at startup (e.x: 2024-05-01T10:00:00.123Z), namespaces it finished are skipped and reports are appended to the same run")
+
+	flag.StringVar(&config.ConfigFile, "config", "", "path to a YAML or JSON config file keyed by flag name, with per-namespace overrides under namespaces. Flags given on the command line take precedence over the file")
+
+	mappings := flag.StringArray("map", nil, "map a source namespace or database to its name on the target as <source>=<target> (e.x: --map prod_app=app --map app.users=app.accounts), pass this flag multiple times for multiple mappings. Prefix and regex rules are set with mappings in the config file")
+
+	flag.StringArrayVar(&config.Include, "include", nil, "namespace pattern to compare, either a glob over db.coll (e.x: tenant_*.orders, or tenant_* for whole databases) or a /regex/ over db.coll, pass this flag multiple times for multiple patterns")
+	flag.StringArrayVar(&config.Exclude, "exclude", nil, "namespace pattern to skip, same syntax as --include and applied after it (e.x: --include 'tenant_*' --exclude '*.*_audit')")
+
 	config.IncludeNS = flag.StringArray("ns", nil, "namespace to check, pass this flag multiple times to check multiple namespaces")
 
 	flag.Usage = func() {
 		flagSet := flag.CommandLine
 		fmt.Printf("Usage of %s:\n", os.Args[0])
 		required := []string{"src", "tgt"}
-		optional := []string{"ns", "meta", "metadbname", "verbosity", "log", "filter", "clean", "fulldoc", "nodoc"}
+		optional := []string{"config", "ns", "include", "exclude", "meta", "metadbname", "verbosity", "log", "filter", "clean", "fulldoc", "nodoc", "recheck", "recheckDelay", "snapshot", "srcClusterTime", "tgtClusterTime", "sampleMethod", "seed", "seedFraction", "sequential", "initialSample", "focusDocs", "strata", "strataField", "strataBuckets", "numericEquivalence", "epsilon", "hash", "batchDocs", "batchMB", "bufferMB", "nsWorkers", "docWorkers", "reportWorkers", "srcMaxQueries", "tgtMaxQueries", "srcOpsPerSec", "tgtOpsPerSec", "srcDocsPerSec", "tgtDocsPerSec", "adaptive", "maxQueuedReaders", "maxReplLag", "report", "reportFile", "summary-json", "resume", "map"}
 
 		fmt.Println("[ required ]")
 		for _, name := range required {
@@ -83,7 +232,22 @@ func Init() Configuration {
 
 	flag.Parse()
 
-	config.validate()
+	var errs []string
+	if config.ConfigFile != "" {
+		errs = config.loadFile(flag.CommandLine)
+	}
+	// command line mappings are checked before the config file's
+	rules := []ns.MappingRule{}
+	for _, each := range *mappings {
+		from, to, found := strings.Cut(each, "=")
+		if !found {
+			errs = append(errs, fmt.Sprintf("invalid parameter: --map %q must be of the form <source>=<target>", each))
+			continue
+		}
+		rules = append(rules, ns.MappingRule{From: from, To: to, Match: ns.MatchExact})
+	}
+	config.Mappings = append(rules, config.Mappings...)
+	config.validate(errs)
 
 	return config
 }
@@ -93,15 +257,111 @@ func (m *MongoOptions) MakeClientOptions() *options.ClientOptions {
 	return clientOps
 }
 
-func (c *Configuration) validate() {
+// checks the configuration, printing every problem found along with the usage before exiting
+func (c *Configuration) validate(errs []string) {
 	if c.Source.URI == "" {
-		flag.Usage()
-		fmt.Println("missing required parameters: --src")
-		os.Exit(1)
+		errs = append(errs, "missing required parameters: --src")
 	}
 	if c.Target.URI == "" {
+		errs = append(errs, "missing required parameters: --tgt")
+	}
+	if c.Compare.Recheck < 0 {
+		errs = append(errs, "invalid parameter: --recheck must not be negative")
+	}
+	if !c.Compare.Snapshot && (c.Compare.SrcClusterTime != "" || c.Compare.TgtClusterTime != "") {
+		errs = append(errs, "invalid parameters: --srcClusterTime and --tgtClusterTime require --snapshot")
+	}
+	if c.Compare.BatchDocs <= 0 || c.Compare.BatchMB <= 0 || c.Compare.BufferMB <= 0 {
+		errs = append(errs, "invalid parameter: --batchDocs, --batchMB and --bufferMB must be positive")
+	}
+	if c.NamespaceWorkers <= 0 || c.Compare.DocWorkers <= 0 || c.ReportWorkers <= 0 {
+		errs = append(errs, "invalid parameter: --nsWorkers, --docWorkers and --reportWorkers must be positive")
+	}
+	for _, each := range []throttle.Options{c.SourceThrottle, c.TargetThrottle} {
+		if each.MaxQueries < 0 || each.OpsPerSec < 0 || each.DocsPerSec < 0 {
+			errs = append(errs, "invalid parameter: --srcMaxQueries, --tgtMaxQueries, --srcOpsPerSec, --tgtOpsPerSec, --srcDocsPerSec and --tgtDocsPerSec must not be negative")
+			break
+		}
+	}
+	if c.Adaptive && c.SourceThrottle.MaxQueries == 0 && c.TargetThrottle.MaxQueries == 0 {
+		errs = append(errs, "invalid parameters: --adaptive lowers --srcMaxQueries and --tgtMaxQueries and requires at least one of them")
+	}
+	if c.Compare.SampleMethod != SampleAggregate && c.Compare.SampleMethod != SampleRand {
+		errs = append(errs, fmt.Sprintf("invalid parameter: unknown --sampleMethod %q", c.Compare.SampleMethod))
+	}
+	if c.Compare.Sequential && c.Compare.InitialSample <= 0 {
+		errs = append(errs, "invalid parameter: --initialSample must be positive")
+	}
+	switch c.Compare.Strata {
+	case "", StrataShard, StrataTime, StrataField:
+	default:
+		errs = append(errs, fmt.Sprintf("invalid parameter: unknown --strata %q", c.Compare.Strata))
+	}
+	if c.Compare.StrataBuckets <= 0 {
+		errs = append(errs, "invalid parameter: --strataBuckets must be positive")
+	}
+	if c.Compare.SeedFraction < 0 || c.Compare.SeedFraction > 1 {
+		errs = append(errs, "invalid parameter: --seedFraction must be between 0 and 1")
+	}
+	if c.Compare.SeedFraction > 0 && c.Compare.Seed == 0 {
+		errs = append(errs, "invalid parameters: --seedFraction requires --seed")
+	}
+	if c.Compare.FocusDocs < 0 {
+		errs = append(errs, "invalid parameter: --focusDocs must not be negative")
+	}
+	if c.Compare.Epsilon < 0 {
+		errs = append(errs, "invalid parameter: --epsilon must not be negative")
+	}
+	if c.Compare.Epsilon > 0 && !c.Compare.NumericEquivalence {
+		errs = append(errs, "invalid parameters: --epsilon requires --numericEquivalence")
+	}
+	for _, each := range c.Reports {
+		if each != MongoSink && each != FileSink && each != StdoutSink {
+			errs = append(errs, fmt.Sprintf("invalid parameter: unknown report sink %q", each))
+		}
+	}
+	if c.HasSink(FileSink) && c.ReportFile == "" {
+		errs = append(errs, "missing required parameters: --reportFile is required when reporting to a file")
+	}
+	if c.Resume != "" {
+		run, err := time.Parse(time.RFC3339Nano, c.Resume)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("invalid parameter: --resume must be the run's RFC 3339 start time: %s", err))
+		}
+		c.ResumeRun = run
+		if !c.HasSink(MongoSink) {
+			errs = append(errs, "invalid parameters: --resume reads the run's progress from the meta database and requires the mongo report sink")
+		}
+		if c.CleanMeta {
+			errs = append(errs, "invalid parameters: --resume cannot be used with --clean")
+		}
+	}
+	nsFilter, err := ns.NewFilter(c.Include, c.Exclude)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("invalid parameter: %s", err))
+	}
+	c.NamespaceFilter = nsFilter
+
+	rules := []ns.MappingRule{}
+	for namespace, options := range c.Namespaces {
+		if options.Target != "" {
+			rules = append(rules, ns.MappingRule{From: namespace, To: options.Target, Match: ns.MatchExact})
+		}
+	}
+	mapper, err := ns.NewMapper(append(rules, c.Mappings...))
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("invalid mapping: %s", err))
+	}
+	c.Mapper = mapper
+	if c.Compare.Snapshot && c.Compare.Recheck > 0 {
+		errs = append(errs, "invalid parameters: --recheck cannot be used with --snapshot, snapshot reads already compare both clusters at a consistent point in time")
+	}
+
+	if len(errs) > 0 {
 		flag.Usage()
-		fmt.Println("missing required parameters: --tgt")
+		for _, each := range errs {
+			fmt.Println(each)
+		}
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,228 @@
+package cfg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// keys of the config file holding per-namespace overrides and mapping rules, every other key is the name of a flag
+const (
+	namespacesKey = "namespaces"
+	mappingsKey   = "mappings"
+)
+
+// Overrides for a single namespace, set under namespaces in the config file keyed by db.coll
+type NamespaceOptions struct {
+	// fixed number of docs to sample, overrides --forceSampleSize
+	SampleSize int64   `yaml:"sampleSize"`
+	Zscore     float64 `yaml:"zscore"`
+	ErrorRate  float64 `yaml:"errRate"`
+	// extended JSON filter as a mapping or a string, takes precedence over the --filter file
+	RawFilter yaml.Node `yaml:"filter"`
+	Filter    bson.D    `yaml:"-"`
+	// dotted paths not compared, * matches any field or array index (e.x: items.*.updatedAt)
+	IgnoreFields []string `yaml:"ignoreFields"`
+	// when set, only these dotted paths are compared
+	CompareFields []string `yaml:"compareFields"`
+	// dotted paths of set-like arrays compared regardless of element order (e.x: tags, items.*.labels)
+	UnorderedArrays []string `yaml:"unorderedArrays"`
+	// dotted path whose values are the strata of --strata field, overrides --strataField
+	StrataField string `yaml:"strataField"`
+	SkipCount   bool   `yaml:"skipCount"`
+	SkipIndexes bool   `yaml:"skipIndexes"`
+	SkipDocs    bool   `yaml:"skipDocs"`
+	// db.coll the namespace was renamed to on the target
+	Target string `yaml:"target"`
+	// fraction of the hash space a seeded sample selects, overrides --seedFraction
+	SeedFraction float64 `yaml:"seedFraction"`
+}
+
+// returns the overrides for a namespace, the zero value when it has none
+func (c *Configuration) NamespaceOptions(namespace string) NamespaceOptions {
+	return c.Namespaces[namespace]
+}
+
+// Applies the config file to every flag not set on the command line and loads its per-namespace overrides.
+// Returns every problem found rather than stopping at the first
+func (c *Configuration) loadFile(flagSet *flag.FlagSet) []string {
+	raw, err := os.ReadFile(c.ConfigFile)
+	if err != nil {
+		return []string{fmt.Sprintf("cannot read config file: %s", err)}
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(raw, &root); err != nil {
+		return []string{fmt.Sprintf("cannot parse config file: %s", err)}
+	}
+	// an empty file has no document node
+	if len(root.Content) == 0 {
+		return nil
+	}
+	options := root.Content[0]
+	if options.Kind != yaml.MappingNode {
+		return []string{"config file must be a mapping of option names to values"}
+	}
+
+	var errs []string
+	for i := 0; i < len(options.Content); i += 2 {
+		key, value := options.Content[i].Value, options.Content[i+1]
+		if key == namespacesKey {
+			errs = append(errs, c.loadNamespaces(value)...)
+			continue
+		}
+		if key == mappingsKey {
+			if err := value.Decode(&c.Mappings); err != nil {
+				errs = append(errs, fmt.Sprintf("config file: %s: %s", mappingsKey, err))
+			}
+			continue
+		}
+		f := flagSet.Lookup(key)
+		if f == nil || key == "config" {
+			errs = append(errs, fmt.Sprintf("config file: unknown option %q", key))
+			continue
+		}
+		// the command line takes precedence over the file
+		if f.Changed {
+			continue
+		}
+		errs = append(errs, setFlag(flagSet, f, value)...)
+	}
+	return errs
+}
+
+func setFlag(flagSet *flag.FlagSet, f *flag.Flag, value *yaml.Node) []string {
+	values := []*yaml.Node{value}
+	if value.Kind == yaml.SequenceNode {
+		if !strings.HasSuffix(f.Value.Type(), "Slice") && !strings.HasSuffix(f.Value.Type(), "Array") {
+			return []string{fmt.Sprintf("config file: %s takes a single value", f.Name)}
+		}
+		values = value.Content
+	}
+	var errs []string
+	for _, each := range values {
+		if each.Kind != yaml.ScalarNode {
+			errs = append(errs, fmt.Sprintf("config file: %s must be a scalar or a list of scalars", f.Name))
+			continue
+		}
+		if err := flagSet.Set(f.Name, each.Value); err != nil {
+			errs = append(errs, fmt.Sprintf("config file: invalid value %q for %s: %s", each.Value, f.Name, err))
+		}
+	}
+	return errs
+}
+
+func (c *Configuration) loadNamespaces(value *yaml.Node) []string {
+	if value.Kind != yaml.MappingNode {
+		return []string{fmt.Sprintf("config file: %s must be a mapping of namespaces to options", namespacesKey)}
+	}
+	// unknown per-namespace options are rejected instead of silently ignored
+	known := map[string]bool{}
+	optionsType := reflect.TypeOf(NamespaceOptions{})
+	for i := 0; i < optionsType.NumField(); i++ {
+		known[optionsType.Field(i).Tag.Get("yaml")] = true
+	}
+	var errs []string
+	for i := 1; i < len(value.Content); i += 2 {
+		if value.Content[i].Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 0; j < len(value.Content[i].Content); j += 2 {
+			key := value.Content[i].Content[j]
+			if !known[key.Value] {
+				errs = append(errs, fmt.Sprintf("config file: line %d: unknown namespace option %q", key.Line, key.Value))
+			}
+		}
+	}
+	if err := value.Decode(&c.Namespaces); err != nil {
+		return append(errs, fmt.Sprintf("config file: %s: %s", namespacesKey, err))
+	}
+
+	for namespace, options := range c.Namespaces {
+		if i := strings.Index(namespace, "."); i <= 0 || i == len(namespace)-1 {
+			errs = append(errs, fmt.Sprintf("config file: %q is not a namespace of the form db.coll", namespace))
+		}
+		if options.SampleSize < 0 || options.Zscore < 0 || options.ErrorRate < 0 {
+			errs = append(errs, fmt.Sprintf("config file: %s: sampleSize, zscore and errRate must not be negative", namespace))
+		}
+		if options.RawFilter.Kind != 0 {
+			filter, err := parseFilter(&options.RawFilter)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("config file: %s: invalid filter: %s", namespace, err))
+			}
+			options.Filter = filter
+		}
+		c.Namespaces[namespace] = options
+	}
+	return errs
+}
+
+// parses a filter given either as an extended JSON string or as a mapping, keeping the order of its fields
+func parseFilter(node *yaml.Node) (bson.D, error) {
+	var extJSON []byte
+	if node.Kind == yaml.ScalarNode {
+		extJSON = []byte(node.Value)
+	} else {
+		var buffer bytes.Buffer
+		if err := writeJSON(&buffer, node); err != nil {
+			return nil, err
+		}
+		extJSON = buffer.Bytes()
+	}
+	var filter bson.D
+	if err := bson.UnmarshalExtJSON(extJSON, false, &filter); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// writes a yaml node as JSON, unlike decoding into a map this keeps the order of mapping keys
+func writeJSON(buffer *bytes.Buffer, node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		buffer.WriteByte('{')
+		for i := 0; i < len(node.Content); i += 2 {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			key, _ := json.Marshal(node.Content[i].Value)
+			buffer.Write(key)
+			buffer.WriteByte(':')
+			if err := writeJSON(buffer, node.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte('}')
+	case yaml.SequenceNode:
+		buffer.WriteByte('[')
+		for i, each := range node.Content {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			if err := writeJSON(buffer, each); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte(']')
+	case yaml.ScalarNode:
+		var value any
+		if err := node.Decode(&value); err != nil {
+			return err
+		}
+		scalar, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		buffer.Write(scalar)
+	default:
+		return fmt.Errorf("unsupported yaml at line %d", node.Line)
+	}
+	return nil
+}
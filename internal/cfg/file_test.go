@@ -0,0 +1,125 @@
+package cfg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	flag "github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// a flag set with a few of the real flags, parsed from args
+type testFlags struct {
+	set          *flag.FlagSet
+	zscore       float64
+	docWorkers   int
+	include      []string
+	sampleMethod string
+}
+
+func newTestFlags(t *testing.T, args ...string) *testFlags {
+	f := &testFlags{set: flag.NewFlagSet("test", flag.ContinueOnError)}
+	f.set.Float64Var(&f.zscore, "zscore", 2.58, "")
+	f.set.IntVar(&f.docWorkers, "docWorkers", 4, "")
+	f.set.StringSliceVar(&f.include, "include", nil, "")
+	f.set.StringVar(&f.sampleMethod, "sampleMethod", "sample", "")
+	f.set.String("config", "", "")
+	assert.Nil(t, f.set.Parse(args))
+	return f
+}
+
+func testConfigFile(t *testing.T, content string) Configuration {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+	return Configuration{ConfigFile: path}
+}
+
+func TestLoadFileFlagsOverrideFile(t *testing.T) {
+	config := testConfigFile(t, `
+zscore: 1.96
+docWorkers: 8
+include: [shop.orders, shop.users]
+`)
+	flags := newTestFlags(t, "--docWorkers", "2")
+	assert.Empty(t, config.loadFile(flags.set))
+	assert.Equal(t, 1.96, flags.zscore)
+	// set on the command line
+	assert.Equal(t, 2, flags.docWorkers)
+	assert.Equal(t, []string{"shop.orders", "shop.users"}, flags.include)
+	// neither set, keeps its default
+	assert.Equal(t, "sample", flags.sampleMethod)
+}
+
+func TestLoadFileReportsEveryProblem(t *testing.T) {
+	config := testConfigFile(t, `
+zscore: high
+unknownOption: 1
+config: other.yaml
+sampleMethod: [sample, rand]
+namespaces:
+  shop.orders:
+    sampleSize: 100
+    sampleSzie: 200
+  shop.users:
+    color: blue
+`)
+	errs := config.loadFile(newTestFlags(t).set)
+	assert.Len(t, errs, 6)
+	assert.Contains(t, errs[0], `invalid value "high" for zscore`)
+	assert.Contains(t, errs[1], `unknown option "unknownOption"`)
+	assert.Contains(t, errs[2], `unknown option "config"`)
+	assert.Contains(t, errs[3], "sampleMethod takes a single value")
+	assert.Contains(t, errs[4], `line 9: unknown namespace option "sampleSzie"`)
+	assert.Contains(t, errs[5], `line 11: unknown namespace option "color"`)
+	// known options are still loaded
+	assert.Equal(t, int64(100), config.NamespaceOptions("shop.orders").SampleSize)
+}
+
+func TestLoadFileInvalidNamespaces(t *testing.T) {
+	config := testConfigFile(t, `
+namespaces:
+  shop:
+    sampleSize: 100
+  shop.orders:
+    zscore: -1
+`)
+	errs := config.loadFile(newTestFlags(t).set)
+	assert.Len(t, errs, 2)
+	assert.ElementsMatch(t, []string{
+		`config file: "shop" is not a namespace of the form db.coll`,
+		"config file: shop.orders: sampleSize, zscore and errRate must not be negative",
+	}, errs)
+}
+
+func TestLoadFileFilterKeepsKeyOrder(t *testing.T) {
+	config := testConfigFile(t, `
+namespaces:
+  shop.orders:
+    filter:
+      status: shipped
+      total: {$gte: 100, $lt: 1000}
+      created: {$gte: {$date: "2024-01-01T00:00:00Z"}}
+      tags: [a, b]
+  shop.users:
+    filter: '{"zone": "eu", "active": true}'
+`)
+	assert.Empty(t, config.loadFile(newTestFlags(t).set))
+
+	filter := config.NamespaceOptions("shop.orders").Filter
+	keys := []string{}
+	for _, each := range filter {
+		keys = append(keys, each.Key)
+	}
+	assert.Equal(t, []string{"status", "total", "created", "tags"}, keys)
+	assert.Equal(t, bson.D{{"$gte", int32(100)}, {"$lt", int32(1000)}}, filter[1].Value)
+	assert.Equal(t, bson.A{"a", "b"}, filter[3].Value)
+
+	assert.Equal(t, bson.D{{"zone", "eu"}, {"active", true}}, config.NamespaceOptions("shop.users").Filter)
+}
+
+func TestLoadFileEmpty(t *testing.T) {
+	config := testConfigFile(t, "")
+	assert.Empty(t, config.loadFile(newTestFlags(t).set))
+}
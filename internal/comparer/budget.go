@@ -0,0 +1,50 @@
+package comparer
+
+import (
+	"context"
+	"sync"
+)
+
+// Bounds the bytes of sampled batches queued or being compared at once
+type byteBudget struct {
+	lock     sync.Mutex
+	capacity int
+	used     int
+	// closed and replaced on every release to wake up waiting producers
+	released chan struct{}
+}
+
+func newByteBudget(capacity int) *byteBudget {
+	return &byteBudget{
+		capacity: capacity,
+		released: make(chan struct{}),
+	}
+}
+
+// blocks until n more bytes fit in the budget, a batch larger than the whole budget only waits for the budget to be
+// empty. Returns false if ctx is done first
+func (b *byteBudget) acquire(ctx context.Context, n int) bool {
+	for {
+		b.lock.Lock()
+		if b.used == 0 || b.used+n <= b.capacity {
+			b.used += n
+			b.lock.Unlock()
+			return true
+		}
+		released := b.released
+		b.lock.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (b *byteBudget) release(n int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.used -= n
+	close(b.released)
+	b.released = make(chan struct{})
+}
@@ -0,0 +1,122 @@
+package comparer
+
+import (
+	"context"
+	"sampler/internal/util"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// acquires n bytes in the background, the returned channel receives the result
+func testAcquire(ctx context.Context, b *byteBudget, n int) chan bool {
+	acquired := make(chan bool, 1)
+	go func() {
+		acquired <- b.acquire(ctx, n)
+	}()
+	return acquired
+}
+
+func testBlocked(t *testing.T, acquired chan bool) {
+	select {
+	case <-acquired:
+		t.Fatal("acquired over the budget")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func testAcquired(t *testing.T, acquired chan bool) {
+	select {
+	case ok := <-acquired:
+		assert.True(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("still blocked after a release")
+	}
+}
+
+func TestByteBudgetAcquireRelease(t *testing.T) {
+	b := newByteBudget(100)
+	assert.True(t, b.acquire(context.Background(), 60))
+	assert.True(t, b.acquire(context.Background(), 40))
+
+	acquired := testAcquire(context.Background(), b, 30)
+	testBlocked(t, acquired)
+	// not enough room yet
+	b.release(10)
+	testBlocked(t, acquired)
+	b.release(30)
+	testAcquired(t, acquired)
+	assert.Equal(t, 90, b.used)
+
+	b.release(60)
+	b.release(30)
+	assert.Equal(t, 0, b.used)
+}
+
+func TestByteBudgetOversizedBatch(t *testing.T) {
+	b := newByteBudget(100)
+	// a batch larger than the budget waits for the budget to empty
+	assert.True(t, b.acquire(context.Background(), 10))
+	oversized := testAcquire(context.Background(), b, 250)
+	testBlocked(t, oversized)
+	b.release(10)
+	testAcquired(t, oversized)
+	assert.Equal(t, 250, b.used)
+
+	// and holds it alone
+	small := testAcquire(context.Background(), b, 1)
+	testBlocked(t, small)
+	b.release(250)
+	testAcquired(t, small)
+	b.release(1)
+
+	// an empty budget takes it right away
+	assert.True(t, b.acquire(context.Background(), 250))
+}
+
+func TestByteBudgetInterrupted(t *testing.T) {
+	b := newByteBudget(100)
+	assert.True(t, b.acquire(context.Background(), 100))
+	ctx, cancel := context.WithCancel(context.Background())
+	acquired := testAcquire(ctx, b, 1)
+	testBlocked(t, acquired)
+	cancel()
+	select {
+	case ok := <-acquired:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("still blocked after cancelling")
+	}
+	// nothing was taken
+	assert.Equal(t, 100, b.used)
+}
+
+func TestByteBudgetConcurrentBatches(t *testing.T) {
+	b := newByteBudget(100)
+	var lock sync.Mutex
+	inFlight, most := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				assert.True(t, b.acquire(context.Background(), n))
+				lock.Lock()
+				inFlight += n
+				most = util.Max(most, inFlight)
+				lock.Unlock()
+				time.Sleep(time.Microsecond)
+				lock.Lock()
+				inFlight -= n
+				lock.Unlock()
+				b.release(n)
+			}
+		}(10 + i*5)
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, most, 100)
+	assert.Equal(t, 0, b.used)
+}
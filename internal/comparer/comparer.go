@@ -3,21 +3,36 @@ package comparer
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"os"
 	"sampler/internal/cfg"
 	"sampler/internal/reporter"
+	"sampler/internal/throttle"
 	"sampler/internal/worker"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+
+	"sampler/internal/util"
 )
 
-// hard code batch size of 100
+// first cursor batch size of a sample, later batches follow the observed document size
 const BATCH_SIZE int = 100
-const NUM_WORKERS int = 4
+const MB int = 1024 * 1024
+
+// how often each cluster is checked for pressure in adaptive mode
+const MONITOR_INTERVAL = 5 * time.Second
+
+// stages of a namespace comparison, reported along with namespaceError
+const (
+	STAGE_COUNT  = "count"
+	STAGE_INDEX  = "index"
+	STAGE_SAMPLE = "sampleDoc"
+)
 
 // Conducts comparison between one or more namespaces.
 // Comparison includes
@@ -30,23 +45,40 @@ type Comparer struct {
 	targetClient mongo.Client
 	reporter     *reporter.Reporter
 	nsFilters    map[string]bson.D
+	// cluster times samples and lookups read at, both nil unless running in snapshot mode
+	clusterTime util.Pair[*primitive.Timestamp]
+	// caps the queries in flight against each cluster, nil when unlimited
+	limiter util.Pair[*throttle.Limiter]
+	result  *Result
+	// checkpoints namespace progress, nil unless reporting to mongo
+	progress *reporter.Progress
+	// progress of the run being resumed, keyed by namespace
+	resumed map[string]reporter.NamespaceProgress
+	// chunks of sharded namespaces lookups are routed with
+	routes *routeCache
+	// filtered populations already counted
+	counts *countCache
 }
 
-// init this comparer's reporter before returning internal struct
-func NewComparer(config cfg.Configuration, source *mongo.Client, target *mongo.Client, meta *mongo.Client, startTime time.Time) Comparer {
+// init this comparer's reporter before returning internal struct, meta is only used when reporting to mongo
+func NewComparer(config cfg.Configuration, source *mongo.Client, target *mongo.Client, meta *mongo.Client, startTime time.Time) (Comparer, error) {
 	nsFilters := make(map[string]bson.D)
-	reporter := reporter.NewReporter(meta, config.MetaDBName, config.CleanMeta, startTime, config.ReportFullDoc)
+	sinks, err := newSinks(config, meta)
+	if err != nil {
+		return Comparer{}, err
+	}
+	rep := reporter.NewReporter(sinks, startTime, config.ReportFullDoc, config.ReportWorkers)
 
 	if config.Filter != "" {
 		var rawMap map[string]json.RawMessage
 		raw, err := os.ReadFile(config.Filter)
 		if err != nil {
-			log.Fatal().Err(err).Msg("")
+			return Comparer{}, fmt.Errorf("cannot read filter file: %w", err)
 		}
 		log.Trace().Msgf("opened and read filter path %s", config.Filter)
 		err = json.Unmarshal(raw, &rawMap)
 		if err != nil {
-			log.Fatal().Err(err).Msg("")
+			return Comparer{}, fmt.Errorf("cannot parse filter file: %w", err)
 		}
 		log.Trace().Msgf("raw map %s", rawMap)
 
@@ -54,31 +86,105 @@ func NewComparer(config cfg.Configuration, source *mongo.Client, target *mongo.C
 			var filter bson.D
 			err = bson.UnmarshalExtJSON(rawValue, false, &filter)
 			if err != nil {
-				log.Fatal().Err(err).Msg("")
+				return Comparer{}, fmt.Errorf("cannot parse filter for %s: %w", namespace, err)
 			}
 
 			nsFilters[namespace] = filter
 		}
 		log.Debug().Msgf("using namespaces filters")
 	}
+	for namespace, options := range config.Namespaces {
+		if options.Filter == nil {
+			continue
+		}
+		if _, ok := nsFilters[namespace]; ok {
+			log.Warn().Msgf("%s has a filter in both the filter file and the config file, using the config file's", namespace)
+		}
+		nsFilters[namespace] = options.Filter
+	}
+
+	var clusterTime util.Pair[*primitive.Timestamp]
+	if config.Compare.Snapshot {
+		if clusterTime.Source, err = snapshotTime(source, config.Compare.SrcClusterTime, "source"); err != nil {
+			return Comparer{}, err
+		}
+		if clusterTime.Target, err = snapshotTime(target, config.Compare.TgtClusterTime, "target"); err != nil {
+			return Comparer{}, err
+		}
+		log.Warn().Msg("snapshot reads fail once the cluster time falls outside the server's minSnapshotHistoryWindowInSeconds (default 5 minutes), raise it on both clusters for long runs")
+	}
+
+	var progress *reporter.Progress
+	resumed := map[string]reporter.NamespaceProgress{}
+	if meta != nil {
+		progress = reporter.NewProgress(meta, config.MetaDBName, startTime)
+	}
+	if !config.ResumeRun.IsZero() {
+		if resumed, err = progress.Load(context.TODO()); err != nil {
+			return Comparer{}, err
+		}
+		log.Info().Msgf("resuming run %s with %d namespaces already started", startTime.UTC().Format(time.RFC3339Nano), len(resumed))
+	}
 
 	return Comparer{
 		config:       config,
 		sourceClient: *source,
 		targetClient: *target,
-		reporter:     &reporter,
+		reporter:     &rep,
 		nsFilters:    nsFilters,
+		clusterTime:  clusterTime,
+		limiter: util.Pair[*throttle.Limiter]{
+			Source: throttle.NewLimiter(config.SourceThrottle),
+			Target: throttle.NewLimiter(config.TargetThrottle),
+		},
+		progress: progress,
+		resumed:  resumed,
+		routes:   newRouteCache(),
+		counts:   newCountCache(),
+	}, nil
+}
+
+// builds every report sink selected in the configuration
+func newSinks(config cfg.Configuration, meta *mongo.Client) ([]reporter.Sink, error) {
+	sinks := []reporter.Sink{}
+	if config.HasSink(cfg.MongoSink) {
+		sinks = append(sinks, reporter.NewMongoSink(meta, config.MetaDBName, config.CleanMeta))
+	}
+	if config.HasSink(cfg.FileSink) {
+		sink, err := reporter.NewFileSink(config.ReportFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open report file: %w", err)
+		}
+		sinks = append(sinks, sink)
 	}
+	if config.HasSink(cfg.StdoutSink) {
+		sinks = append(sinks, reporter.NewStdoutSink())
+	}
+	return sinks, nil
 }
 
-// Preforms comparison on every namespace-pair
-func (c *Comparer) Compare(ctx context.Context) {
+// Preforms comparison on every namespace-pair and returns the aggregated result
+func (c *Comparer) Compare(ctx context.Context) *Result {
 	logger := log.With().Logger()
+	c.result = newResult()
+	c.reporter.RunStatus(reporter.RUN_RUNNING)
+	if c.config.Compare.Seed != 0 {
+		logger.Info().Msgf("sampling with seed %d", c.config.Compare.Seed)
+		c.reporter.RunSeed(c.config.Compare.Seed, c.config.Compare.SeedFraction)
+		c.result.Seed = c.config.Compare.Seed
+	}
+
+	if c.config.Adaptive {
+		monitorCtx, stopMonitors := context.WithCancel(ctx)
+		defer stopMonitors()
+		go throttle.Monitor(monitorCtx, logger.With().Str("c", "throttle").Str("cluster", "source").Logger(), &c.sourceClient, c.limiter.Source, c.config.Pressure, MONITOR_INTERVAL)
+		go throttle.Monitor(monitorCtx, logger.With().Str("c", "throttle").Str("cluster", "target").Logger(), &c.targetClient, c.limiter.Target, c.config.Pressure, MONITOR_INTERVAL)
+	}
 
 	// create threads and start them listening to process namespaces put on the channel
 	namespacesToCompare := make(chan namespacePair)
-	pool := worker.NewWorkerPool(logger, NUM_WORKERS, "namespaceWorkers")
-	pool.Start(func(innerCtx context.Context, innerLogger zerolog.Logger) {
+	pool := worker.NewWorkerPool(logger, c.config.NamespaceWorkers, "namespaceWorkers")
+	pool.Start(ctx, func(innerCtx context.Context, innerLogger zerolog.Logger) {
 		c.processNS(innerCtx, innerLogger, namespacesToCompare)
 	})
 
@@ -88,33 +194,148 @@ func (c *Comparer) Compare(ctx context.Context) {
 	// clean up and wait to signal to reporter that no more namespaces will be added for reporting
 	close(namespacesToCompare)
 	pool.Done()
-	c.reporter.Done(ctx, logger)
-	logger.Info().Msg("all namespaces finished")
+	if ctx.Err() != nil {
+		logger.Warn().Msg("interrupted, writing queued reports before exiting")
+		c.result.Interrupted = true
+		c.reporter.RunStatus(reporter.RUN_INTERRUPTED)
+	} else {
+		c.reporter.RunStatus(reporter.RUN_COMPLETED)
+	}
+	// the reporter is never cancelled so it drains everything queued so far
+	c.reporter.Done(context.WithoutCancel(ctx), logger)
+	c.result.finish()
+	logger.Info().Msgf("all namespaces finished - %s", c.result.Verdict)
+	return c.result
 }
 
-// Preforms comparison on a single namespace-pair
-func (c *Comparer) CompareNs(ctx context.Context, logger zerolog.Logger, namespace namespacePair) {
+// Preforms comparison on a single namespace-pair. A failing stage is reported as a namespaceError
+// and the remaining stages still run, since they usually do not depend on each other
+func (c *Comparer) CompareNs(ctx context.Context, logger zerolog.Logger, namespace namespacePair) *NamespaceResult {
+	result, prior, seen := c.resumedResult(logger, namespace)
 	logger.Info().Msg("beginning validation")
-	c.CompareEstimatedCounts(ctx, logger, namespace)
-	c.CompareIndexes(ctx, logger, namespace)
-	c.CompareSampleDocs(ctx, logger, namespace)
+
+	options := c.config.NamespaceOptions(namespace.String())
+
+	if !prior.HasStage(STAGE_COUNT) && !options.SkipCount {
+		sourceCount, targetCount, err := c.CompareEstimatedCounts(ctx, logger, namespace)
+		if c.stageInterrupted(ctx, logger, namespace, result, STAGE_COUNT, err) {
+			return result
+		}
+		if err == nil {
+			result.SourceCount, result.TargetCount = sourceCount, targetCount
+			result.CountMismatch = sourceCount != targetCount
+			c.checkpoint(ctx, logger, namespace, STAGE_COUNT, result)
+		}
+	}
+
+	if !prior.HasStage(STAGE_INDEX) && !options.SkipIndexes {
+		indexes, err := c.CompareIndexes(ctx, logger, namespace)
+		if c.stageInterrupted(ctx, logger, namespace, result, STAGE_INDEX, err) {
+			return result
+		}
+		if err == nil {
+			result.IndexesMissing = len(indexes.MissingOnSrc) + len(indexes.MissingOnTgt)
+			result.IndexesDifferent = len(indexes.Different)
+			c.checkpoint(ctx, logger, namespace, STAGE_INDEX, result)
+		}
+	}
+
+	if !prior.HasStage(STAGE_SAMPLE) && !options.SkipDocs {
+		// an interrupted attempt may have left part of its sample behind
+		if seen {
+			if err := c.progress.ResetSample(ctx, namespace.String()); err != nil {
+				logger.Warn().Err(err).Msg("unable to reset the previous attempt's sample, its totals will be added to this one")
+			}
+		}
+		docs, err := c.CompareSampleDocs(ctx, logger, namespace)
+		if c.stageInterrupted(ctx, logger, namespace, result, STAGE_SAMPLE, err) {
+			return result
+		}
+		if err == nil {
+			result.Docs = docs
+			c.checkpoint(ctx, logger, namespace, STAGE_SAMPLE, result)
+		}
+	}
+
+	// failed stages are retried when resuming, so only a namespace without errors is done
+	if c.progress != nil && len(result.Errors) == 0 {
+		if err := c.progress.NamespaceDone(ctx, namespace.String(), result); err != nil {
+			logger.Warn().Err(err).Msg("")
+		}
+	}
 	logger.Info().Msg("finished validation")
+	return result
+}
+
+// returns the namespace's result as of the run being resumed, the stages it finished, and whether it was started at all
+func (c *Comparer) resumedResult(logger zerolog.Logger, namespace namespacePair) (*NamespaceResult, reporter.NamespaceProgress, bool) {
+	result := &NamespaceResult{}
+	prior, seen := c.resumed[namespace.String()]
+	if !seen || prior.Result == nil {
+		return result, prior, seen
+	}
+	if err := bson.Unmarshal(prior.Result, result); err != nil {
+		logger.Warn().Err(err).Msg("unable to decode the resumed run's result, comparing from scratch")
+		return &NamespaceResult{}, reporter.NamespaceProgress{}, seen
+	}
+	// errors of the previous attempt are retried
+	result.Errors = nil
+	logger.Info().Strs("stages", prior.Stages).Msg("resuming namespace, skipping finished stages")
+	return result, prior, seen
+}
+
+// records a finished stage when checkpointing, failing to checkpoint only means the stage is redone on resume
+func (c *Comparer) checkpoint(ctx context.Context, logger zerolog.Logger, namespace namespacePair, stage string, result *NamespaceResult) {
+	if c.progress == nil {
+		return
+	}
+	if err := c.progress.StageDone(ctx, namespace.String(), stage, result); err != nil {
+		logger.Warn().Err(err).Str("stage", stage).Msg("")
+	}
+}
+
+// records a failed stage on the namespace result and report. Returns true when the run was interrupted, in which
+// case the error is most likely the cancellation itself and the remaining stages should not run
+func (c *Comparer) stageInterrupted(ctx context.Context, logger zerolog.Logger, namespace namespacePair, result *NamespaceResult, stage string, err error) bool {
+	if ctx.Err() != nil {
+		result.Interrupted = true
+		return true
+	}
+	if err != nil {
+		logger.Error().Err(err).Str("stage", stage).Msg("stage failed, continuing with the remaining stages")
+		c.reporter.NamespaceError(namespace.Names(), stage, err)
+		result.Errors = append(result.Errors, StageError{Stage: stage, Error: err.Error()})
+	}
+	return false
 }
 
 // internal worker method that compares each namespace channel it recieves on the channel
 func (c *Comparer) processNS(ctx context.Context, logger zerolog.Logger, jobs chan namespacePair) {
 	for namespace := range jobs {
-		logger = logger.With().Str("ns", namespace.String()).Logger()
-		c.CompareNs(ctx, logger, namespace)
+		if ctx.Err() != nil {
+			continue
+		}
+		nsContext := logger.With().Str("ns", namespace.String())
+		if namespace.TargetString() != namespace.String() {
+			nsContext = nsContext.Str("tgtNs", namespace.TargetString())
+		}
+		nsLogger := nsContext.Logger()
+		if prior := c.resumed[namespace.String()]; prior.Done {
+			result, _, _ := c.resumedResult(nsLogger, namespace)
+			nsLogger.Info().Msg("finished in the resumed run, skipping")
+			c.result.addNamespace(namespace.String(), result)
+			continue
+		}
+		c.result.addNamespace(namespace.String(), c.CompareNs(ctx, nsLogger, namespace))
 	}
 }
 
 // internal helper to return a handle to the source collection for a namespace
-func (c *Comparer) sourceCollection(db string, coll string) *mongo.Collection {
-	return c.sourceClient.Database(db).Collection(coll)
+func (c *Comparer) sourceCollection(namespace namespacePair) *mongo.Collection {
+	return c.sourceClient.Database(namespace.Db).Collection(namespace.Collection)
 }
 
-// internal helper to return a handle to the target collection for a namespace
-func (c *Comparer) targetCollection(db string, coll string) *mongo.Collection {
-	return c.targetClient.Database(db).Collection(coll)
+// internal helper to return a handle to the target collection for a namespace, resolved through the namespace mapping
+func (c *Comparer) targetCollection(namespace namespacePair) *mongo.Collection {
+	return c.targetClient.Database(namespace.TargetDb).Collection(namespace.TargetCollection)
 }
@@ -0,0 +1,30 @@
+package comparer
+
+import (
+	"os"
+	"path/filepath"
+	"sampler/internal/cfg"
+	"sampler/internal/reporter"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSinks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reports.jsonl")
+	sinks, err := newSinks(cfg.Configuration{Reports: []string{cfg.FileSink, cfg.StdoutSink}, ReportFile: path}, nil)
+	assert.Nil(t, err)
+	if assert.Len(t, sinks, 2) {
+		assert.IsType(t, &reporter.JSONSink{}, sinks[0])
+		assert.IsType(t, &reporter.JSONSink{}, sinks[1])
+	}
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+
+	sinks, err = newSinks(cfg.Configuration{}, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, sinks)
+
+	_, err = newSinks(cfg.Configuration{Reports: []string{cfg.FileSink}, ReportFile: filepath.Join(t.TempDir(), "missing", "reports.jsonl")}, nil)
+	assert.ErrorContains(t, err, "cannot open report file")
+}
@@ -2,34 +2,95 @@ package comparer
 
 import (
 	"context"
+	"fmt"
+	"sampler/internal/throttle"
+	"sync"
 
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func (c *Comparer) CompareEstimatedCounts(ctx context.Context, logger zerolog.Logger, namespace namespacePair) {
+// Filtered counts already taken, keyed by collection and filter. A filtered count is a $count over every matching
+// document, so a namespace or stratum is only counted once per side. Counts are pinned to the snapshot cluster time
+// when there is one, otherwise the first count stands for the rest of the run like an estimate would
+type countCache struct {
+	lock   sync.Mutex
+	counts map[string]int64
+}
+
+func newCountCache() *countCache {
+	return &countCache{counts: map[string]int64{}}
+}
+
+// returns the number of documents of coll matching filter, see countFiltered
+func (c *countCache) filtered(ctx context.Context, limiter *throttle.Limiter, coll *mongo.Collection, at *primitive.Timestamp, filter bson.D) (int64, error) {
+	json, err := bson.MarshalExtJSON(filter, true, false)
+	if err != nil {
+		return countFiltered(ctx, limiter, coll, at, filter)
+	}
+	// both sides may share a namespace name, so the client tells them apart
+	key := fmt.Sprintf("%p %s.%s %s", coll.Database().Client(), coll.Database().Name(), coll.Name(), json)
+	return c.get(key, func() (int64, error) {
+		return countFiltered(ctx, limiter, coll, at, filter)
+	})
+}
+
+// returns the count cached under key, taking it with count when missing. Failed counts are not cached
+func (c *countCache) get(key string, count func() (int64, error)) (int64, error) {
+	c.lock.Lock()
+	n, ok := c.counts[key]
+	c.lock.Unlock()
+	if ok {
+		return n, nil
+	}
+	n, err := count()
+	if err != nil {
+		return 0, err
+	}
+	c.lock.Lock()
+	c.counts[key] = n
+	c.lock.Unlock()
+	return n, nil
+}
+
+// compares and returns the estimated document counts of the source and target
+func (c *Comparer) CompareEstimatedCounts(ctx context.Context, logger zerolog.Logger, namespace namespacePair) (int64, int64, error) {
 	logger = logger.With().Str("c", "count").Logger()
-	sourceCount, targetCount := c.GetEstimates(ctx, namespace)
+	sourceCount, targetCount, err := c.GetEstimates(ctx, namespace)
+	if err != nil {
+		return 0, 0, err
+	}
 	logger.Info().Msgf("source estimate docs: %d, target estimate docs: %d", sourceCount, targetCount)
 
 	if sourceCount != targetCount {
-		c.reporter.MismatchCount(namespace.String(), sourceCount, targetCount)
+		c.reporter.MismatchCount(namespace.Names(), sourceCount, targetCount)
 		logger.Warn().Msg("estimated document counts don't match. (NOTE: this could be the result of metadata differences from unclean shutdowns, consider running a more exact countDocuments if all other tests pass)")
 	} else {
 		logger.Info().Msg("estimated document match")
 	}
+	return sourceCount, targetCount, nil
 }
 
-func (c *Comparer) GetEstimates(ctx context.Context, namespace namespacePair) (int64, int64) {
-	sourceCount, err := c.sourceCollection(namespace.Db, namespace.Collection).EstimatedDocumentCount(context.TODO())
+func (c *Comparer) GetEstimates(ctx context.Context, namespace namespacePair) (int64, int64, error) {
+	if err := c.limiter.Source.Acquire(ctx); err != nil {
+		return 0, 0, err
+	}
+	sourceCount, err := c.sourceCollection(namespace).EstimatedDocumentCount(ctx)
+	c.limiter.Source.Release()
 	if err != nil {
-		log.Fatal().Err(err).Msg("")
+		return 0, 0, fmt.Errorf("source estimated document count: %w", err)
 	}
 
-	targetCount, err := c.targetCollection(namespace.Db, namespace.Collection).EstimatedDocumentCount(context.TODO())
+	if err := c.limiter.Target.Acquire(ctx); err != nil {
+		return 0, 0, err
+	}
+	targetCount, err := c.targetCollection(namespace).EstimatedDocumentCount(ctx)
+	c.limiter.Target.Release()
 	if err != nil {
-		log.Fatal().Err(err).Msg("")
+		return 0, 0, fmt.Errorf("target estimated document count: %w", err)
 	}
 
-	return sourceCount, targetCount
+	return sourceCount, targetCount, nil
 }
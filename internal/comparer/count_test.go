@@ -0,0 +1,34 @@
+package comparer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountCache(t *testing.T) {
+	cache := newCountCache()
+	counted := 0
+	count := func(n int64, err error) func() (int64, error) {
+		return func() (int64, error) {
+			counted++
+			return n, err
+		}
+	}
+
+	// failed counts are taken again
+	_, err := cache.get("shop.orders", count(0, errors.New("interrupted")))
+	assert.Error(t, err)
+	n, err := cache.get("shop.orders", count(10, nil))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), n)
+	n, err = cache.get("shop.orders", count(20, nil))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), n)
+	assert.Equal(t, 2, counted)
+
+	n, _ = cache.get("shop.users", count(3, nil))
+	assert.Equal(t, int64(3), n)
+	assert.Equal(t, 3, counted)
+}
@@ -0,0 +1,66 @@
+package comparer
+
+import (
+	"context"
+
+	"sampler/internal/util"
+
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// most inconsistent documents whose neighbours are compared per namespace
+const MAX_FOCUS_CENTERS = 100
+
+// Returns the sources reading the Compare.FocusDocs documents matching filter before and after each inconsistent document
+// in _id order, from the side it was sampled on. Inconsistencies often cluster in a range of _ids (and so, with ObjectIds,
+// a time window) a replicator skipped, the neighbours tell how far such a range reaches
+func (c *Comparer) focusSources(ctx context.Context, logger zerolog.Logger, namespace namespacePair, filter bson.D, inconsistent []inconsistentDoc) []sampleSource {
+	centers := inconsistent
+	if len(centers) > MAX_FOCUS_CENTERS {
+		logger.Warn().Msgf("focusing on the first %d of %d inconsistent documents", MAX_FOCUS_CENTERS, len(centers))
+		centers = centers[:MAX_FOCUS_CENTERS]
+	}
+	logger.Info().Msgf("comparing up to %d documents on each side of %d inconsistent documents", c.config.Compare.FocusDocs, len(centers))
+
+	opts := options.Aggregate().SetBatchSize(int32(util.Min(c.config.Compare.FocusDocs, c.config.Compare.BatchDocs)))
+	sources := make([]sampleSource, 0, 2*len(centers))
+	for _, center := range centers {
+		coll, at, limiter := c.sourceCollection(namespace), c.clusterTime.Source, c.limiter.Source
+		if center.dir == util.TgtToSrc {
+			coll, at, limiter = c.targetCollection(namespace), c.clusterTime.Target, c.limiter.Target
+		}
+		id := center.doc.Lookup("_id")
+		for _, side := range []struct {
+			operator string
+			order    int
+		}{{"$lt", -1}, {"$gt", 1}} {
+			pipeline := c.neighbourPipeline(namespace, filter, id, side.operator, side.order)
+			sources = append(sources, sampleSource{
+				dir:     center.dir,
+				limiter: limiter,
+				open: func() (*mongo.Cursor, error) {
+					logger.Debug().Any("pipeline", pipeline).Msg("aggregating neighbours")
+					return aggregate(ctx, limiter, coll, at, pipeline, opts)
+				},
+			})
+		}
+	}
+	return sources
+}
+
+// returns the pipeline reading the Compare.FocusDocs documents matching filter closest to id on one side of it, operator
+// and order are $lt and -1 for the documents before it and $gt and 1 for those after it
+func (c *Comparer) neighbourPipeline(namespace namespacePair, filter bson.D, id bson.RawValue, operator string, order int) bson.A {
+	match := bson.D{{"_id", bson.D{{operator, id}}}}
+	if filter != nil {
+		match = bson.D{{"$and", bson.A{filter, match}}}
+	}
+	return c.samplePipeline(namespace, bson.A{
+		bson.D{{"$match", match}},
+		bson.D{{"$sort", bson.D{{"_id", order}}}},
+		bson.D{{"$limit", c.config.Compare.FocusDocs}},
+	})
+}
@@ -0,0 +1,48 @@
+package comparer
+
+import (
+	"context"
+	"sampler/internal/cfg"
+	"sampler/internal/util"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestFocusSources(t *testing.T) {
+	c := &Comparer{config: cfg.Configuration{Compare: cfg.Compare{FocusDocs: 5, BatchDocs: 100}}}
+	inconsistent := []inconsistentDoc{}
+	for i := 0; i < MAX_FOCUS_CENTERS+20; i++ {
+		dir := util.SrcToTgt
+		if i%2 == 1 {
+			dir = util.TgtToSrc
+		}
+		inconsistent = append(inconsistent, inconsistentDoc{dir: dir, doc: testRaw(bson.D{{"_id", i}})})
+	}
+
+	// the neighbours on both sides of the first MAX_FOCUS_CENTERS documents, read from the side they were sampled on
+	sources := c.focusSources(context.Background(), zerolog.Nop(), namespacePair{}, nil, inconsistent)
+	if assert.Len(t, sources, 2*MAX_FOCUS_CENTERS) {
+		for i, each := range sources {
+			assert.Equal(t, inconsistent[i/2].dir, each.dir, i)
+		}
+	}
+	assert.Len(t, c.focusSources(context.Background(), zerolog.Nop(), namespacePair{}, nil, inconsistent[:3]), 6)
+}
+
+func TestNeighbourPipeline(t *testing.T) {
+	c := &Comparer{config: cfg.Configuration{Compare: cfg.Compare{FocusDocs: 5}}}
+	id := testRaw(bson.D{{"_id", 7}}).Lookup("_id")
+	assert.Equal(t, `[{"$match":{"_id":{"$lt":7}}},{"$sort":{"_id":-1}},{"$limit":5}]`,
+		testPipelineJSON(t, c.neighbourPipeline(namespacePair{}, nil, id, "$lt", -1)))
+	assert.Equal(t, `[{"$match":{"$and":[{"region":"eu"},{"_id":{"$gt":7}}]}},{"$sort":{"_id":1}},{"$limit":5}]`,
+		testPipelineJSON(t, c.neighbourPipeline(namespacePair{}, bson.D{{"region", "eu"}}, id, "$gt", 1)))
+}
+
+func testPipelineJSON(t *testing.T, pipeline bson.A) string {
+	json, err := bson.MarshalExtJSON(bson.D{{"p", pipeline}}, false, false)
+	assert.Nil(t, err)
+	return string(json)[5 : len(json)-1]
+}
@@ -0,0 +1,159 @@
+package comparer
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"sampler/internal/reporter"
+	"sampler/internal/util"
+
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// field holding the server side digest of a document in hash mode
+const HASH_FIELD = "__sampleHash"
+
+// levels of embedded documents and arrays the digest rewrites, a document nested deeper is always fetched in full
+const MAX_DIGEST_DEPTH = 8
+
+// largest magnitude below which every integral double or decimal is hashed exactly
+const maxExactHash = 1 << 53
+
+// Projects a document down to its _id, shard key and a digest of the (already projected) document. $toHashedIndexKey
+// truncates doubles and decimals to integers and hashes equal numbers of different types alike, so the document is
+// hashed with every number paired with its type. Documents holding fractional, huge or NaN numbers, or nested deeper
+// than MAX_DIGEST_DEPTH, get a random digest and are always fetched and compared in full
+func hashStage(namespace namespacePair) bson.D {
+	projection := bson.D{{"_id", 1}}
+	for _, each := range shardKeyFields(namespace) {
+		if each != "_id" {
+			projection = append(projection, bson.E{each, 1})
+		}
+	}
+	projection = append(projection, bson.E{HASH_FIELD, bson.D{{"$toHashedIndexKey", digestValue("$$ROOT", MAX_DIGEST_DEPTH)}}})
+	return bson.D{{"$project", projection}}
+}
+
+// Returns an expression rewriting value so $toHashedIndexKey hashes it without losing numeric types or fractions.
+// Numbers become {t: type, v: number}, embedded documents and arrays are rewritten down to depth more levels
+func digestValue(value string, depth int) bson.D {
+	kind := bson.D{{"$type", value}}
+	typed := bson.D{{"t", kind}, {"v", value}}
+	// a random digest never matches the other side's, scaled up since the hash truncates $rand's fraction to 0
+	unverifiable := bson.D{{"$multiply", bson.A{bson.D{{"$rand", bson.D{}}}, math.Exp2(62)}}}
+	branches := bson.A{
+		bson.D{{"case", bson.D{{"$in", bson.A{kind, bson.A{"int", "long"}}}}}, {"then", typed}},
+		bson.D{{"case", bson.D{{"$in", bson.A{kind, bson.A{"double", "decimal"}}}}}, {"then", bson.D{{"$cond", bson.A{
+			// NaN orders below every number so it fails the lower bound
+			bson.D{{"$and", bson.A{
+				bson.D{{"$eq", bson.A{value, bson.D{{"$trunc", value}}}}},
+				bson.D{{"$gt", bson.A{value, -maxExactHash}}},
+				bson.D{{"$lt", bson.A{value, maxExactHash}}},
+			}}},
+			typed,
+			unverifiable,
+		}}}}},
+	}
+	container := bson.D{{"$in", bson.A{kind, bson.A{"object", "array"}}}}
+	if depth == 0 {
+		branches = append(branches, bson.D{{"case", container}, {"then", unverifiable}})
+		return bson.D{{"$switch", bson.D{{"branches", branches}, {"default", value}}}}
+	}
+
+	// arrays are rewritten as lists of {k, v} like documents so both share a single nested rewrite
+	field, children := fmt.Sprintf("f%d", depth), fmt.Sprintf("c%d", depth)
+	isArray := bson.D{{"$isArray", bson.A{value}}}
+	elements := bson.D{{"$map", bson.D{{"input", value}, {"as", field}, {"in", bson.D{{"k", ""}, {"v", "$$" + field}}}}}}
+	rewritten := bson.D{{"$map", bson.D{
+		{"input", bson.D{{"$cond", bson.A{isArray, elements, bson.D{{"$objectToArray", value}}}}}},
+		{"as", field},
+		{"in", bson.D{{"k", "$$" + field + ".k"}, {"v", digestValue("$$"+field+".v", depth-1)}}},
+	}}}
+	rebuilt := bson.D{{"$cond", bson.A{
+		isArray,
+		bson.D{{"$map", bson.D{{"input", "$$" + children}, {"as", field}, {"in", "$$" + field + ".v"}}}},
+		bson.D{{"$arrayToObject", bson.A{"$$" + children}}},
+	}}}
+	branches = append(branches, bson.D{{"case", container}, {"then", bson.D{{"$let", bson.D{
+		{"vars", bson.D{{children, rewritten}}},
+		{"in", rebuilt},
+	}}}}})
+	return bson.D{{"$switch", bson.D{{"branches", branches}, {"default", value}}}}
+}
+
+// looks up the digests of a batch of hashed documents on the opposite side
+func (c *Comparer) batchHashes(ctx context.Context, logger zerolog.Logger, namespace namespacePair, toFind documentBatch) (documentBatch, error) {
+	coll, at, limiter := c.lookupCollection(logger, namespace, toFind.dir)
+	buffer, err := c.lookup(ctx, logger, namespace, toFind, limiter, func(query bson.D) (*mongo.Cursor, error) {
+		pipeline := bson.A{bson.D{{"$match", query}}}
+		if projection := c.projection(namespace); projection != nil {
+			pipeline = append(pipeline, bson.D{{"$project", projection}})
+		}
+		pipeline = append(pipeline, hashStage(namespace))
+		logger.Debug().Any("pipeline", pipeline).Msg("aggregating digests")
+		return aggregate(ctx, limiter, coll, at, pipeline, options.Aggregate().SetBatchSize(int32(len(toFind.batch))))
+	})
+	if err != nil {
+		return documentBatch{}, fmt.Errorf("%s batch hash: %w", toFind.dir, err)
+	}
+	return documentBatch{
+		dir:   toFind.dir,
+		batch: buffer,
+	}, nil
+}
+
+// compares a batch of sampled digests against the opposite side's, only fetching the documents whose digests differ or
+// are missing from both sides to compare them with batchCompare
+func (c *Comparer) hashCompare(ctx context.Context, logger zerolog.Logger, namespace namespacePair, sampled documentBatch) (reporter.DocSummary, []inconsistentDoc, error) {
+	var summary reporter.DocSummary
+	lookedUp, err := c.batchHashes(ctx, logger, namespace, sampled)
+	if err != nil {
+		return summary, nil, err
+	}
+
+	var candidates batch
+	summary.Equal, candidates = hashCandidates(sampled.batch, lookedUp.batch)
+	if len(candidates) == 0 {
+		return summary, nil, nil
+	}
+	logger.Debug().Msgf("fetching %d of %d documents whose digests differ", len(candidates), len(sampled.batch))
+
+	// batchFind looks up on the opposite side of the direction it is given
+	opposite := util.TgtToSrc
+	if sampled.dir == util.TgtToSrc {
+		opposite = util.SrcToTgt
+	}
+	same, err := c.batchFind(ctx, logger, namespace, documentBatch{dir: opposite, batch: candidates})
+	if err != nil {
+		return summary, nil, err
+	}
+	other, err := c.batchFind(ctx, logger, namespace, documentBatch{dir: sampled.dir, batch: candidates})
+	if err != nil {
+		return summary, nil, err
+	}
+	if len(same.batch) < len(candidates) {
+		logger.Debug().Msgf("%d sampled documents were deleted before they were fetched", len(candidates)-len(same.batch))
+	}
+	compared, inconsistent := c.batchCompare(ctx, logger, namespace, documentBatch{dir: sampled.dir, batch: same.batch}, other)
+	compared.Equal += summary.Equal
+	return compared, inconsistent, nil
+}
+
+// returns how many sampled documents have the same digest on the other side and the ones that must be fetched in full
+func hashCandidates(sampled batch, lookedUp batch) (int, batch) {
+	equal := 0
+	candidates := make(batch)
+	for key, aDoc := range sampled {
+		bDoc, ok := lookedUp[key]
+		if ok && aDoc.Lookup(HASH_FIELD).Equal(bDoc.Lookup(HASH_FIELD)) {
+			equal++
+			continue
+		}
+		candidates[key] = aDoc
+	}
+	return equal, candidates
+}
@@ -0,0 +1,272 @@
+package comparer
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// evaluates the subset of aggregation expressions digestValue builds, documents are bson.D and arrays bson.A
+func testEval(t *testing.T, expr interface{}, vars map[string]interface{}) interface{} {
+	switch e := expr.(type) {
+	case string:
+		if !strings.HasPrefix(e, "$$") {
+			return e
+		}
+		path := strings.Split(e[2:], ".")
+		value := vars[path[0]]
+		for _, field := range path[1:] {
+			value = testField(value.(bson.D), field)
+		}
+		return value
+	case bson.A:
+		ret := bson.A{}
+		for _, each := range e {
+			ret = append(ret, testEval(t, each, vars))
+		}
+		return ret
+	case bson.D:
+		if len(e) != 1 || !strings.HasPrefix(e[0].Key, "$") {
+			ret := bson.D{}
+			for _, each := range e {
+				ret = append(ret, bson.E{each.Key, testEval(t, each.Value, vars)})
+			}
+			return ret
+		}
+		return testOperator(t, e[0].Key, e[0].Value, vars)
+	}
+	return expr
+}
+
+func testField(doc bson.D, field string) interface{} {
+	for _, each := range doc {
+		if each.Key == field {
+			return each.Value
+		}
+	}
+	return nil
+}
+
+func testOperator(t *testing.T, operator string, arg interface{}, vars map[string]interface{}) interface{} {
+	args := func() bson.A { return testEval(t, arg, vars).(bson.A) }
+	switch operator {
+	case "$type":
+		switch testEval(t, arg, vars).(type) {
+		case int32:
+			return "int"
+		case int64:
+			return "long"
+		case float64:
+			return "double"
+		case bson.D:
+			return "object"
+		case bson.A:
+			return "array"
+		case string:
+			return "string"
+		}
+		return "missing"
+	case "$in":
+		values := args()
+		for _, each := range values[1].(bson.A) {
+			if each == values[0] {
+				return true
+			}
+		}
+		return false
+	case "$switch":
+		for _, each := range testField(arg.(bson.D), "branches").(bson.A) {
+			if testEval(t, testField(each.(bson.D), "case"), vars).(bool) {
+				return testEval(t, testField(each.(bson.D), "then"), vars)
+			}
+		}
+		return testEval(t, testField(arg.(bson.D), "default"), vars)
+	case "$cond":
+		branches := arg.(bson.A)
+		if testEval(t, branches[0], vars).(bool) {
+			return testEval(t, branches[1], vars)
+		}
+		return testEval(t, branches[2], vars)
+	case "$and":
+		for _, each := range arg.(bson.A) {
+			if !testEval(t, each, vars).(bool) {
+				return false
+			}
+		}
+		return true
+	case "$eq", "$gt", "$lt":
+		values := args()
+		cmp := testCompareNumbers(testNumber(values[0]), testNumber(values[1]))
+		return map[string]bool{"$eq": cmp == 0, "$gt": cmp > 0, "$lt": cmp < 0}[operator]
+	case "$trunc":
+		return math.Trunc(testNumber(testEval(t, arg, vars)))
+	case "$rand":
+		return rand.Float64()
+	case "$multiply":
+		values := args()
+		return testNumber(values[0]) * testNumber(values[1])
+	case "$isArray":
+		_, ok := args()[0].(bson.A)
+		return ok
+	case "$objectToArray":
+		ret := bson.A{}
+		for _, each := range testEval(t, arg, vars).(bson.D) {
+			ret = append(ret, bson.D{{"k", each.Key}, {"v", each.Value}})
+		}
+		return ret
+	case "$arrayToObject":
+		ret := bson.D{}
+		for _, each := range args()[0].(bson.A) {
+			ret = append(ret, bson.E{testField(each.(bson.D), "k").(string), testField(each.(bson.D), "v")})
+		}
+		return ret
+	case "$map", "$let":
+		spec := arg.(bson.D)
+		if operator == "$let" {
+			scope := map[string]interface{}{}
+			for key, value := range vars {
+				scope[key] = value
+			}
+			for _, each := range testField(spec, "vars").(bson.D) {
+				scope[each.Key] = testEval(t, each.Value, vars)
+			}
+			return testEval(t, testField(spec, "in"), scope)
+		}
+		ret := bson.A{}
+		for _, each := range testEval(t, testField(spec, "input"), vars).(bson.A) {
+			scope := map[string]interface{}{}
+			for key, value := range vars {
+				scope[key] = value
+			}
+			scope[testField(spec, "as").(string)] = each
+			ret = append(ret, testEval(t, testField(spec, "in"), scope))
+		}
+		return ret
+	}
+	t.Fatalf("unsupported operator %s", operator)
+	return nil
+}
+
+func testNumber(value interface{}) float64 {
+	switch n := value.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return math.NaN()
+}
+
+// orders numbers like the server, NaN equals itself and orders below every other number
+func testCompareNumbers(a, b float64) int {
+	switch {
+	case math.IsNaN(a) && math.IsNaN(b):
+		return 0
+	case math.IsNaN(a):
+		return -1
+	case math.IsNaN(b):
+		return 1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// hashes like $toHashedIndexKey, numbers of every type are truncated to integers
+func testHash(value interface{}) string {
+	switch v := value.(type) {
+	case int32, int64, float64:
+		return fmt.Sprintf("n%d", int64(testNumber(v)))
+	case bson.D:
+		ret := "{"
+		for _, each := range v {
+			ret += each.Key + ":" + testHash(each.Value) + ","
+		}
+		return ret + "}"
+	case bson.A:
+		ret := "["
+		for _, each := range v {
+			ret += testHash(each) + ","
+		}
+		return ret + "]"
+	}
+	return fmt.Sprintf("%T:%v", value, value)
+}
+
+func testDigest(t *testing.T, doc bson.D) string {
+	return testHash(testEval(t, digestValue("$$ROOT", MAX_DIGEST_DEPTH), map[string]interface{}{"ROOT": doc}))
+}
+
+func testDigests(t *testing.T, digest func(bson.D) string, docs ...bson.D) batch {
+	ret := []bson.D{}
+	for _, each := range docs {
+		ret = append(ret, bson.D{{"_id", each[0].Value}, {HASH_FIELD, digest(each)}})
+	}
+	return testBatch(ret...)
+}
+
+func TestDigestKeepsNumericTypesAndFractions(t *testing.T) {
+	nested := bson.D{{"a", bson.D{{"b", bson.A{int64(5), 2.0, bson.D{{"c", "x"}}}}}}}
+	deep := interface{}("leaf")
+	for i := 0; i < MAX_DIGEST_DEPTH+1; i++ {
+		deep = bson.A{deep}
+	}
+	source := []bson.D{
+		{{"_id", 1}, {"x", 1.2}},
+		{{"_id", 2}, {"x", int32(1)}},
+		{{"_id", 3}, {"x", int64(7)}, {"nested", nested}},
+		{{"_id", 4}, {"deep", deep}},
+		{{"_id", 5}, {"x", math.NaN()}},
+		{{"_id", 6}, {"x", bson.A{int32(1), 2.5}}},
+	}
+	target := []bson.D{
+		// fractional only
+		{{"_id", 1}, {"x", 1.7}},
+		// type only
+		{{"_id", 2}, {"x", 1.0}},
+		{{"_id", 3}, {"x", int64(7)}, {"nested", nested}},
+		{{"_id", 4}, {"deep", deep}},
+		{{"_id", 5}, {"x", math.NaN()}},
+		{{"_id", 6}, {"x", bson.A{int32(1), 2.5}}},
+	}
+
+	// hashing the documents as is misses both differences
+	lossy := func(doc bson.D) string { return testHash(doc) }
+	equal, candidates := hashCandidates(testDigests(t, lossy, source...), testDigests(t, lossy, target...))
+	assert.Equal(t, 6, equal)
+	assert.Empty(t, candidates)
+
+	digest := func(doc bson.D) string { return testDigest(t, doc) }
+	equal, candidates = hashCandidates(testDigests(t, digest, source...), testDigests(t, digest, target...))
+	// only the identical document made of integers, strings and integral doubles is equal by digest
+	assert.Equal(t, 1, equal)
+	assert.ElementsMatch(t, []int32{1, 2, 4, 5, 6}, testIds(candidates))
+}
+
+func TestHashCandidatesMissing(t *testing.T) {
+	digest := func(doc bson.D) string { return testDigest(t, doc) }
+	sampled := testDigests(t, digest, bson.D{{"_id", 1}, {"x", "a"}}, bson.D{{"_id", 2}, {"x", "b"}})
+	lookedUp := testDigests(t, digest, bson.D{{"_id", 1}, {"x", "a"}})
+	equal, candidates := hashCandidates(sampled, lookedUp)
+	assert.Equal(t, 1, equal)
+	assert.Equal(t, []int32{2}, testIds(candidates))
+}
+
+func testIds(b batch) []int32 {
+	ids := []int32{}
+	for _, each := range b {
+		ids = append(ids, each.Lookup("_id").Int32())
+	}
+	return ids
+}
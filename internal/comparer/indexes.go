@@ -2,19 +2,23 @@ package comparer
 
 import (
 	"context"
+	"fmt"
 
 	"sampler/internal/diff"
 	"sampler/internal/idx"
 
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-func (c *Comparer) CompareIndexes(ctx context.Context, logger zerolog.Logger, namespace namespacePair) {
+// compares and returns the difference between the source and target indexes
+func (c *Comparer) CompareIndexes(ctx context.Context, logger zerolog.Logger, namespace namespacePair) (diff.Diff[idx.Index], error) {
 	logger = logger.With().Str("c", "index").Logger()
 
-	source, target := c.getSortedIndexes(ctx, namespace)
+	source, target, err := c.getSortedIndexes(ctx, namespace)
+	if err != nil {
+		return diff.Diff[idx.Index]{}, err
+	}
 	comparison := diff.CompareSorted(logger, source, target)
 
 	logger.Trace().Msgf("%s", comparison.String())
@@ -25,19 +29,20 @@ func (c *Comparer) CompareIndexes(ctx context.Context, logger zerolog.Logger, na
 	}
 	for _, each := range comparison.MissingOnSrc {
 		logger.Error().Msgf("%s is missing on the source", each.Name)
-		c.reporter.MissingIndex(namespace.String(), each.Raw, "source")
+		c.reporter.MissingIndex(namespace.Names(), each.Raw, "source")
 	}
 	for _, each := range comparison.MissingOnTgt {
 		logger.Error().Msgf("%s is missing on the target", each.Name)
-		c.reporter.MissingIndex(namespace.String(), each.Raw, "target")
+		c.reporter.MissingIndex(namespace.Names(), each.Raw, "target")
 	}
 	for _, each := range comparison.Different {
 		logger.Error().Msgf("%s is different between the source and target", each.Source.Name)
-		c.reporter.MismatchIndex(namespace.String(), each.Source.Raw, each.Target.Raw)
+		c.reporter.MismatchIndex(namespace.Names(), each.Source.Raw, each.Target.Raw)
 	}
+	return comparison, nil
 }
 
-func (c *Comparer) getSortedIndexes(ctx context.Context, namespace namespacePair) ([]idx.Index, []idx.Index) {
+func (c *Comparer) getSortedIndexes(ctx context.Context, namespace namespacePair) ([]idx.Index, []idx.Index, error) {
 	var sourceSpecs, targetSpecs []bson.Raw
 	sortedIndexesPipeline := bson.A{
 		bson.D{{"$indexStats", bson.D{}}},
@@ -45,22 +50,22 @@ func (c *Comparer) getSortedIndexes(ctx context.Context, namespace namespacePair
 		bson.D{{"$replaceRoot", bson.D{{"newRoot", "$spec"}}}},
 		bson.D{{"$project", bson.D{{"ns", 0}}}},
 	}
-	sourceCursor, err := c.sourceCollection(namespace.Db, namespace.Collection).Aggregate(ctx, sortedIndexesPipeline)
+	sourceCursor, err := aggregate(ctx, c.limiter.Source, c.sourceCollection(namespace), nil, sortedIndexesPipeline, nil)
 	if err != nil {
-		log.Fatal().Err(err).Msg("")
+		return nil, nil, fmt.Errorf("source $indexStats: %w", err)
 	}
 	err = sourceCursor.All(ctx, &sourceSpecs)
 	if err != nil {
-		log.Fatal().Err(err).Msg("source index specification decoding error")
+		return nil, nil, fmt.Errorf("source index specification decoding error: %w", err)
 	}
-	targetCursor, err := c.targetCollection(namespace.Db, namespace.Collection).Aggregate(ctx, sortedIndexesPipeline)
+	targetCursor, err := aggregate(ctx, c.limiter.Target, c.targetCollection(namespace), nil, sortedIndexesPipeline, nil)
 	if err != nil {
-		log.Fatal().Err(err).Msg("")
+		return nil, nil, fmt.Errorf("target $indexStats: %w", err)
 	}
 	err = targetCursor.All(ctx, &targetSpecs)
 	if err != nil {
-		log.Fatal().Err(err).Msg("target index specification decoding error")
+		return nil, nil, fmt.Errorf("target index specification decoding error: %w", err)
 	}
 
-	return idx.FromBson(sourceSpecs), idx.FromBson(targetSpecs)
+	return idx.FromBson(sourceSpecs), idx.FromBson(targetSpecs), nil
 }
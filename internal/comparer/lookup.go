@@ -0,0 +1,262 @@
+package comparer
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"sampler/internal/throttle"
+	"sampler/internal/util"
+
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// number of lookup queries of a single batch in flight at once
+const LOOKUP_CONCURRENCY int = 4
+
+// returns the collection documents sampled in a direction are looked up on, the cluster time to read it at and the
+// limiter of its cluster
+func (c *Comparer) lookupCollection(logger zerolog.Logger, namespace namespacePair, dir util.Direction) (*mongo.Collection, *primitive.Timestamp, *throttle.Limiter) {
+	switch dir {
+	case util.SrcToTgt:
+		return c.targetCollection(namespace), c.clusterTime.Target, c.limiter.Target
+	case util.TgtToSrc:
+		return c.sourceCollection(namespace), c.clusterTime.Source, c.limiter.Source
+	default:
+		logger.Fatal().Msg("invalid comparison direction?")
+	}
+	return nil, nil, nil
+}
+
+// a lookup query and, for one routed to a single shard, the number of documents it looks up
+type lookupQuery struct {
+	filter bson.D
+	routed int
+}
+
+// the sharding of the side documents sampled in a direction are looked up on
+type lookupSide struct {
+	partitioned bool
+	key         bson.Raw
+	client      *mongo.Client
+	cluster     string
+	namespace   string
+}
+
+func (c *Comparer) lookupSide(namespace namespacePair, dir util.Direction) lookupSide {
+	if dir == util.TgtToSrc {
+		return lookupSide{
+			partitioned: namespace.Partitioned.Source,
+			key:         namespace.PartitionKey.Source,
+			client:      &c.sourceClient,
+			cluster:     "source",
+			namespace:   namespace.String(),
+		}
+	}
+	return lookupSide{
+		partitioned: namespace.Partitioned.Target,
+		key:         namespace.PartitionKey.Target,
+		client:      &c.targetClient,
+		cluster:     "target",
+		namespace:   namespace.TargetString(),
+	}
+}
+
+// builds the queries matching every document of the batch on the opposite side, see groupLookups. A side sharded on a
+// ranged shard key is routed with the chunks of that side
+func (c *Comparer) lookupQueries(ctx context.Context, logger zerolog.Logger, namespace namespacePair, toFind documentBatch) []lookupQuery {
+	side := c.lookupSide(namespace, toFind.dir)
+	fields := []string{}
+	if side.partitioned {
+		elements, _ := side.key.Elements()
+		for _, each := range elements {
+			if each.Key() != "_id" {
+				fields = append(fields, each.Key())
+			}
+		}
+	}
+	var table *routingTable
+	if len(fields) > 0 {
+		table = c.routes.get(ctx, logger, side.client, side.cluster, side.namespace, side.key)
+	}
+	return groupLookups(fields, table, toFind.batch)
+}
+
+// Looks up the documents of a batch on the opposite side with open, see lookupQueries. A routed query finding fewer
+// documents than it looked up may have been routed with chunks that moved since, so its routing table is reloaded
+func (c *Comparer) lookup(ctx context.Context, logger zerolog.Logger, namespace namespacePair, toFind documentBatch, limiter *throttle.Limiter, open func(query bson.D) (*mongo.Cursor, error)) (batch, error) {
+	queries := c.lookupQueries(ctx, logger, namespace, toFind)
+	filters := make([]bson.D, 0, len(queries))
+	for _, each := range queries {
+		filters = append(filters, each.filter)
+	}
+	buffer, found, err := lookupParallel(ctx, limiter, filters, open)
+	if err != nil {
+		return buffer, err
+	}
+	for i, each := range queries {
+		if each.routed > found[i] {
+			side := c.lookupSide(namespace, toFind.dir)
+			if c.routes.invalidate(side.cluster, side.namespace) {
+				logger.Debug().Msgf("a routed lookup found %d of %d documents, reloading the chunks of %s on the %s", found[i], each.routed, side.namespace, side.cluster)
+			}
+			break
+		}
+	}
+	return buffer, nil
+}
+
+// Groups the documents of a batch into lookup queries on a side sharded on fields (the shard key without _id). A shard
+// key on _id alone (ranged or hashed) is already targeted by the _id itself, so every document is looked up with a
+// single _id $in. Otherwise documents the routing table places on a shard share one $or of their exact shard key values
+// and _id, which only targets that shard, and the rest are grouped by shard key value with the documents alone in their
+// group sharing one $or
+func groupLookups(fields []string, table *routingTable, docs batch) []lookupQuery {
+	if len(fields) == 0 {
+		ids := bson.A{}
+		for _, value := range docs {
+			ids = append(ids, value.Lookup("_id"))
+		}
+		return []lookupQuery{{filter: bson.D{{"_id", bson.D{{"$in", ids}}}}}}
+	}
+
+	shards := map[string][]bson.Raw{}
+	values := map[string][]bson.Raw{}
+	for _, value := range docs {
+		if table != nil {
+			if shard, ok := table.shard(value); ok {
+				shards[shard] = append(shards[shard], value)
+				continue
+			}
+		}
+		// marshalled values compare equal only for the same values of the same types, like the shard key
+		raw, _ := bson.Marshal(shardKeyQuery(fields, value))
+		values[string(raw)] = append(values[string(raw)], value)
+	}
+
+	queries := []lookupQuery{}
+	for _, shard := range sortedKeys(shards) {
+		or := bson.A{}
+		for _, each := range shards[shard] {
+			or = append(or, tupleQuery(fields, each))
+		}
+		queries = append(queries, lookupQuery{filter: anyOf(or), routed: len(or)})
+	}
+	or := bson.A{}
+	for _, group := range sortedKeys(values) {
+		if len(values[group]) == 1 {
+			or = append(or, tupleQuery(fields, values[group][0]))
+			continue
+		}
+		queries = append(queries, lookupQuery{filter: append(shardKeyQuery(fields, values[group][0]), bson.E{"_id", bson.D{{"$in", ids(values[group])}}})})
+	}
+	if len(or) > 0 {
+		queries = append(queries, lookupQuery{filter: anyOf(or)})
+	}
+	return queries
+}
+
+// matches exactly the shard key values and _id of a document. Separate $ins per field would match every combination of
+// the values, which is only the requested documents while _id is unique across the collection
+func tupleQuery(fields []string, doc bson.Raw) bson.D {
+	return append(shardKeyQuery(fields, doc), bson.E{"_id", doc.Lookup("_id")})
+}
+
+// matches any of the queries, a single query is used as is
+func anyOf(queries bson.A) bson.D {
+	if len(queries) == 1 {
+		return queries[0].(bson.D)
+	}
+	return bson.D{{"$or", queries}}
+}
+
+// matches the shard key values of a document
+func shardKeyQuery(fields []string, doc bson.Raw) bson.D {
+	query := bson.D{}
+	for _, field := range fields {
+		query = append(query, bson.E{field, shardKeyValue(doc, field)})
+	}
+	return query
+}
+
+func ids(docs []bson.Raw) bson.A {
+	in := bson.A{}
+	for _, each := range docs {
+		in = append(in, each.Lookup("_id"))
+	}
+	return in
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// returns the value of a possibly dotted shard key field, a missing field is matched as null like the shard key does
+func shardKeyValue(doc bson.Raw, field string) bson.RawValue {
+	value, err := doc.LookupErr(strings.Split(field, ".")...)
+	if err != nil {
+		return bson.RawValue{Type: bsontype.Null}
+	}
+	return value
+}
+
+// runs every query with at most LOOKUP_CONCURRENCY in flight and decodes the documents of all of them into a single batch,
+// along with the number of documents each query found. Returns the first error, the remaining queries are still waited for
+func lookupParallel(ctx context.Context, limiter *throttle.Limiter, queries []bson.D, open func(query bson.D) (*mongo.Cursor, error)) (batch, []int, error) {
+	buffer := make(batch)
+	found := make([]int, len(queries))
+	var lock sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, LOOKUP_CONCURRENCY)
+	for i, query := range queries {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, query bson.D) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			cursor, err := open(query)
+			if err != nil {
+				fail(err)
+				return
+			}
+			defer cursor.Close(context.WithoutCancel(ctx))
+			for limiter.Next(ctx, cursor) {
+				var doc bson.Raw
+				if err := cursor.Decode(&doc); err != nil {
+					fail(err)
+					return
+				}
+				lock.Lock()
+				buffer.add(doc)
+				found[i]++
+				lock.Unlock()
+			}
+			if err := cursor.Err(); err != nil {
+				fail(err)
+			}
+		}(i, query)
+	}
+	wg.Wait()
+	return buffer, found, firstErr
+}
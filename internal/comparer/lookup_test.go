@@ -0,0 +1,128 @@
+package comparer
+
+import (
+	"context"
+	"testing"
+
+	"sampler/internal/util"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func testBatch(docs ...bson.D) batch {
+	b := make(batch)
+	for _, each := range docs {
+		raw, _ := bson.Marshal(each)
+		b.add(raw)
+	}
+	return b
+}
+
+func testRaw(doc bson.D) bson.Raw {
+	raw, _ := bson.Marshal(doc)
+	return raw
+}
+
+// unmarshals queries so they compare independently of the batch's iteration order
+func testQueries(t *testing.T, queries []lookupQuery) []map[string]any {
+	ret := []map[string]any{}
+	for _, each := range queries {
+		raw, err := bson.Marshal(each.filter)
+		assert.Nil(t, err)
+		var query map[string]any
+		assert.Nil(t, bson.Unmarshal(raw, &query))
+		ret = append(ret, query)
+	}
+	return ret
+}
+
+func TestLookupQueriesById(t *testing.T) {
+	docs := testBatch(bson.D{{"_id", 1}, {"x", 1}}, bson.D{{"_id", 2}, {"x", 2}}, bson.D{{"_id", 3}, {"x", 3}})
+	c := &Comparer{}
+	for _, key := range []bson.D{{}, {{"_id", 1}}, {{"_id", "hashed"}}} {
+		namespace := namespacePair{
+			Partitioned:  util.Pair[bool]{Source: len(key) > 0, Target: len(key) > 0},
+			PartitionKey: util.Pair[bson.Raw]{Source: testRaw(key), Target: testRaw(key)},
+		}
+		queries := c.lookupQueries(context.Background(), zerolog.Nop(), namespace, documentBatch{dir: util.SrcToTgt, batch: docs})
+		if assert.Len(t, queries, 1) {
+			assert.Equal(t, "_id", queries[0].filter[0].Key)
+			assert.ElementsMatch(t, bson.A{int32(1), int32(2), int32(3)}, rawValues(queries[0].filter[0].Value.(bson.D)[0].Value.(bson.A)))
+			assert.Zero(t, queries[0].routed)
+		}
+	}
+}
+
+func rawValues(values bson.A) bson.A {
+	ret := bson.A{}
+	for _, each := range values {
+		ret = append(ret, each.(bson.RawValue).Int32())
+	}
+	return ret
+}
+
+func TestGroupLookupsByShard(t *testing.T) {
+	table := newRoutingTable(testRaw(bson.D{{"x", 1}}), []chunk{
+		{min: testRaw(bson.D{{"x", primitive.MinKey{}}}), max: testRaw(bson.D{{"x", 10}}), shard: "a"},
+		{min: testRaw(bson.D{{"x", 10}}), max: testRaw(bson.D{{"x", primitive.MaxKey{}}}), shard: "b"},
+	})
+	docs := testBatch(
+		bson.D{{"_id", 1}, {"x", 1}},
+		bson.D{{"_id", 2}, {"x", 2.5}},
+		bson.D{{"_id", 3}, {"x", 10}},
+		// documents are not ordered here, grouped by value
+		bson.D{{"_id", 4}, {"x", bson.D{{"y", 1}}}},
+		bson.D{{"_id", 5}, {"x", bson.D{{"y", 1}}}},
+		bson.D{{"_id", 6}, {"x", bson.D{{"y", 2}}}},
+		bson.D{{"_id", 7}, {"x", bson.A{1}}},
+	)
+	grouped := groupLookups([]string{"x"}, table, docs)
+	queries := testQueries(t, grouped)
+	if !assert.Len(t, queries, 4) {
+		return
+	}
+	// only the queries routed to a shard expect every document they look up
+	assert.Equal(t, []int{2, 1, 0, 0}, []int{grouped[0].routed, grouped[1].routed, grouped[2].routed, grouped[3].routed})
+	// exact tuples rather than every combination of the values
+	assert.ElementsMatch(t, bson.A{
+		map[string]any{"x": int32(1), "_id": int32(1)},
+		map[string]any{"x": 2.5, "_id": int32(2)},
+	}, queries[0]["$or"])
+	assert.Equal(t, map[string]any{"x": int32(10), "_id": int32(3)}, queries[1])
+	assert.Equal(t, map[string]any{"y": int32(1)}, queries[2]["x"])
+	assert.ElementsMatch(t, bson.A{int32(4), int32(5)}, queries[2]["_id"].(map[string]any)["$in"])
+	// documents alone in their group share one $or
+	assert.Len(t, queries[3]["$or"], 2)
+}
+
+func TestGroupLookupsCompoundKeyMatchesTuples(t *testing.T) {
+	table := newRoutingTable(testRaw(bson.D{{"a", 1}, {"b", 1}}), []chunk{
+		{min: testRaw(bson.D{{"a", primitive.MinKey{}}, {"b", primitive.MinKey{}}}), max: testRaw(bson.D{{"a", primitive.MaxKey{}}, {"b", primitive.MaxKey{}}}), shard: "a"},
+	})
+	docs := testBatch(bson.D{{"_id", 1}, {"a", 1}, {"b", 2}}, bson.D{{"_id", 2}, {"a", 2}, {"b", 1}})
+	queries := testQueries(t, groupLookups([]string{"a", "b"}, table, docs))
+	if assert.Len(t, queries, 1) {
+		// {a: 1, b: 1} and {a: 2, b: 2} are not matched
+		assert.ElementsMatch(t, bson.A{
+			map[string]any{"a": int32(1), "b": int32(2), "_id": int32(1)},
+			map[string]any{"a": int32(2), "b": int32(1), "_id": int32(2)},
+		}, queries[0]["$or"])
+	}
+}
+
+func TestGroupLookupsWithoutRouting(t *testing.T) {
+	docs := testBatch(bson.D{{"_id", 1}, {"x", 1}}, bson.D{{"_id", 2}, {"x", 1}}, bson.D{{"_id", 3}, {"x", 2}})
+	queries := testQueries(t, groupLookups([]string{"x"}, nil, docs))
+	if assert.Len(t, queries, 2) {
+		assert.Equal(t, int32(1), queries[0]["x"])
+		assert.ElementsMatch(t, bson.A{int32(1), int32(2)}, queries[0]["_id"].(map[string]any)["$in"])
+		// a single document left over is looked up without an $or
+		assert.Equal(t, map[string]any{"x": int32(2), "_id": int32(3)}, queries[1])
+	}
+
+	// a hashed shard key cannot be routed by value
+	assert.Nil(t, newRoutingTable(testRaw(bson.D{{"x", "hashed"}}), []chunk{{}}))
+}
@@ -2,9 +2,10 @@ package comparer
 
 import (
 	"context"
-	"sampler/internal/diff"
 	"sampler/internal/ns"
+	"sampler/internal/reporter"
 	"sampler/internal/util"
+	"sort"
 	"strconv"
 
 	"github.com/rs/zerolog"
@@ -13,76 +14,247 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// a namespace present on both sides, the target names differ from the source names when the namespace is mapped
 type namespacePair struct {
-	Db            string
-	Collection    string
-	Partitioned   util.Pair[bool]
-	PartitionKey  util.Pair[bson.Raw]
-	Specification *mongo.CollectionSpecification
+	Db               string
+	Collection       string
+	TargetDb         string
+	TargetCollection string
+	Partitioned      util.Pair[bool]
+	PartitionKey     util.Pair[bson.Raw]
+	Specification    *mongo.CollectionSpecification
 }
 
+// the source namespace, results and per-namespace options are keyed by it
 func (ns namespacePair) String() string {
 	return ns.Db + "." + ns.Collection
 }
 
+func (ns namespacePair) TargetString() string {
+	return ns.TargetDb + "." + ns.TargetCollection
+}
+
+func (ns namespacePair) Names() util.Pair[string] {
+	return util.Pair[string]{Source: ns.String(), Target: ns.TargetString()}
+}
+
 func (ns namespacePair) Debug() string {
-	base := "{ name: " + ns.Db + "." + ns.Collection + ", src: { partioned: " + strconv.FormatBool(ns.Partitioned.Source)
+	base := "{ name: " + ns.String() + ", src: { partioned: " + strconv.FormatBool(ns.Partitioned.Source)
 	if ns.Partitioned.Source {
 		base += ", key: " + ns.PartitionKey.Source.String()
 	}
-	base += " }, tgt: { partitioned: " + strconv.FormatBool(ns.Partitioned.Target)
+	base += " }, tgt: { name: " + ns.TargetString() + ", partitioned: " + strconv.FormatBool(ns.Partitioned.Target)
 	if ns.Partitioned.Target {
 		base += ", key: " + ns.PartitionKey.Target.String()
 	}
 	return base + " }"
 }
 
-// streams namespaces to worker threads that are present on both the source and target, reports namespaces that are different or missing
-func (c *Comparer) streamNamespaces(ctx context.Context, logger zerolog.Logger, ret chan namespacePair) {
-	logger = logger.With().Str("c", "namespace").Logger()
+// how many collection specifications are read at once while merging the namespaces of a database
+const NAMESPACE_BATCH_SIZE = 1000
 
-	source, target := c.getNamespaces(ctx)
-	if len(source) == 0 && len(target) == 0 {
-		log.Info().Msg("no user namespaces found on the source or target... nothing to do")
-		return
+// A namespace named by the target namespace it maps to, so renamed namespaces are merged with their target.
+// Target namespaces are named by themselves
+type mappedNamespace struct {
+	ns.Namespace
+	mapped string
+}
+
+// the collection name is allowed to differ, it was already matched through the mapping
+func (m mappedNamespace) Equal(other mappedNamespace) bool {
+	return m.Namespace.EqualOptions(other.Namespace)
+}
+
+func (m mappedNamespace) names() util.Pair[string] {
+	return util.Pair[string]{Source: m.Namespace.String(), Target: m.mapped}
+}
+
+// a listed collection, named by the namespace it is compared under
+type listedName struct {
+	db         string
+	collection string
+	mapped     string
+}
+
+// Reads namespaces sorted by the name they are compared under. Listed names have their specifications read
+// NAMESPACE_BATCH_SIZE at a time, so only the names of a database and a single batch of specifications are held
+type namespaceCursor struct {
+	client *mongo.Client
+	names  []listedName
+	batch  []mappedNamespace
+}
+
+func newNamespaceCursor(client *mongo.Client, names []listedName) *namespaceCursor {
+	sort.SliceStable(names, func(a, b int) bool { return names[a].mapped < names[b].mapped })
+	return &namespaceCursor{client: client, names: names}
+}
+
+// a cursor over namespaces that were already read, named by name
+func namespaceSlice(namespaces []ns.Namespace, name func(ns.Namespace) string) *namespaceCursor {
+	batch := make([]mappedNamespace, 0, len(namespaces))
+	for _, each := range namespaces {
+		batch = append(batch, mappedNamespace{Namespace: each, mapped: name(each)})
+	}
+	sort.SliceStable(batch, func(a, b int) bool { return batch[a].mapped < batch[b].mapped })
+	return &namespaceCursor{batch: batch}
+}
+
+// returns the next namespace without consuming it, false once every namespace was read or when interrupted
+func (c *namespaceCursor) peek(ctx context.Context, logger zerolog.Logger) (mappedNamespace, bool) {
+	for len(c.batch) == 0 && len(c.names) > 0 && ctx.Err() == nil {
+		n := util.Min(NAMESPACE_BATCH_SIZE, len(c.names))
+		c.batch = c.read(ctx, logger, c.names[:n])
+		c.names = c.names[n:]
+	}
+	if len(c.batch) == 0 {
+		return mappedNamespace{}, false
 	}
+	return c.batch[0], true
+}
 
-	sortedSource := diff.SortSpec(source)
-	sortedTarget := diff.SortSpec(target)
+func (c *namespaceCursor) pop() {
+	c.batch = c.batch[1:]
+}
 
-	comparison := diff.CompareSorted(logger, sortedSource, sortedTarget)
-	logger.Trace().Msgf("%s", comparison.String())
-	if comparison.HasMismatches() {
-		logger.Warn().Msg("there are namespace mismatches between source and target")
-		logger.Debug().Msgf("%s", comparison.String())
+// reads the specifications of a batch of names in their order, names that cannot be read are skipped
+func (c *namespaceCursor) read(ctx context.Context, logger zerolog.Logger, names []listedName) []mappedNamespace {
+	byDB := map[string][]string{}
+	for _, each := range names {
+		byDB[each.db] = append(byDB[each.db], each.collection)
 	}
-	for _, each := range comparison.Equal {
-		c.makeNamespacePair(ctx, logger, each, ret)
+	specifications := map[string]*mongo.CollectionSpecification{}
+	for db, collections := range byDB {
+		specs, err := ns.Specifications(ctx, c.client, db, collections)
+		if err != nil {
+			log.Error().Err(err).Msgf("cannot read collections of %s", db)
+			continue
+		}
+		for name, spec := range specs {
+			specifications[db+"."+name] = spec
+		}
 	}
-	for _, each := range comparison.MissingOnSrc {
-		logger.Error().Str("ns", each.String()).Msgf("%s missing on the source", each.String())
-		c.reporter.MissingNamespace(each.String(), "source")
+	batch := make([]mappedNamespace, 0, len(names))
+	for _, each := range names {
+		namespace := each.db + "." + each.collection
+		spec, ok := specifications[namespace]
+		if !ok {
+			logger.Debug().Msgf("skipping %s, it was dropped since it was listed or could not be read", namespace)
+			continue
+		}
+		batch = append(batch, mappedNamespace{
+			Namespace: ns.Namespace{Db: each.db, Collection: each.collection, Specification: spec},
+			mapped:    each.mapped,
+		})
 	}
-	for _, each := range comparison.MissingOnTgt {
-		logger.Error().Str("ns", each.String()).Msgf("%s missing on the target", each.String())
-		c.reporter.MissingNamespace(each.String(), "target")
+	return batch
+}
+
+// streams namespaces to worker threads that are present on both the source and target, reports namespaces that are different or missing.
+// Without --ns namespaces are listed and merged one target database at a time, so only the names of a single database are held in memory
+func (c *Comparer) streamNamespaces(ctx context.Context, logger zerolog.Logger, ret chan namespacePair) {
+	logger = logger.With().Str("c", "namespace").Logger()
+
+	found := false
+	if len(*c.config.IncludeNS) > 0 {
+		log.Info().Strs("includeNS", *c.config.IncludeNS).Msg("looking for included namespaces")
+		source, target := c.includedUserNamespaces(ctx, *c.config.IncludeNS)
+		found = c.compareNamespaces(ctx, logger,
+			namespaceSlice(source, func(each ns.Namespace) string { return c.config.Mapper.Map(each.String()) }),
+			namespaceSlice(target, ns.Namespace.String), ret)
+	} else {
+		log.Info().Msg("looking for all user namespaces")
+		found = c.streamAllNamespaces(ctx, logger, ret)
+	}
+	if !found && ctx.Err() == nil {
+		log.Info().Msg("no user namespaces found on the source or target... nothing to do")
+	}
+}
+
+// Merges the namespaces of both sides by the name they are compared under as they are read, streams those present on
+// both to worker threads and reports the rest. Returns whether any namespace was found
+func (c *Comparer) compareNamespaces(ctx context.Context, logger zerolog.Logger, source *namespaceCursor, target *namespaceCursor, ret chan namespacePair) bool {
+	mismatched := false
+	mismatch := func() {
+		if !mismatched {
+			logger.Warn().Msg("there are namespace mismatches between source and target")
+			mismatched = true
+		}
 	}
-	for _, each := range comparison.Different {
-		logger.Warn().Str("ns", each.Source.String()).Msgf("%s different between the source and target", each.Source.String())
-		c.reporter.MismatchNamespace(each.Source, each.Target)
-		logger.Trace().Msgf("putting ns %s on channel", each.Source)
-		c.makeNamespacePair(ctx, logger, each.Source, ret)
+	return mergeNamespaces(ctx, logger, source, target, func(src *mappedNamespace, tgt *mappedNamespace) {
+		switch {
+		case src == nil:
+			mismatch()
+			logger.Error().Str("ns", tgt.mapped).Msgf("%s missing on the source", tgt.mapped)
+			c.reporter.MissingNamespace(tgt.names(), "source")
+			c.result.addMissingNamespace(tgt.mapped, reporter.Source)
+		case tgt == nil:
+			mismatch()
+			logger.Error().Str("ns", src.Namespace.String()).Msgf("%s missing on the target as %s", src.Namespace.String(), src.mapped)
+			c.reporter.MissingNamespace(src.names(), "target")
+			c.result.addMissingNamespace(src.Namespace.String(), reporter.Target)
+		default:
+			if !src.Equal(*tgt) {
+				mismatch()
+				logger.Warn().Str("ns", src.Namespace.String()).Msgf("%s different between the source and target", src.Namespace.String())
+				c.reporter.MismatchNamespace(src.Namespace, tgt.Namespace)
+				c.result.addDifferentNamespace(src.Namespace.String())
+			}
+			logger.Trace().Msgf("putting ns %s on channel", src.Namespace)
+			c.makeNamespacePair(ctx, logger, *src, ret)
+		}
+	})
+}
+
+// Walks both cursors in name order, calling visit with each source namespace and the target namespace it is compared
+// against, nil when either is missing on its side. Returns whether any namespace was found
+func mergeNamespaces(ctx context.Context, logger zerolog.Logger, source *namespaceCursor, target *namespaceCursor, visit func(*mappedNamespace, *mappedNamespace)) bool {
+	found := false
+	// namespaces consolidated into the same target namespace follow each other, they are compared against it like the first one was
+	lastMapped := ""
+	var lastTarget *mappedNamespace
+	for {
+		src, srcOk := source.peek(ctx, logger)
+		tgt, tgtOk := target.peek(ctx, logger)
+		if ctx.Err() != nil {
+			logger.Warn().Msg("interrupted, no more namespaces will be compared")
+			return found
+		}
+		found = found || srcOk || tgtOk
+		switch {
+		case !srcOk && !tgtOk:
+			return found
+		case srcOk && src.mapped == lastMapped:
+			logger.Info().Msgf("%s is consolidated into %s with other namespaces, expect its counts to differ", src.Namespace.String(), src.mapped)
+			visit(&src, lastTarget)
+			source.pop()
+		case tgtOk && (!srcOk || tgt.mapped < src.mapped):
+			visit(nil, &tgt)
+			target.pop()
+		case !tgtOk || src.mapped < tgt.mapped:
+			visit(&src, nil)
+			lastMapped, lastTarget = src.mapped, nil
+			source.pop()
+		default:
+			visit(&src, &tgt)
+			lastMapped, lastTarget = src.mapped, &tgt
+			source.pop()
+			target.pop()
+		}
 	}
 }
 
-func (c *Comparer) makeNamespacePair(ctx context.Context, logger zerolog.Logger, namespace ns.Namespace, ret chan namespacePair) {
-	sourceSharded, sourceKey := ns.IsSharded(&c.sourceClient, namespace.Db, namespace.Collection)
-	targetSharded, targetKey := ns.IsSharded(&c.targetClient, namespace.Db, namespace.Collection)
+func (c *Comparer) makeNamespacePair(ctx context.Context, logger zerolog.Logger, namespace mappedNamespace, ret chan namespacePair) {
+	// the mapped name was checked to be a namespace when mapping
+	targetDb, targetColl, _ := util.SplitNamespace(namespace.mapped)
+	sourceSharded, sourceKey := ns.IsSharded(ctx, &c.sourceClient, namespace.Db, namespace.Collection)
+	targetSharded, targetKey := ns.IsSharded(ctx, &c.targetClient, targetDb, targetColl)
 
 	pair := namespacePair{
-		Db:            namespace.Db,
-		Collection:    namespace.Collection,
-		Specification: namespace.Specification,
+		Db:               namespace.Db,
+		Collection:       namespace.Collection,
+		TargetDb:         targetDb,
+		TargetCollection: targetColl,
+		Specification:    namespace.Specification,
 		Partitioned: util.Pair[bool]{
 			Source: sourceSharded,
 			Target: targetSharded,
@@ -94,17 +266,9 @@ func (c *Comparer) makeNamespacePair(ctx context.Context, logger zerolog.Logger,
 	}
 
 	logger.Trace().Msgf("putting ns-pair %s on channel", pair.Debug())
-	ret <- pair
-}
-
-// do not need to worry about handling missing namespaces here, will compute that in the diff
-func (c *Comparer) getNamespaces(ctx context.Context) ([]ns.Namespace, []ns.Namespace) {
-	if len(*c.config.IncludeNS) > 0 {
-		log.Info().Strs("includeNS", *c.config.IncludeNS).Msg("looking for included namespaces")
-		return c.includedUserNamespaces(ctx, *c.config.IncludeNS)
-	} else {
-		log.Info().Msg("looking for all user namespaces")
-		return c.allUserNamespaces(ctx)
+	select {
+	case ret <- pair:
+	case <-ctx.Done():
 	}
 }
 
@@ -116,24 +280,135 @@ func (c *Comparer) includedUserNamespaces(ctx context.Context, included []string
 			log.Error().Err(err).Msg(each + " is not a proper namespace format, skipping")
 			continue
 		}
-		if eachSrc, err := ns.GetOneUserCollections(&c.sourceClient, db, coll); err == nil {
+		if !c.config.NamespaceFilter.Match(each) {
+			log.Info().Msgf("%s is not selected by --include/--exclude, skipping", each)
+			continue
+		}
+		if eachSrc, err := ns.GetOneUserCollections(ctx, &c.sourceClient, db, coll); err == nil {
 			source = append(source, eachSrc)
 		}
-		if eachTgt, err := ns.GetOneUserCollections(&c.targetClient, db, coll); err == nil {
+		// the included namespace is looked up on the target under the name it maps to
+		tgtDb, tgtColl, _ := util.SplitNamespace(c.config.Mapper.Map(each))
+		if eachTgt, err := ns.GetOneUserCollections(ctx, &c.targetClient, tgtDb, tgtColl); err == nil {
 			target = append(target, eachTgt)
 		}
 	}
 	return source, target
 }
 
-func (c *Comparer) allUserNamespaces(ctx context.Context) ([]ns.Namespace, []ns.Namespace) {
-	source, err := ns.AllUserCollections(&c.sourceClient, false, c.config.MetaDBName)
+// lists and merges every selected namespace one target database at a time, returns whether any namespace was found
+func (c *Comparer) streamAllNamespaces(ctx context.Context, logger zerolog.Logger, ret chan namespacePair) bool {
+	nsFilter := c.config.NamespaceFilter
+	if !nsFilter.Empty() {
+		log.Info().Strs("include", c.config.Include).Strs("exclude", c.config.Exclude).Msg("filtering namespaces")
+	}
+	sourceDBs, err := ns.UserDatabases(ctx, &c.sourceClient, nsFilter, c.config.MetaDBName)
+	if err != nil {
+		log.Error().Err(err).Msg("cannot list source databases")
+	}
+	// patterns select source names, with mappings every target database is listed and filtered per database below
+	targetFilter := nsFilter
+	if !c.config.Mapper.Empty() {
+		targetFilter = nil
+	}
+	targetDBs, err := ns.UserDatabases(ctx, &c.targetClient, targetFilter, c.config.MetaDBName)
 	if err != nil {
-		log.Error().Err(err).Msg("")
+		log.Error().Err(err).Msg("cannot list target databases")
+	}
+
+	feeds := c.sourceDatabasesByTarget(ctx, logger, sourceDBs)
+	all := append([]string{}, targetDBs...)
+	for each := range feeds {
+		all = append(all, each)
+	}
+	sort.Strings(all)
+
+	found := false
+	for i, targetDB := range all {
+		if i > 0 && all[i-1] == targetDB {
+			continue
+		}
+		if ctx.Err() != nil {
+			logger.Warn().Msg("interrupted, no more namespaces will be compared")
+			return found
+		}
+		source, target := c.databaseNames(ctx, logger, targetDB, feeds[targetDB])
+		logger.Debug().Msgf("merging %d source and %d target namespaces of target database %s", len(source), len(target), targetDB)
+		found = c.compareNamespaces(ctx, logger, newNamespaceCursor(&c.sourceClient, source), newNamespaceCursor(&c.targetClient, target), ret) || found
+	}
+	return found
+}
+
+// Returns the source databases whose collections map into each target database. Databases are resolved by the mapping
+// rules alone when they can be, only those a rule may map apart have their collection names listed up front
+func (c *Comparer) sourceDatabasesByTarget(ctx context.Context, logger zerolog.Logger, sourceDBs []string) map[string][]string {
+	feeds := map[string][]string{}
+	for _, sourceDB := range sourceDBs {
+		if targetDB, ok := c.config.Mapper.TargetDatabase(sourceDB); ok {
+			feeds[targetDB] = append(feeds[targetDB], sourceDB)
+			continue
+		}
+		if ctx.Err() != nil {
+			return feeds
+		}
+		names, err := ns.UserCollectionNames(ctx, &c.sourceClient, sourceDB, c.config.NamespaceFilter, false)
+		if err != nil {
+			log.Error().Err(err).Msgf("cannot list source collections of %s", sourceDB)
+			continue
+		}
+		for _, each := range names {
+			targetDB, _, _ := util.SplitNamespace(c.config.Mapper.Map(sourceDB + "." + each))
+			if fed := feeds[targetDB]; len(fed) == 0 || fed[len(fed)-1] != sourceDB {
+				feeds[targetDB] = append(fed, sourceDB)
+			}
+		}
 	}
-	target, err := ns.AllUserCollections(&c.targetClient, false, c.config.MetaDBName)
+	logger.Trace().Msgf("source databases by target database %v", feeds)
+	return feeds
+}
+
+// lists the names of the source collections mapped into a target database and of the target database's collections
+func (c *Comparer) databaseNames(ctx context.Context, logger zerolog.Logger, targetDB string, sourceDBs []string) ([]listedName, []listedName) {
+	nsFilter := c.config.NamespaceFilter
+	source := []listedName{}
+	mappedSource := map[string]bool{}
+	for _, sourceDB := range sourceDBs {
+		names, err := ns.UserCollectionNames(ctx, &c.sourceClient, sourceDB, nsFilter, false)
+		if err != nil {
+			log.Error().Err(err).Msgf("cannot list source collections of %s", sourceDB)
+			continue
+		}
+		for _, each := range names {
+			namespace := sourceDB + "." + each
+			mapped := c.config.Mapper.Map(namespace)
+			if db, _, _ := util.SplitNamespace(mapped); db != targetDB {
+				continue
+			}
+			if mapped != namespace {
+				logger.Debug().Msgf("mapped %s to %s", namespace, mapped)
+			}
+			source = append(source, listedName{db: sourceDB, collection: each, mapped: mapped})
+			mappedSource[mapped] = true
+		}
+	}
+
+	// without mappings, or when nothing maps here, the patterns select target namespaces by their own name
+	filter, byMapping := nsFilter, !c.config.Mapper.Empty() && len(source) > 0
+	if byMapping {
+		filter = nil
+	}
+	names, err := ns.UserCollectionNames(ctx, &c.targetClient, targetDB, filter, false)
 	if err != nil {
-		log.Error().Err(err).Msg("")
+		log.Error().Err(err).Msgf("cannot list target collections of %s", targetDB)
+	}
+	// otherwise keep what the selected source namespaces map to, along with anything the patterns select by its target name
+	target := []listedName{}
+	for _, each := range names {
+		namespace := targetDB + "." + each
+		if byMapping && !mappedSource[namespace] && !nsFilter.Match(namespace) {
+			continue
+		}
+		target = append(target, listedName{db: targetDB, collection: each, mapped: namespace})
 	}
 	return source, target
 }
@@ -0,0 +1,78 @@
+package comparer
+
+import (
+	"context"
+	"sampler/internal/ns"
+	"sampler/internal/util"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func testNamespaces(names ...string) []ns.Namespace {
+	ret := []ns.Namespace{}
+	for _, each := range names {
+		db, coll, _ := util.SplitNamespace(each)
+		ret = append(ret, ns.Namespace{Db: db, Collection: coll, Specification: &mongo.CollectionSpecification{Name: coll}})
+	}
+	return ret
+}
+
+func testMerge(ctx context.Context, source, target []ns.Namespace, mapping map[string]string) ([]string, bool) {
+	visited := []string{}
+	name := func(each *mappedNamespace) string {
+		if each == nil {
+			return "-"
+		}
+		return each.Namespace.String()
+	}
+	found := mergeNamespaces(ctx, zerolog.Nop(),
+		namespaceSlice(source, func(each ns.Namespace) string {
+			if mapped, ok := mapping[each.String()]; ok {
+				return mapped
+			}
+			return each.String()
+		}),
+		namespaceSlice(target, ns.Namespace.String),
+		func(src *mappedNamespace, tgt *mappedNamespace) {
+			visited = append(visited, name(src)+" "+name(tgt))
+		})
+	return visited, found
+}
+
+func TestMergeNamespaces(t *testing.T) {
+	visited, found := testMerge(context.Background(),
+		testNamespaces("shop.users", "shop.carts", "shop.orders"),
+		testNamespaces("shop.orders", "shop.audit", "shop.users"), nil)
+	assert.True(t, found)
+	assert.Equal(t, []string{"- shop.audit", "shop.carts -", "shop.orders shop.orders", "shop.users shop.users"}, visited)
+
+	visited, found = testMerge(context.Background(), nil, nil, nil)
+	assert.False(t, found)
+	assert.Empty(t, visited)
+}
+
+func TestMergeNamespacesMapped(t *testing.T) {
+	// renamed namespaces merge by their target name, consolidated ones are compared against the same target
+	visited, _ := testMerge(context.Background(),
+		testNamespaces("a.orders", "b.orders", "c.orders", "d.orders", "shop.users"),
+		testNamespaces("store.orders", "store.users"),
+		map[string]string{"a.orders": "store.orders", "b.orders": "store.orders", "c.orders": "store.x", "d.orders": "store.x", "shop.users": "store.users"})
+	assert.Equal(t, []string{
+		"a.orders store.orders",
+		"b.orders store.orders",
+		"shop.users store.users",
+		"c.orders -",
+		"d.orders -",
+	}, visited)
+}
+
+func TestMergeNamespacesInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	visited, found := testMerge(ctx, testNamespaces("shop.orders"), nil, nil)
+	assert.False(t, found)
+	assert.Empty(t, visited)
+}
@@ -0,0 +1,122 @@
+package comparer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"sampler/internal/throttle"
+	"sampler/internal/util"
+)
+
+// resolves the cluster time snapshot reads use on one side, either the configured <seconds>[,<increment>] or the cluster's current time
+func snapshotTime(client *mongo.Client, configured string, name string) (*primitive.Timestamp, error) {
+	var ts primitive.Timestamp
+	var err error
+	if configured != "" {
+		ts, err = util.ParseTimestamp(configured)
+	} else {
+		ts, err = util.ClusterTime(context.TODO(), client)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine %s snapshot cluster time: %w", name, err)
+	}
+	log.Info().Msgf("reading %s at cluster time %d,%d", name, ts.T, ts.I)
+	return &ts, nil
+}
+
+func snapshotReadConcern(at *primitive.Timestamp) bson.D {
+	return bson.D{{"level", "snapshot"}, {"atClusterTime", *at}}
+}
+
+// runs an aggregation, pinned to cluster time at with readConcern snapshot when at is not nil. Holds a slot of the
+// cluster's limiter until the first batch is returned
+func aggregate(ctx context.Context, limiter *throttle.Limiter, coll *mongo.Collection, at *primitive.Timestamp, pipeline bson.A, opts *options.AggregateOptions) (*mongo.Cursor, error) {
+	return throttled(ctx, limiter, func() (*mongo.Cursor, error) {
+		return runAggregate(ctx, coll, at, pipeline, opts)
+	})
+}
+
+func runAggregate(ctx context.Context, coll *mongo.Collection, at *primitive.Timestamp, pipeline bson.A, opts *options.AggregateOptions) (*mongo.Cursor, error) {
+	if cmd := aggregateCommand(coll.Name(), at, pipeline, opts); cmd != nil {
+		return coll.Database().RunCommandCursor(ctx, cmd)
+	}
+	return coll.Aggregate(ctx, pipeline, opts)
+}
+
+// returns the aggregate command reading at cluster time at, nil when at is nil and the driver's helper is used instead
+func aggregateCommand(collection string, at *primitive.Timestamp, pipeline bson.A, opts *options.AggregateOptions) bson.D {
+	if at == nil {
+		return nil
+	}
+	cursorOpts := bson.D{}
+	if opts != nil && opts.BatchSize != nil {
+		cursorOpts = append(cursorOpts, bson.E{"batchSize", *opts.BatchSize})
+	}
+	cmd := bson.D{
+		{"aggregate", collection},
+		{"pipeline", pipeline},
+		{"cursor", cursorOpts},
+		{"readConcern", snapshotReadConcern(at)},
+	}
+	if opts != nil && opts.AllowDiskUse != nil {
+		cmd = append(cmd, bson.E{"allowDiskUse", *opts.AllowDiskUse})
+	}
+	return cmd
+}
+
+// runs a find, pinned to cluster time at with readConcern snapshot when at is not nil. Holds a slot of the cluster's
+// limiter until the first batch is returned
+func find(ctx context.Context, limiter *throttle.Limiter, coll *mongo.Collection, at *primitive.Timestamp, filter bson.D, opts *options.FindOptions) (*mongo.Cursor, error) {
+	return throttled(ctx, limiter, func() (*mongo.Cursor, error) {
+		return runFind(ctx, coll, at, filter, opts)
+	})
+}
+
+func runFind(ctx context.Context, coll *mongo.Collection, at *primitive.Timestamp, filter bson.D, opts *options.FindOptions) (*mongo.Cursor, error) {
+	if cmd := findCommand(coll.Name(), at, filter, opts); cmd != nil {
+		return coll.Database().RunCommandCursor(ctx, cmd)
+	}
+	return coll.Find(ctx, filter, opts)
+}
+
+// returns the find command reading at cluster time at, nil when at is nil and the driver's helper is used instead
+func findCommand(collection string, at *primitive.Timestamp, filter bson.D, opts *options.FindOptions) bson.D {
+	if at == nil {
+		return nil
+	}
+	cmd := bson.D{
+		{"find", collection},
+		{"filter", filter},
+		{"readConcern", snapshotReadConcern(at)},
+	}
+	if opts != nil && opts.BatchSize != nil {
+		cmd = append(cmd, bson.E{"batchSize", *opts.BatchSize})
+	}
+	if opts != nil && opts.Projection != nil {
+		cmd = append(cmd, bson.E{"projection", opts.Projection})
+	}
+	return cmd
+}
+
+// opens a cursor holding a slot of the limiter until the first batch is returned, then charges that batch's documents
+func throttled(ctx context.Context, limiter *throttle.Limiter, open func() (*mongo.Cursor, error)) (*mongo.Cursor, error) {
+	if err := limiter.Acquire(ctx); err != nil {
+		return nil, err
+	}
+	cursor, err := open()
+	limiter.Release()
+	if err != nil {
+		return nil, err
+	}
+	if err := limiter.Fetched(ctx, cursor.RemainingBatchLength()); err != nil {
+		cursor.Close(context.WithoutCancel(ctx))
+		return nil, err
+	}
+	return cursor, nil
+}
@@ -0,0 +1,56 @@
+package comparer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestSnapshotTime(t *testing.T) {
+	// a configured time is used as is, without asking the cluster
+	at, err := snapshotTime(nil, "1700000000,5", "source")
+	assert.Nil(t, err)
+	assert.Equal(t, &primitive.Timestamp{T: 1700000000, I: 5}, at)
+	at, err = snapshotTime(nil, "1700000000", "source")
+	assert.Nil(t, err)
+	assert.Equal(t, &primitive.Timestamp{T: 1700000000}, at)
+
+	_, err = snapshotTime(nil, "yesterday", "target")
+	assert.ErrorContains(t, err, "cannot determine target snapshot cluster time")
+}
+
+func TestAggregateCommand(t *testing.T) {
+	at := &primitive.Timestamp{T: 1700000000, I: 5}
+	pipeline := bson.A{bson.D{{"$sample", bson.D{{"size", 10}}}}}
+	opts := options.Aggregate().SetAllowDiskUse(true).SetBatchSize(100)
+	assert.Equal(t, `{"aggregate":"orders",`+
+		`"pipeline":[{"$sample":{"size":10}}],`+
+		`"cursor":{"batchSize":100},`+
+		`"readConcern":{"level":"snapshot","atClusterTime":{"$timestamp":{"t":1700000000,"i":5}}},`+
+		`"allowDiskUse":true}`,
+		testJSON(t, aggregateCommand("orders", at, pipeline, opts)))
+	assert.Equal(t, `{"aggregate":"orders","pipeline":[],"cursor":{},"readConcern":{"level":"snapshot","atClusterTime":{"$timestamp":{"t":1700000000,"i":5}}}}`,
+		testJSON(t, aggregateCommand("orders", at, bson.A{}, nil)))
+
+	// without a cluster time the driver's helper reads with the collection's read concern
+	assert.Nil(t, aggregateCommand("orders", nil, pipeline, opts))
+}
+
+func TestFindCommand(t *testing.T) {
+	at := &primitive.Timestamp{T: 1700000000, I: 5}
+	filter := bson.D{{"_id", bson.D{{"$in", bson.A{1, 2}}}}}
+	opts := options.Find().SetBatchSize(2).SetProjection(bson.D{{"meta", 0}})
+	assert.Equal(t, `{"find":"orders",`+
+		`"filter":{"_id":{"$in":[1,2]}},`+
+		`"readConcern":{"level":"snapshot","atClusterTime":{"$timestamp":{"t":1700000000,"i":5}}},`+
+		`"batchSize":2,`+
+		`"projection":{"meta":0}}`,
+		testJSON(t, findCommand("orders", at, filter, opts)))
+	assert.Equal(t, `{"find":"orders","filter":{},"readConcern":{"level":"snapshot","atClusterTime":{"$timestamp":{"t":1700000000,"i":5}}}}`,
+		testJSON(t, findCommand("orders", at, bson.D{}, nil)))
+
+	assert.Nil(t, findCommand("orders", nil, filter, opts))
+}
@@ -0,0 +1,111 @@
+package comparer
+
+import (
+	"context"
+	"time"
+
+	"sampler/internal/reporter"
+	"sampler/internal/util"
+
+	"github.com/rs/zerolog"
+)
+
+// Re-reads every missing or mismatched document from both clusters up to Compare.Recheck times, waiting Compare.RecheckDelay
+// before each pass. Documents that are consistent on a later read (including ones deleted from both sides) are marked
+// resolved and removed from the collection totals, anything left in totals.inconsistent is still inconsistent
+func (c *Comparer) recheckDocs(ctx context.Context, logger zerolog.Logger, namespace namespacePair, totals *collectionTotals) error {
+	logger = logger.With().Str("c", "recheck").Logger()
+	pending := totals.inconsistent
+	found := len(pending)
+
+	for attempt := 1; attempt <= c.config.Compare.Recheck && len(pending) > 0; attempt++ {
+		logger.Info().Msgf("recheck %d of %d: waiting %s before re-reading %d documents", attempt, c.config.Compare.Recheck, c.config.Compare.RecheckDelay, len(pending))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(c.config.Compare.RecheckDelay):
+		}
+
+		var still []inconsistentDoc
+		for start := 0; start < len(pending); start += c.config.Compare.BatchDocs {
+			end := start + c.config.Compare.BatchDocs
+			if end > len(pending) {
+				end = len(pending)
+			}
+			inconsistent, err := c.recheckBatch(ctx, logger, namespace, pending[start:end], attempt, totals)
+			if err != nil {
+				return err
+			}
+			still = append(still, inconsistent...)
+		}
+		pending = still
+	}
+
+	totals.lock.Lock()
+	totals.inconsistent = pending
+	totals.lock.Unlock()
+	logger.Info().Msgf("recheck finished: %d of %d documents resolved, %d still inconsistent", found-len(pending), found, len(pending))
+	return nil
+}
+
+// rechecks a single batch of documents against both clusters, returning the ones that are still inconsistent
+func (c *Comparer) recheckBatch(ctx context.Context, logger zerolog.Logger, namespace namespacePair, docs []inconsistentDoc, attempt int, totals *collectionTotals) ([]inconsistentDoc, error) {
+	toFind := make(batch, len(docs))
+	for _, each := range docs {
+		toFind[each.key] = each.doc
+	}
+	// batchFind looks up on the opposite side of the direction it is given
+	source, err := c.batchFind(ctx, logger, namespace, documentBatch{dir: util.TgtToSrc, batch: toFind})
+	if err != nil {
+		return nil, err
+	}
+	target, err := c.batchFind(ctx, logger, namespace, documentBatch{dir: util.SrcToTgt, batch: toFind})
+	if err != nil {
+		return nil, err
+	}
+	return c.resolveConsistent(logger, namespace, docs, source.batch, target.batch, attempt, totals), nil
+}
+
+// Reports the documents consistent between what was re-read from the source and the target as resolved and removes them
+// from the collection totals, returning the ones that are still inconsistent. Documents on neither side are consistent
+func (c *Comparer) resolveConsistent(logger zerolog.Logger, namespace namespacePair, docs []inconsistentDoc, source batch, target batch, attempt int, totals *collectionTotals) []inconsistentDoc {
+	var still []inconsistentDoc
+	resolved := map[util.Direction]*reporter.DocSummary{
+		util.SrcToTgt: {},
+		util.TgtToSrc: {},
+	}
+	for _, each := range docs {
+		srcDoc, onSrc := source[each.key]
+		tgtDoc, onTgt := target[each.key]
+		consistent := !onSrc && !onTgt
+		if onSrc && onTgt {
+			comparison, err := c.compareDocs(namespace, srcDoc, tgtDoc)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+			}
+			consistent = err == nil && (comparison == nil || comparison.Equivalent())
+		}
+		if !consistent {
+			still = append(still, each)
+			continue
+		}
+
+		logger.Debug().Msgf("_id %s is consistent on recheck %d", each.key, attempt)
+		if !c.config.SkipDocReports {
+			c.reporter.ResolvedDoc(namespace.Names(), each.dir, each.doc, each.missing, attempt)
+		}
+		if each.missing {
+			resolved[each.dir].Missing++
+		} else {
+			resolved[each.dir].Different++
+		}
+	}
+
+	for dir, summary := range resolved {
+		if summary.HasMismatches() {
+			c.reporter.ResolvedSummary(namespace.Names(), totals.stratum, dir, *summary)
+			totals.resolve(dir, *summary)
+		}
+	}
+	return still
+}
@@ -0,0 +1,87 @@
+package comparer
+
+import (
+	"context"
+	"sampler/internal/reporter"
+	"sampler/internal/util"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// collects every report written
+type testSink struct {
+	lock    sync.Mutex
+	reports []reporter.Report
+}
+
+func (s *testSink) Write(ctx context.Context, rep reporter.Report) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.reports = append(s.reports, rep)
+	return nil
+}
+
+func (s *testSink) Close(ctx context.Context) error {
+	return nil
+}
+
+func testInconsistent(dir util.Direction, missing bool, doc bson.D) inconsistentDoc {
+	raw := testRaw(doc)
+	return inconsistentDoc{dir: dir, key: raw.Lookup("_id").String(), doc: raw, missing: missing}
+}
+
+func TestResolveConsistent(t *testing.T) {
+	sink := &testSink{}
+	rep := reporter.NewReporter([]reporter.Sink{sink}, time.Now(), false, 1)
+	c := &Comparer{reporter: &rep}
+	namespace := namespacePair{Db: "shop", Collection: "orders", TargetDb: "shop", TargetCollection: "orders"}
+
+	totals := &collectionTotals{stratum: "eu", sampledSrc: 10, sampledTgt: 10, mismatchSrcToTgt: 2, missingTgt: 1, missingSrc: 1}
+	docs := []inconsistentDoc{
+		// replicated since the sample
+		testInconsistent(util.SrcToTgt, true, bson.D{{"_id", 1}}),
+		// caught up since the sample
+		testInconsistent(util.SrcToTgt, false, bson.D{{"_id", 2}, {"x", 1}}),
+		// still different
+		testInconsistent(util.SrcToTgt, false, bson.D{{"_id", 3}, {"x", 1}}),
+		// deleted from both sides
+		testInconsistent(util.TgtToSrc, true, bson.D{{"_id", 4}}),
+	}
+	source := testBatch(bson.D{{"_id", 1}}, bson.D{{"_id", 2}, {"x", 2}}, bson.D{{"_id", 3}, {"x", 1}})
+	target := testBatch(bson.D{{"_id", 1}}, bson.D{{"_id", 2}, {"x", 2}}, bson.D{{"_id", 3}, {"x", 2}})
+
+	still := c.resolveConsistent(zerolog.Nop(), namespace, docs, source, target, 1, totals)
+	assert.Equal(t, []inconsistentDoc{docs[2]}, still)
+	assert.Equal(t, int64(1), totals.mismatchSrcToTgt)
+	assert.Equal(t, int64(0), totals.missingTgt)
+	assert.Equal(t, int64(0), totals.missingSrc)
+	assert.Equal(t, int64(0), totals.mismatchTgtToSrc)
+	assert.True(t, totals.hasMismatches())
+
+	rep.Done(context.Background(), zerolog.Nop())
+	resolved, summaries := map[string]reporter.Reason{}, map[util.Direction]bson.D{}
+	for _, each := range sink.reports {
+		switch each.Reason {
+		case reporter.COLL_SUMMARY:
+			assert.Equal(t, "eu", each.Stratum)
+			summaries[each.Direction] = each.Details
+		default:
+			resolved[testField(each.Details, "key").(bson.RawValue).String()] = each.Reason
+			assert.Equal(t, true, testField(each.Details, "resolved"))
+		}
+	}
+	assert.Equal(t, map[string]reporter.Reason{
+		`{"$numberInt":"1"}`: reporter.DOC_MISSING,
+		`{"$numberInt":"2"}`: reporter.DOC_DIFF,
+		`{"$numberInt":"4"}`: reporter.DOC_MISSING,
+	}, resolved)
+	assert.Equal(t, map[util.Direction]bson.D{
+		util.SrcToTgt: {{"docsMissing.tgt", -1}, {"docsWithMismatches.srcToTgt", -1}, {"docsResolved.srcToTgt", 2}},
+		util.TgtToSrc: {{"docsMissing.src", -1}, {"docsWithMismatches.tgtToSrc", 0}, {"docsResolved.tgtToSrc", 1}},
+	}, summaries)
+}
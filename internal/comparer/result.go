@@ -0,0 +1,204 @@
+package comparer
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+
+	"sampler/internal/reporter"
+)
+
+// process exit codes for the final verdict of a run
+const (
+	EXIT_OK                = 0
+	EXIT_TOOL_ERROR        = 1
+	EXIT_DATA_MISMATCH     = 2
+	EXIT_METADATA_MISMATCH = 3
+	// 128 + SIGINT, as a shell reports a process killed by Ctrl-C
+	EXIT_INTERRUPTED = 130
+)
+
+type Verdict string
+
+const (
+	MATCH             Verdict = "match"
+	DATA_MISMATCH     Verdict = "dataMismatch"
+	METADATA_MISMATCH Verdict = "metadataMismatch"
+	ERROR             Verdict = "error"
+	INTERRUPTED       Verdict = "interrupted"
+)
+
+// Aggregated outcome of a run, namespace workers add to it concurrently
+type Result struct {
+	lock                sync.Mutex
+	Verdict             Verdict                     `json:"verdict"`
+	Interrupted         bool                        `json:"interrupted"`
+	NamespacesMissing   []MissingNamespace          `json:"namespacesMissing"`
+	NamespacesDifferent []string                    `json:"namespacesDifferent"`
+	Namespaces          map[string]*NamespaceResult `json:"namespaces"`
+	// seed of a seeded sample, 0 when sampled at random
+	Seed int64 `json:"seed,omitempty"`
+}
+
+type MissingNamespace struct {
+	Namespace   string            `json:"ns"`
+	MissingFrom reporter.Location `json:"missingFrom"`
+}
+
+// Outcome of every stage ran against a single namespace
+type NamespaceResult struct {
+	// the run was interrupted before every stage finished for this namespace
+	Interrupted      bool      `json:"interrupted" bson:"interrupted"`
+	CountMismatch    bool      `json:"countMismatch" bson:"countMismatch"`
+	SourceCount      int64     `json:"srcCount" bson:"srcCount"`
+	TargetCount      int64     `json:"tgtCount" bson:"tgtCount"`
+	IndexesMissing   int       `json:"indexesMissing" bson:"indexesMissing"`
+	IndexesDifferent int       `json:"indexesDifferent" bson:"indexesDifferent"`
+	Docs             DocTotals `json:"docs" bson:"docs"`
+	// stages that failed, the fields of a failed stage are left empty
+	Errors []StageError `json:"errors" bson:"errors"`
+}
+
+type StageError struct {
+	Stage string `json:"stage" bson:"stage"`
+	Error string `json:"error" bson:"error"`
+}
+
+type DocTotals struct {
+	SampledSrc       int64 `json:"sampledSrc" bson:"sampledSrc"`
+	SampledTgt       int64 `json:"sampledTgt" bson:"sampledTgt"`
+	MissingSrc       int64 `json:"missingOnSrc" bson:"missingOnSrc"`
+	MissingTgt       int64 `json:"missingOnTgt" bson:"missingOnTgt"`
+	MismatchSrcToTgt int64 `json:"mismatchSrcToTgt" bson:"mismatchSrcToTgt"`
+	MismatchTgtToSrc int64 `json:"mismatchTgtToSrc" bson:"mismatchTgtToSrc"`
+	// documents that only differ in ways the comparison tolerates, they are not mismatches
+	MinorSrcToTgt int64 `json:"minorMismatchSrcToTgt" bson:"minorMismatchSrcToTgt"`
+	MinorTgtToSrc int64 `json:"minorMismatchTgtToSrc" bson:"minorMismatchTgtToSrc"`
+	// how far the totals generalize to the documents sampled from, only set once the sample finishes
+	ConfidenceSrcToTgt *reporter.Confidence `json:"confidenceSrcToTgt,omitempty" bson:"confidenceSrcToTgt,omitempty"`
+	ConfidenceTgtToSrc *reporter.Confidence `json:"confidenceTgtToSrc,omitempty" bson:"confidenceTgtToSrc,omitempty"`
+	// neighbours of inconsistent documents compared with Compare.FocusDocs, not part of the random sample
+	Focus *DocTotals `json:"focus,omitempty" bson:"focus,omitempty"`
+	// totals of every stratum with Compare.Strata, the totals above are their sum and have no confidence of their own
+	Strata []StratumTotals `json:"strata,omitempty" bson:"strata,omitempty"`
+}
+
+// totals of a single stratum of a stratified sample
+type StratumTotals struct {
+	Stratum string    `json:"stratum" bson:"stratum"`
+	Docs    DocTotals `json:"docs" bson:"docs"`
+}
+
+// adds the counts of other, confidences are not additive and are left out
+func (d *DocTotals) add(other DocTotals) {
+	d.SampledSrc += other.SampledSrc
+	d.SampledTgt += other.SampledTgt
+	d.MissingSrc += other.MissingSrc
+	d.MissingTgt += other.MissingTgt
+	d.MismatchSrcToTgt += other.MismatchSrcToTgt
+	d.MismatchTgtToSrc += other.MismatchTgtToSrc
+	d.MinorSrcToTgt += other.MinorSrcToTgt
+	d.MinorTgtToSrc += other.MinorTgtToSrc
+	if other.Focus != nil {
+		if d.Focus == nil {
+			d.Focus = &DocTotals{}
+		}
+		d.Focus.add(*other.Focus)
+	}
+}
+
+func (d DocTotals) HasMismatches() bool {
+	if d.Focus != nil && d.Focus.HasMismatches() {
+		return true
+	}
+	return d.MismatchSrcToTgt > 0 || d.MismatchTgtToSrc > 0 || d.MissingSrc > 0 || d.MissingTgt > 0
+}
+
+func (n *NamespaceResult) hasMetadataMismatches() bool {
+	return n.CountMismatch || n.IndexesMissing > 0 || n.IndexesDifferent > 0
+}
+
+func newResult() *Result {
+	return &Result{
+		NamespacesMissing:   []MissingNamespace{},
+		NamespacesDifferent: []string{},
+		Namespaces:          map[string]*NamespaceResult{},
+	}
+}
+
+func (r *Result) addMissingNamespace(namespace string, loc reporter.Location) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.NamespacesMissing = append(r.NamespacesMissing, MissingNamespace{Namespace: namespace, MissingFrom: loc})
+}
+
+func (r *Result) addDifferentNamespace(namespace string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.NamespacesDifferent = append(r.NamespacesDifferent, namespace)
+}
+
+func (r *Result) addNamespace(namespace string, result *NamespaceResult) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Namespaces[namespace] = result
+}
+
+// Computes the verdict, an interrupted run takes precedence over failed stages since neither compared everything, and
+// both over metadata differences and then missing or mismatched data, which can only be trusted from a complete run
+func (r *Result) finish() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sort.Slice(r.NamespacesMissing, func(a, b int) bool {
+		return r.NamespacesMissing[a].Namespace < r.NamespacesMissing[b].Namespace
+	})
+	sort.Strings(r.NamespacesDifferent)
+
+	metadata := len(r.NamespacesDifferent) > 0
+	data := len(r.NamespacesMissing) > 0
+	failed := false
+	for _, each := range r.Namespaces {
+		metadata = metadata || each.hasMetadataMismatches()
+		data = data || each.Docs.HasMismatches()
+		failed = failed || len(each.Errors) > 0
+	}
+	switch {
+	case r.Interrupted:
+		r.Verdict = INTERRUPTED
+	case failed:
+		r.Verdict = ERROR
+	case metadata:
+		r.Verdict = METADATA_MISMATCH
+	case data:
+		r.Verdict = DATA_MISMATCH
+	default:
+		r.Verdict = MATCH
+	}
+}
+
+func (r *Result) ExitCode() int {
+	switch r.Verdict {
+	case DATA_MISMATCH:
+		return EXIT_DATA_MISMATCH
+	case METADATA_MISMATCH:
+		return EXIT_METADATA_MISMATCH
+	case ERROR:
+		return EXIT_TOOL_ERROR
+	case INTERRUPTED:
+		return EXIT_INTERRUPTED
+	default:
+		return EXIT_OK
+	}
+}
+
+// writes the result as indented JSON to path, overwriting any existing file
+func (r *Result) WriteJSON(path string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	raw, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(raw, '\n'), 0664)
+}
@@ -0,0 +1,153 @@
+package comparer
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sampler/internal/reporter"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResultVerdict(t *testing.T) {
+	mismatched := &NamespaceResult{Docs: DocTotals{SampledSrc: 10, MissingTgt: 1}}
+	focused := &NamespaceResult{Docs: DocTotals{Focus: &DocTotals{MismatchTgtToSrc: 1}}}
+	indexes := &NamespaceResult{IndexesDifferent: 1}
+	counts := &NamespaceResult{CountMismatch: true}
+	failed := &NamespaceResult{Errors: []StageError{{Stage: "sampleDocs", Error: "interrupted"}}}
+	minor := &NamespaceResult{Docs: DocTotals{SampledSrc: 10, MinorSrcToTgt: 2}}
+
+	tests := []struct {
+		name        string
+		interrupted bool
+		missing     []MissingNamespace
+		different   []string
+		namespaces  map[string]*NamespaceResult
+		verdict     Verdict
+		exitCode    int
+	}{
+		{
+			name:     "nothing to compare",
+			verdict:  MATCH,
+			exitCode: EXIT_OK,
+		},
+		{
+			name:       "minor mismatches match",
+			namespaces: map[string]*NamespaceResult{"shop.orders": minor},
+			verdict:    MATCH,
+			exitCode:   EXIT_OK,
+		},
+		{
+			name:       "mismatched documents",
+			namespaces: map[string]*NamespaceResult{"shop.orders": mismatched, "shop.users": minor},
+			verdict:    DATA_MISMATCH,
+			exitCode:   EXIT_DATA_MISMATCH,
+		},
+		{
+			name:       "focused mismatches",
+			namespaces: map[string]*NamespaceResult{"shop.orders": focused},
+			verdict:    DATA_MISMATCH,
+			exitCode:   EXIT_DATA_MISMATCH,
+		},
+		{
+			name:     "missing namespace",
+			missing:  []MissingNamespace{{Namespace: "shop.orders", MissingFrom: reporter.Target}},
+			verdict:  DATA_MISMATCH,
+			exitCode: EXIT_DATA_MISMATCH,
+		},
+		{
+			name:       "metadata over data",
+			missing:    []MissingNamespace{{Namespace: "shop.carts", MissingFrom: reporter.Target}},
+			namespaces: map[string]*NamespaceResult{"shop.orders": mismatched, "shop.users": indexes},
+			verdict:    METADATA_MISMATCH,
+			exitCode:   EXIT_METADATA_MISMATCH,
+		},
+		{
+			name:       "count mismatch",
+			namespaces: map[string]*NamespaceResult{"shop.orders": counts},
+			verdict:    METADATA_MISMATCH,
+			exitCode:   EXIT_METADATA_MISMATCH,
+		},
+		{
+			name:      "different namespace",
+			different: []string{"shop.orders"},
+			verdict:   METADATA_MISMATCH,
+			exitCode:  EXIT_METADATA_MISMATCH,
+		},
+		{
+			name:       "tool error over metadata",
+			different:  []string{"shop.orders"},
+			namespaces: map[string]*NamespaceResult{"shop.orders": mismatched, "shop.users": failed},
+			verdict:    ERROR,
+			exitCode:   EXIT_TOOL_ERROR,
+		},
+		{
+			name:        "interrupted over everything",
+			interrupted: true,
+			different:   []string{"shop.orders"},
+			namespaces:  map[string]*NamespaceResult{"shop.orders": mismatched, "shop.users": failed},
+			verdict:     INTERRUPTED,
+			exitCode:    EXIT_INTERRUPTED,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newResult()
+			r.Interrupted = test.interrupted
+			for _, each := range test.missing {
+				r.addMissingNamespace(each.Namespace, each.MissingFrom)
+			}
+			for _, each := range test.different {
+				r.addDifferentNamespace(each)
+			}
+			for namespace, each := range test.namespaces {
+				r.addNamespace(namespace, each)
+			}
+			r.finish()
+			assert.Equal(t, test.verdict, r.Verdict)
+			assert.Equal(t, test.exitCode, r.ExitCode())
+		})
+	}
+}
+
+func TestResultWriteJSON(t *testing.T) {
+	r := newResult()
+	r.Seed = 7
+	r.addMissingNamespace("shop.users", reporter.Source)
+	r.addMissingNamespace("shop.carts", reporter.Target)
+	r.addNamespace("shop.orders", &NamespaceResult{
+		SourceCount: 10,
+		TargetCount: 9,
+		Docs:        DocTotals{SampledSrc: 5, SampledTgt: 5, MissingTgt: 1},
+	})
+	r.finish()
+
+	path := filepath.Join(t.TempDir(), "summary.json")
+	assert.Nil(t, r.WriteJSON(path))
+	raw, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, byte('\n'), raw[len(raw)-1])
+
+	var written map[string]interface{}
+	assert.Nil(t, json.Unmarshal(raw, &written))
+	assert.Equal(t, "dataMismatch", written["verdict"])
+	assert.Equal(t, false, written["interrupted"])
+	assert.Equal(t, float64(7), written["seed"])
+	// missing namespaces are sorted
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"ns": "shop.carts", "missingFrom": string(reporter.Target)},
+		map[string]interface{}{"ns": "shop.users", "missingFrom": string(reporter.Source)},
+	}, written["namespacesMissing"])
+	assert.Equal(t, []interface{}{}, written["namespacesDifferent"])
+	orders := written["namespaces"].(map[string]interface{})["shop.orders"].(map[string]interface{})
+	assert.Equal(t, float64(10), orders["srcCount"])
+	assert.Equal(t, float64(9), orders["tgtCount"])
+	docs := orders["docs"].(map[string]interface{})
+	assert.Equal(t, float64(1), docs["missingOnTgt"])
+	assert.NotContains(t, docs, "focus")
+	assert.NotContains(t, docs, "strata")
+
+	// an unwritable path is reported
+	assert.Error(t, r.WriteJSON(filepath.Join(t.TempDir(), "missing", "summary.json")))
+}
@@ -0,0 +1,288 @@
+package comparer
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// a chunk of a sharded collection, the shard key values from min (inclusive) to max (exclusive) live on shard
+type chunk struct {
+	min   bson.Raw
+	max   bson.Raw
+	shard string
+}
+
+// reads the chunks of a sharded collection from a cluster's config database, sorted by min
+func loadChunks(ctx context.Context, client *mongo.Client, namespace string) ([]chunk, error) {
+	config := client.Database("config")
+	collection, err := config.Collection("collections").FindOne(ctx, bson.D{{"_id", namespace}}).Raw()
+	if err != nil {
+		return nil, err
+	}
+	// chunks reference their collection by uuid since 5.0 and by namespace before
+	filter := bson.D{{"ns", namespace}}
+	if uuid, err := collection.LookupErr("uuid"); err == nil {
+		filter = bson.D{{"$or", bson.A{bson.D{{"uuid", uuid}}, filter}}}
+	}
+	cursor, err := config.Collection("chunks").Find(ctx, filter, options.Find().SetSort(bson.D{{"min", 1}}).SetProjection(bson.D{{"shard", 1}, {"min", 1}, {"max", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.WithoutCancel(ctx))
+
+	chunks := []chunk{}
+	for cursor.Next(ctx) {
+		chunks = append(chunks, chunk{
+			min:   cursor.Current.Lookup("min").Document(),
+			max:   cursor.Current.Lookup("max").Document(),
+			shard: cursor.Current.Lookup("shard").StringValue(),
+		})
+	}
+	return chunks, cursor.Err()
+}
+
+// The chunks of one side of a sharded namespace, used to group lookups by the shard owning each document
+type routingTable struct {
+	// every field of the shard key in key order
+	fields []string
+	chunks []chunk
+}
+
+// returns a routing table for a ranged shard key, nil for a hashed one whose chunks hold hashes instead of values
+func newRoutingTable(key bson.Raw, chunks []chunk) *routingTable {
+	elements, _ := key.Elements()
+	fields := []string{}
+	for _, each := range elements {
+		if kind, ok := each.Value().StringValueOK(); ok && kind == "hashed" {
+			return nil
+		}
+		fields = append(fields, each.Key())
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+	return &routingTable{fields: fields, chunks: chunks}
+}
+
+// returns the shard owning a document, false when one of its shard key values cannot be ordered here
+func (r *routingTable) shard(doc bson.Raw) (string, bool) {
+	values := make([]bson.RawValue, 0, len(r.fields))
+	for _, field := range r.fields {
+		values = append(values, shardKeyValue(doc, field))
+	}
+	ordered := true
+	// first chunk starting after the document, the one before it owns the document
+	i := sort.Search(len(r.chunks), func(i int) bool {
+		cmp, ok := compareKey(r.fields, r.chunks[i].min, values)
+		ordered = ordered && ok
+		return cmp > 0
+	})
+	if !ordered || i == 0 {
+		return "", false
+	}
+	owner := r.chunks[i-1]
+	if cmp, ok := compareKey(r.fields, owner.max, values); !ok || cmp <= 0 {
+		return "", false
+	}
+	return owner.shard, true
+}
+
+// compares a chunk bound to shard key values field by field
+func compareKey(fields []string, bound bson.Raw, values []bson.RawValue) (int, bool) {
+	for i, field := range fields {
+		cmp, ok := compareValues(bound.Lookup(field), values[i])
+		if !ok || cmp != 0 {
+			return cmp, ok
+		}
+	}
+	return 0, true
+}
+
+// canonical order of the types compareValues supports, the types between them in the server's order are not supported
+func typeRank(value bson.RawValue) (int, bool) {
+	switch value.Type {
+	case bsontype.MinKey:
+		return 1, true
+	case bsontype.Null, bsontype.Undefined:
+		return 2, true
+	case bsontype.Int32, bsontype.Int64, bsontype.Double:
+		return 3, true
+	case bsontype.String:
+		return 4, true
+	case bsontype.ObjectID:
+		return 5, true
+	case bsontype.Boolean:
+		return 6, true
+	case bsontype.DateTime:
+		return 7, true
+	case bsontype.MaxKey:
+		return 8, true
+	}
+	return 0, false
+}
+
+// orders two values like the server with the simple collation, false for types (and NaN) it does not order
+func compareValues(a, b bson.RawValue) (int, bool) {
+	rankA, okA := typeRank(a)
+	rankB, okB := typeRank(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	if rankA != rankB {
+		return compareInts(int64(rankA), int64(rankB)), true
+	}
+	switch a.Type {
+	case bsontype.Int32, bsontype.Int64, bsontype.Double:
+		numberA, okA := bigNumber(a)
+		numberB, okB := bigNumber(b)
+		if !okA || !okB {
+			return 0, false
+		}
+		return numberA.Cmp(numberB), true
+	case bsontype.String:
+		return strings.Compare(a.StringValue(), b.StringValue()), true
+	case bsontype.ObjectID:
+		idA, idB := a.ObjectID(), b.ObjectID()
+		return bytes.Compare(idA[:], idB[:]), true
+	case bsontype.Boolean:
+		return compareInts(boolInt(a.Boolean()), boolInt(b.Boolean())), true
+	case bsontype.DateTime:
+		return compareInts(a.DateTime(), b.DateTime()), true
+	}
+	return 0, true
+}
+
+func bigNumber(value bson.RawValue) (*big.Float, bool) {
+	switch value.Type {
+	case bsontype.Int32:
+		return new(big.Float).SetInt64(int64(value.Int32())), true
+	case bsontype.Int64:
+		return new(big.Float).SetInt64(value.Int64()), true
+	case bsontype.Double:
+		double := value.Double()
+		if math.IsNaN(double) {
+			return nil, false
+		}
+		return big.NewFloat(double), true
+	}
+	return nil, false
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// a routing table is reloaded at most once per interval, a lookup finding fewer documents than it routed is also what a
+// namespace with missing documents looks like
+const ROUTE_REFRESH_INTERVAL = time.Minute
+
+// Routing tables of sharded namespaces keyed by cluster and namespace. A table is loaded once by the first lookup
+// needing it while later ones wait for that load, without holding up lookups of other namespaces
+type routeCache struct {
+	lock   sync.Mutex
+	routes map[string]*route
+	// reads a namespace's chunks, loadChunks unless replaced by tests
+	load func(ctx context.Context, client *mongo.Client, namespace string) ([]chunk, error)
+}
+
+// a routing table being loaded until ready is closed, nil when a side's chunks cannot be used
+type route struct {
+	ready  chan struct{}
+	table  *routingTable
+	loaded time.Time
+}
+
+func newRouteCache() *routeCache {
+	return &routeCache{routes: map[string]*route{}, load: loadChunks}
+}
+
+func routeKey(cluster string, namespace string) string {
+	return cluster + ":" + namespace
+}
+
+// returns the routing table of a sharded collection, loading it on first use
+func (r *routeCache) get(ctx context.Context, logger zerolog.Logger, client *mongo.Client, cluster string, namespace string, key bson.Raw) *routingTable {
+	r.lock.Lock()
+	if each, ok := r.routes[routeKey(cluster, namespace)]; ok {
+		r.lock.Unlock()
+		select {
+		case <-each.ready:
+			return each.table
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	loading := &route{ready: make(chan struct{})}
+	r.routes[routeKey(cluster, namespace)] = loading
+	r.lock.Unlock()
+
+	chunks, err := r.load(ctx, client, namespace)
+	if err != nil {
+		logger.Warn().Err(err).Msgf("cannot read the chunks of %s on the %s, lookups are grouped by shard key value", namespace, cluster)
+		chunks = nil
+	}
+	loading.table = newRoutingTable(key, chunks)
+	loading.loaded = time.Now()
+	// an interrupted load is retried by the next lookup
+	if ctx.Err() != nil {
+		r.forget(cluster, namespace, loading)
+	}
+	close(loading.ready)
+	return loading.table
+}
+
+// Drops a routing table loaded at least ROUTE_REFRESH_INTERVAL ago so the next lookup reloads it, e.x: after a lookup
+// routed with it found fewer documents than expected since chunks may have moved. Returns whether it was dropped
+func (r *routeCache) invalidate(cluster string, namespace string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	each, ok := r.routes[routeKey(cluster, namespace)]
+	if !ok {
+		return false
+	}
+	select {
+	case <-each.ready:
+	default:
+		// still loading
+		return false
+	}
+	if time.Since(each.loaded) < ROUTE_REFRESH_INTERVAL {
+		return false
+	}
+	delete(r.routes, routeKey(cluster, namespace))
+	return true
+}
+
+// drops a route unless it was already replaced
+func (r *routeCache) forget(cluster string, namespace string, each *route) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.routes[routeKey(cluster, namespace)] == each {
+		delete(r.routes, routeKey(cluster, namespace))
+	}
+}
@@ -0,0 +1,89 @@
+package comparer
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func testChunks() []chunk {
+	return []chunk{{min: testRaw(bson.D{{"x", primitive.MinKey{}}}), max: testRaw(bson.D{{"x", primitive.MaxKey{}}}), shard: "a"}}
+}
+
+func TestRouteCacheLoadsOnce(t *testing.T) {
+	var loads atomic.Int32
+	release := make(chan struct{})
+	routes := newRouteCache()
+	routes.load = func(ctx context.Context, client *mongo.Client, namespace string) ([]chunk, error) {
+		loads.Add(1)
+		if namespace == "shop.orders" {
+			<-release
+		}
+		return testChunks(), nil
+	}
+	key := testRaw(bson.D{{"x", 1}})
+
+	var wg sync.WaitGroup
+	tables := make([]*routingTable, 4)
+	for i := range tables {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tables[i] = routes.get(context.Background(), zerolog.Nop(), nil, "target", "shop.orders", key)
+		}(i)
+	}
+	// another namespace is not held up by the slow load
+	assert.NotNil(t, routes.get(context.Background(), zerolog.Nop(), nil, "target", "shop.users", key))
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(2), loads.Load())
+	for _, each := range tables {
+		assert.Same(t, tables[0], each)
+	}
+}
+
+func TestRouteCacheRetriesInterruptedLoad(t *testing.T) {
+	routes := newRouteCache()
+	ctx, cancel := context.WithCancel(context.Background())
+	routes.load = func(ctx context.Context, client *mongo.Client, namespace string) ([]chunk, error) {
+		cancel()
+		return nil, ctx.Err()
+	}
+	key := testRaw(bson.D{{"x", 1}})
+	assert.Nil(t, routes.get(ctx, zerolog.Nop(), nil, "target", "shop.orders", key))
+
+	routes.load = func(ctx context.Context, client *mongo.Client, namespace string) ([]chunk, error) {
+		return testChunks(), nil
+	}
+	assert.NotNil(t, routes.get(context.Background(), zerolog.Nop(), nil, "target", "shop.orders", key))
+}
+
+func TestRouteCacheInvalidate(t *testing.T) {
+	var loads atomic.Int32
+	routes := newRouteCache()
+	routes.load = func(ctx context.Context, client *mongo.Client, namespace string) ([]chunk, error) {
+		loads.Add(1)
+		return testChunks(), nil
+	}
+	key := testRaw(bson.D{{"x", 1}})
+	assert.False(t, routes.invalidate("target", "shop.orders"))
+	routes.get(context.Background(), zerolog.Nop(), nil, "target", "shop.orders", key)
+
+	// a fresh table is kept
+	assert.False(t, routes.invalidate("target", "shop.orders"))
+	routes.get(context.Background(), zerolog.Nop(), nil, "target", "shop.orders", key)
+	assert.Equal(t, int32(1), loads.Load())
+
+	routes.routes[routeKey("target", "shop.orders")].loaded = time.Now().Add(-ROUTE_REFRESH_INTERVAL)
+	assert.True(t, routes.invalidate("target", "shop.orders"))
+	routes.get(context.Background(), zerolog.Nop(), nil, "target", "shop.orders", key)
+	assert.Equal(t, int32(2), loads.Load())
+}
@@ -2,6 +2,7 @@ package comparer
 
 import (
 	"context"
+	"fmt"
 	"math"
 	"sync"
 	"time"
@@ -9,25 +10,39 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"sampler/internal/cfg"
 	"sampler/internal/doc"
 	"sampler/internal/reporter"
+	"sampler/internal/throttle"
 	"sampler/internal/util"
 	"sampler/internal/worker"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const retryInterval = 500 * time.Millisecond
+const maxSampleRetries = 20
 
 type documentBatch struct {
 	dir   util.Direction
 	batch batch
+	// BSON size of the sampled documents, used to bound the batches in flight
+	bytes int
 }
 
 type batch map[string]bson.Raw
 
+// the requested sample size and the number of documents it is drawn from on each side
+type samplePlan struct {
+	size       int64
+	population util.Pair[int64]
+	// fraction of the hash space a seeded sample of size selects
+	fraction float64
+}
+
 func (b batch) add(doc bson.Raw) {
 	id := doc.Lookup("_id")
 	key := id.String()
@@ -36,8 +51,17 @@ func (b batch) add(doc bson.Raw) {
 	}
 }
 
+// a sampled document that was missing or mismatched on the other cluster, kept around to be rechecked
+type inconsistentDoc struct {
+	dir     util.Direction
+	key     string
+	doc     bson.Raw
+	missing bool
+}
+
 type collectionTotals struct {
 	ns               string
+	stratum          string
 	lock             sync.Mutex
 	sampledSrc       int64
 	sampledTgt       int64
@@ -45,11 +69,105 @@ type collectionTotals struct {
 	missingTgt       int64
 	mismatchSrcToTgt int64
 	mismatchTgtToSrc int64
+	minorSrcToTgt    int64
+	minorTgtToSrc    int64
+	inconsistent     []inconsistentDoc
+	// first error hit by a sample doc worker, once set remaining batches are skipped
+	err error
+}
+
+func (t *collectionTotals) fail(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+func (t *collectionTotals) failed() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.err != nil
+}
+
+func (t *collectionTotals) hasMismatches() bool {
+	return t.mismatchSrcToTgt > 0 || t.mismatchTgtToSrc > 0 || t.missingSrc > 0 || t.missingTgt > 0
+}
+
+// returns the fewest documents compared on either side
+func (t *collectionTotals) compared() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return util.Min64(t.sampledSrc, t.sampledTgt)
+}
+
+func (t *collectionTotals) docTotals() DocTotals {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return DocTotals{
+		SampledSrc:       t.sampledSrc,
+		SampledTgt:       t.sampledTgt,
+		MissingSrc:       t.missingSrc,
+		MissingTgt:       t.missingTgt,
+		MismatchSrcToTgt: t.mismatchSrcToTgt,
+		MismatchTgtToSrc: t.mismatchTgtToSrc,
+		MinorSrcToTgt:    t.minorSrcToTgt,
+		MinorTgtToSrc:    t.minorTgtToSrc,
+	}
+}
+
+// removes documents found consistent on recheck from the running totals
+func (t *collectionTotals) resolve(dir util.Direction, summary reporter.DocSummary) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	switch dir {
+	case util.SrcToTgt:
+		t.mismatchSrcToTgt -= int64(summary.Different)
+		t.missingTgt -= int64(summary.Missing)
+	case util.TgtToSrc:
+		t.mismatchTgtToSrc -= int64(summary.Different)
+		t.missingSrc -= int64(summary.Missing)
+	}
+}
+
+// compares a sample of documents from both sides and returns the totals after any rechecks. With Compare.Strata every
+// stratum is sampled on its own and the totals are the sum of the strata's
+func (c *Comparer) CompareSampleDocs(ctx context.Context, logger zerolog.Logger, namespace namespacePair) (DocTotals, error) {
+	logger = logger.With().Str("c", "sampleDoc").Logger()
+	strata, err := c.strata(ctx, logger, namespace)
+	if err != nil {
+		return DocTotals{}, err
+	}
+	if len(strata) == 1 && strata[0].name == "" {
+		plan, err := c.samplePlan(ctx, logger, namespace, strata[0].filter)
+		if err != nil {
+			return DocTotals{}, err
+		}
+		return c.compareStratum(ctx, logger, namespace, strata[0], plan)
+	}
+	plans, err := c.strataPlans(ctx, logger, namespace, strata)
+	if err != nil {
+		return DocTotals{}, err
+	}
+	var result DocTotals
+	for i, each := range strata {
+		totals, err := c.compareStratum(ctx, logger.With().Str("stratum", each.name).Logger(), namespace, each, plans[i])
+		result.add(totals)
+		result.Strata = append(result.Strata, StratumTotals{Stratum: each.name, Docs: totals})
+		if err != nil || ctx.Err() != nil {
+			return result, err
+		}
+	}
+	return result, nil
 }
 
-func (c *Comparer) CompareSampleDocs(ctx context.Context, logger zerolog.Logger, namespace namespacePair) {
+// compares a sample of a single stratum's documents. With Compare.Sequential the sample is drawn in rounds sized by
+// nextRound, with Compare.FocusDocs the neighbours of inconsistent documents are compared afterwards and kept out of the
+// sample's totals
+func (c *Comparer) compareStratum(ctx context.Context, logger zerolog.Logger, namespace namespacePair, stratum stratum, plan samplePlan) (DocTotals, error) {
 	totals := collectionTotals{
 		ns:               namespace.String(),
+		stratum:          stratum.name,
 		lock:             sync.Mutex{},
 		sampledSrc:       0,
 		sampledTgt:       0,
@@ -58,44 +176,209 @@ func (c *Comparer) CompareSampleDocs(ctx context.Context, logger zerolog.Logger,
 		mismatchSrcToTgt: 0,
 		mismatchTgtToSrc: 0,
 	}
-	logger = logger.With().Str("c", "sampleDoc").Logger()
-	source, target := c.sampleCursors(ctx, logger, namespace)
-	defer source.Close(ctx)
-	defer target.Close(ctx)
-	// TODO variable batch size based on doc size (256MB)
-	jobs := make(chan documentBatch, 100)
-
-	pool := worker.NewWorkerPool(logger, NUM_WORKERS, "sampleDocWorkers", "sdw")
-	pool.Start(func(iCtx context.Context, iLogger zerolog.Logger) {
-		c.processDocs(iCtx, iLogger, namespace, jobs, &totals)
-	})
+	if c.config.Compare.Seed != 0 {
+		c.reporter.SampleSeed(namespace.Names(), stratum.name, reporter.Seed{
+			Seed:       c.config.Compare.Seed,
+			Fraction:   plan.fraction,
+			Size:       plan.size,
+			Population: util.Min64(plan.population.Source, plan.population.Target),
+		})
+	}
+	// documents already compared, so later rounds and focused follow-ups never compare a document twice
+	var seen map[util.Direction]map[string]struct{}
+	if c.config.Compare.Sequential || c.config.Compare.FocusDocs > 0 {
+		seen = map[util.Direction]map[string]struct{}{util.SrcToTgt: {}, util.TgtToSrc: {}}
+	}
 
 	logger.Info().Msg("beginning document sample")
-	streamBatches(ctx, logger, jobs, util.SrcToTgt, source, &totals)
-	streamBatches(ctx, logger, jobs, util.TgtToSrc, target, &totals)
-
-	close(jobs)
-	pool.Done()
+	requested := plan.size
+	if c.config.Compare.Sequential {
+		requested = util.Min64(c.config.Compare.InitialSample, plan.size)
+	}
+	drawn := int64(0)
+	for round := 1; requested > drawn; round++ {
+		if c.config.Compare.Sequential {
+			logger.Info().Msgf("sample round %d: drawing %d more documents for %d of %d", round, requested-drawn, requested, plan.size)
+		}
+		err := c.compareSources(ctx, logger, namespace, &totals, seen, c.sampleSources(ctx, logger, namespace, stratum.filter, plan, drawn, requested))
+		if ctx.Err() != nil {
+			logger.Warn().Msg("document sample interrupted")
+			return totals.docTotals(), nil
+		}
+		if err != nil {
+			return totals.docTotals(), err
+		}
+		if !c.config.Compare.Sequential || c.config.Compare.Seed != 0 {
+			// seeded rounds select the next band of the hash space whatever the band held
+			drawn = requested
+		} else if achieved := totals.compared(); achieved > drawn {
+			// random rounds redraw documents of earlier rounds, which are skipped, so later rounds make up for them
+			drawn = achieved
+		} else {
+			logger.Warn().Msgf("sample round %d drew no new documents, stopping at %d of %d", round, drawn, requested)
+			break
+		}
+		if c.config.Compare.Sequential {
+			requested = c.nextRound(logger, namespace, &totals, drawn, plan.size)
+		}
+	}
 	logger.Info().Msg("finished document sample")
+	achieved := logger.Info()
+	if totals.sampledSrc < drawn || totals.sampledTgt < drawn {
+		achieved = logger.Warn()
+	}
+	achieved.Msgf("sampled %d source and %d target documents of the %d requested", totals.sampledSrc, totals.sampledTgt, drawn)
+
+	if c.config.Compare.Recheck > 0 && len(totals.inconsistent) > 0 {
+		if err := c.recheckDocs(ctx, logger, namespace, &totals); err != nil {
+			return totals.docTotals(), err
+		}
+	}
+
+	// focuses on the documents still inconsistent after the recheck
+	var focus *collectionTotals
+	if c.config.Compare.FocusDocs > 0 && totals.hasMismatches() {
+		focus = &collectionTotals{ns: namespace.String(), stratum: stratum.name}
+		err := c.compareSources(ctx, logger, namespace, focus, seen, c.focusSources(ctx, logger, namespace, stratum.filter, totals.inconsistent))
+		if ctx.Err() != nil {
+			logger.Warn().Msg("focused follow-up interrupted")
+			return totals.docTotals(), nil
+		}
+		if err != nil {
+			return totals.docTotals(), err
+		}
+	}
+
+	if c.config.Compare.Recheck > 0 && focus != nil && len(focus.inconsistent) > 0 {
+		if err := c.recheckDocs(ctx, logger, namespace, focus); err != nil {
+			return totals.docTotals(), err
+		}
+	}
+
 	// unnecessary locking, but rather safe than sorry
 	totals.lock.Lock()
-	if totals.mismatchSrcToTgt > 0 || totals.mismatchTgtToSrc > 0 || totals.missingSrc > 0 || totals.missingTgt > 0 {
+	if totals.hasMismatches() {
 		logger.Error().Msgf("sampling result -  %d missing on source | %d missing on target | %d out of %d sampled source documents mismatched | %d out of %d sampled target documents mismatched - failure", totals.missingSrc, totals.missingTgt, totals.mismatchSrcToTgt, totals.sampledSrc, totals.mismatchTgtToSrc, totals.sampledTgt)
 	} else {
 		logger.Info().Msgf("sampling result -  %d missing on source | %d missing on target | %d out of %d sampled source documents mismatched | %d out of %d sampled target documents mismatched - success", totals.missingSrc, totals.missingTgt, totals.mismatchSrcToTgt, totals.sampledSrc, totals.mismatchTgtToSrc, totals.sampledTgt)
 	}
 	totals.lock.Unlock()
+	result := totals.docTotals()
+	if focus != nil {
+		focused := focus.docTotals()
+		logger.Warn().Msgf("focused result -  %d missing on source | %d missing on target | %d out of %d neighbouring source documents mismatched | %d out of %d neighbouring target documents mismatched", focused.MissingSrc, focused.MissingTgt, focused.MismatchSrcToTgt, focused.SampledSrc, focused.MismatchTgtToSrc, focused.SampledTgt)
+		result.Focus = &focused
+	}
+	c.sampleConfidence(logger, namespace, stratum.name, plan.population, &result)
+	return result, nil
 }
 
-func (c *Comparer) GetSampleSize(ctx context.Context, logger zerolog.Logger, namespace namespacePair) int64 {
-	if c.config.Compare.ForceSampleSize > 0 {
-		return c.config.Compare.ForceSampleSize
+// bounds the inconsistent documents of each side's population from the final totals, reporting and logging the bound
+func (c *Comparer) sampleConfidence(logger zerolog.Logger, namespace namespacePair, stratum string, population util.Pair[int64], totals *DocTotals) {
+	zscore, _ := c.sampleParameters(namespace)
+	if totals.SampledSrc > 0 {
+		confidence := reporter.NewConfidence(totals.MissingTgt+totals.MismatchSrcToTgt, totals.SampledSrc, population.Source, zscore)
+		totals.ConfidenceSrcToTgt = &confidence
+		c.reporter.SampleConfidence(namespace.Names(), stratum, util.SrcToTgt, confidence)
+		logger.Info().Msgf("source documents: %s", confidence)
 	}
-	source, target := c.GetEstimates(ctx, namespace)
-	// we warn about estimated counts, but they are not guarenteed to be equal, so sample from the smaller of both collections
-	max := util.Min64(source, target)
-	ceiling := int64(math.Round(float64(max) * 0.04))
-	sampleSize := util.GetSampleSize(max, c.config.Compare.Zscore, c.config.Compare.ErrorRate)
+	if totals.SampledTgt > 0 {
+		confidence := reporter.NewConfidence(totals.MissingSrc+totals.MismatchTgtToSrc, totals.SampledTgt, population.Target, zscore)
+		totals.ConfidenceTgtToSrc = &confidence
+		c.reporter.SampleConfidence(namespace.Names(), stratum, util.TgtToSrc, confidence)
+		logger.Info().Msgf("target documents: %s", confidence)
+	}
+}
+
+// a cursor of documents to compare in direction dir, opened once the previous source is exhausted
+type sampleSource struct {
+	dir     util.Direction
+	limiter *throttle.Limiter
+	open    func() (*mongo.Cursor, error)
+}
+
+// compares the documents of every source with Compare.DocWorkers workers, adding to totals. Documents already in seen are
+// skipped when it is not nil
+func (c *Comparer) compareSources(ctx context.Context, logger zerolog.Logger, namespace namespacePair, totals *collectionTotals, seen map[util.Direction]map[string]struct{}, sources []sampleSource) error {
+	// the budget bounds memory, the channel only needs to keep the workers busy
+	jobs := make(chan documentBatch, c.config.Compare.DocWorkers)
+	budget := newByteBudget(c.config.Compare.BufferMB * MB)
+
+	pool := worker.NewWorkerPool(logger, c.config.Compare.DocWorkers, "sampleDocWorkers", "sdw")
+	pool.Start(ctx, func(iCtx context.Context, iLogger zerolog.Logger) {
+		c.processDocs(iCtx, iLogger, namespace, jobs, budget, totals)
+	})
+
+	var err error
+	for _, source := range sources {
+		if ctx.Err() != nil {
+			break
+		}
+		var cursor *mongo.Cursor
+		cursor, err = source.open()
+		if err != nil {
+			break
+		}
+		err = c.streamBatches(ctx, logger, jobs, budget, source.dir, source.limiter, cursor, seen[source.dir])
+		// cursors are killed even when ctx was cancelled so they do not linger on the server
+		cursor.Close(context.WithoutCancel(ctx))
+		if err != nil {
+			break
+		}
+	}
+
+	close(jobs)
+	pool.Done()
+	if err == nil {
+		err = totals.err
+	}
+	return err
+}
+
+// returns the number of documents the sample is drawn from on each side, the documents selected by filter when it is not nil
+func (c *Comparer) GetPopulation(ctx context.Context, logger zerolog.Logger, namespace namespacePair, filter bson.D) (util.Pair[int64], error) {
+	if filter == nil {
+		source, target, err := c.GetEstimates(ctx, namespace)
+		if err != nil {
+			return util.Pair[int64]{}, err
+		}
+		return util.Pair[int64]{Source: source, Target: target}, nil
+	}
+	source, err := c.counts.filtered(ctx, c.limiter.Source, c.sourceCollection(namespace), c.clusterTime.Source, filter)
+	if err != nil {
+		return util.Pair[int64]{}, fmt.Errorf("source filtered count: %w", err)
+	}
+	target, err := c.counts.filtered(ctx, c.limiter.Target, c.targetCollection(namespace), c.clusterTime.Target, filter)
+	if err != nil {
+		return util.Pair[int64]{}, fmt.Errorf("target filtered count: %w", err)
+	}
+	logger.Info().Msgf("filter selects %d source documents and %d target documents", source, target)
+	return util.Pair[int64]{Source: source, Target: target}, nil
+}
+
+// counts the documents matching filter, pinned to the snapshot cluster time like the sample itself
+func countFiltered(ctx context.Context, limiter *throttle.Limiter, coll *mongo.Collection, at *primitive.Timestamp, filter bson.D) (int64, error) {
+	pipeline := bson.A{bson.D{{"$match", filter}}, bson.D{{"$count", "n"}}}
+	cursor, err := aggregate(ctx, limiter, coll, at, pipeline, options.Aggregate())
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.WithoutCancel(ctx))
+	// $count returns nothing when no document matches
+	if !cursor.Next(ctx) {
+		return 0, cursor.Err()
+	}
+	return cursor.Current.Lookup("n").AsInt64(), nil
+}
+
+// returns the number of documents to sample out of population
+func (c *Comparer) GetSampleSize(logger zerolog.Logger, namespace namespacePair, population int64) int64 {
+	if fixed := c.fixedSampleSize(namespace); fixed > 0 {
+		return fixed
+	}
+	zscore, errRate := c.sampleParameters(namespace)
+	ceiling := int64(math.Round(float64(population) * 0.04))
+	sampleSize := util.GetSampleSize(population, zscore, errRate)
 	if ceiling > 100 && sampleSize > ceiling {
 		logger.Warn().Msgf("sample size %d too large, using maxSize %d", sampleSize, ceiling)
 		return ceiling
@@ -103,182 +386,312 @@ func (c *Comparer) GetSampleSize(ctx context.Context, logger zerolog.Logger, nam
 	return sampleSize
 }
 
-func (c *Comparer) sampleCursors(ctx context.Context, logger zerolog.Logger, namespace namespacePair) (*mongo.Cursor, *mongo.Cursor) {
-	sampleSize := c.GetSampleSize(ctx, logger, namespace)
-	logger.Info().Msgf("using sample size of %d", sampleSize)
-
-	pipeline := bson.A{bson.D{{"$sample", bson.D{{"size", sampleSize}}}}}
-
-	// if a filter was provided for this namespace, include it in the aggregation to get the docs
-	// WARNING: this can result in less than the sample-size of documents, which can be problematic for the integrity of results
-	if c.nsFilters[namespace.String()] != nil {
-		pipeline = append(pipeline, bson.D{{"$match", c.nsFilters[namespace.String()]}})
+// returns the namespace's sampleSize or Compare.ForceSampleSize, 0 when the sample size is computed from the population
+func (c *Comparer) fixedSampleSize(namespace namespacePair) int64 {
+	if options := c.config.NamespaceOptions(namespace.String()); options.SampleSize > 0 {
+		return options.SampleSize
 	}
+	return c.config.Compare.ForceSampleSize
+}
 
-	pipeline = append(pipeline, bson.D{{"$sort", bson.D{{"_id", 1}}}})
-	opts := options.Aggregate().SetAllowDiskUse(true).SetBatchSize(int32(BATCH_SIZE))
-	logger.Debug().Any("pipeline", pipeline).Any("options", opts).Msg("aggregating")
+// returns a stratum's part of a fixed sample size, in proportion to its part of the namespace's population
+func stratumShare(size int64, population int64, whole int64) int64 {
+	if whole <= 0 || population <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(float64(size) * float64(population) / float64(whole)))
+}
 
-	var srcCursor, tgtCursor *mongo.Cursor
-	var err error
+// returns the zscore and error rate of the namespace's sample, the namespace's options override the configured ones
+func (c *Comparer) sampleParameters(namespace namespacePair) (float64, float64) {
+	options := c.config.NamespaceOptions(namespace.String())
+	zscore, errRate := c.config.Compare.Zscore, c.config.Compare.ErrorRate
+	if options.Zscore > 0 {
+		zscore = options.Zscore
+	}
+	if options.ErrorRate > 0 {
+		errRate = options.ErrorRate
+	}
+	return zscore, errRate
+}
 
-	// added retries to avoid $sample error described in HELP-46067
-	for {
-		srcCursor, err = c.sourceCollection(namespace.Db, namespace.Collection).Aggregate(ctx, pipeline, opts)
-		if err == nil {
-			break
+// returns the stages selecting requested - drawn more random documents out of population from within filter
+func (c *Comparer) sampleStages(filter bson.D, plan samplePlan, drawn int64, requested int64) bson.A {
+	population := util.Min64(plan.population.Source, plan.population.Target)
+	if c.config.Compare.Seed != 0 {
+		seeded := c.seededMatch(plan.band(drawn), plan.band(requested))
+		if filter != nil {
+			return bson.A{bson.D{{"$match", bson.D{{"$and", bson.A{filter, seeded}}}}}}
 		}
-		logger.Debug().Err(err).Msgf("Error sampling source collection. Retrying...")
-		time.Sleep(retryInterval)
+		return bson.A{bson.D{{"$match", seeded}}}
 	}
-
-	for {
-		tgtCursor, err = c.targetCollection(namespace.Db, namespace.Collection).Aggregate(ctx, pipeline, opts)
-		if err == nil {
-			break
+	sampleSize := requested - drawn
+	if c.config.Compare.SampleMethod == cfg.SampleRand {
+		// keeps each document with probability sampleSize / population, the achieved size varies around sampleSize
+		threshold := 1.0
+		if population > 0 && sampleSize < population {
+			threshold = float64(sampleSize) / float64(population)
+		}
+		random := bson.D{{"$expr", bson.D{{"$lt", bson.A{bson.D{{"$rand", bson.D{}}}, threshold}}}}}
+		if filter != nil {
+			return bson.A{bson.D{{"$match", bson.D{{"$and", bson.A{filter, random}}}}}}
 		}
-		logger.Debug().Err(err).Msgf("Error sampling target collection. Retrying...")
-		time.Sleep(retryInterval)
+		return bson.A{bson.D{{"$match", random}}}
 	}
+	stages := bson.A{}
+	if filter != nil {
+		stages = append(stages, bson.D{{"$match", filter}})
+	}
+	return append(stages, bson.D{{"$sample", bson.D{{"size", sampleSize}}}})
+}
 
-	return srcCursor, tgtCursor
+// computes the sample size and the number of documents it is drawn from on each side
+func (c *Comparer) samplePlan(ctx context.Context, logger zerolog.Logger, namespace namespacePair, filter bson.D) (samplePlan, error) {
+	populations, err := c.GetPopulation(ctx, logger, namespace, filter)
+	if err != nil {
+		return samplePlan{}, err
+	}
+	// we warn about estimated counts, but they are not guarenteed to be equal, so sample from the smaller of both collections
+	population := util.Min64(populations.Source, populations.Target)
+	return c.newPlan(logger, namespace, populations, c.GetSampleSize(logger, namespace, population)), nil
 }
 
-// TODO VARIABLE BATCH SIZE
-func streamBatches(ctx context.Context, logger zerolog.Logger, jobs chan documentBatch, dir util.Direction, cursor *mongo.Cursor, totals *collectionTotals) {
-	logger = logger.With().Str("dir", string(dir)).Logger()
-	docCount := 0
-	batchCount := 0
-	buffer := make(batch, BATCH_SIZE)
-	logger.Debug().Msg("starting cursor walk")
-	for cursor.Next(ctx) {
-		var doc bson.Raw
-		err := cursor.Decode(&doc)
+// Returns the sample plan of every stratum, each sized from its own population. A fixed sample size (the namespace's
+// sampleSize or Compare.ForceSampleSize) is the namespace's, split across its strata in proportion to their populations
+func (c *Comparer) strataPlans(ctx context.Context, logger zerolog.Logger, namespace namespacePair, strata []stratum) ([]samplePlan, error) {
+	populations := make([]util.Pair[int64], 0, len(strata))
+	whole := int64(0)
+	for _, each := range strata {
+		stratumPopulation, err := c.GetPopulation(ctx, logger.With().Str("stratum", each.name).Logger(), namespace, each.filter)
 		if err != nil {
-			logger.Error().Err(err).Msg("")
-		}
-		buffer.add(doc)
-		docCount++
-
-		if docCount%BATCH_SIZE == 0 {
-			logger.Trace().Msgf("adding batch %d to be checked", batchCount+1)
-			jobs <- documentBatch{
-				dir:   dir,
-				batch: buffer,
-			}
-			buffer = make(batch, BATCH_SIZE)
-			batchCount++
+			return nil, fmt.Errorf("stratum %s: %w", each.name, err)
 		}
+		populations = append(populations, stratumPopulation)
+		whole += util.Min64(stratumPopulation.Source, stratumPopulation.Target)
 	}
-	// if we counted more than one doc but the counter did not land on a clean batch size, flush the rest
-	if len(buffer) != 0 {
-		logger.Trace().Msgf("adding batch %d to be checked", batchCount+1)
-		jobs <- documentBatch{
-			dir:   dir,
-			batch: buffer,
+	fixed := c.fixedSampleSize(namespace)
+	plans := make([]samplePlan, 0, len(strata))
+	for i, each := range strata {
+		stratumLogger := logger.With().Str("stratum", each.name).Logger()
+		population := util.Min64(populations[i].Source, populations[i].Target)
+		sampleSize := c.GetSampleSize(stratumLogger, namespace, population)
+		if fixed > 0 {
+			sampleSize = stratumShare(fixed, population, whole)
 		}
-		batchCount++
+		plans = append(plans, c.newPlan(stratumLogger, namespace, populations[i], sampleSize))
 	}
+	return plans, nil
 }
 
-func (c *Comparer) batchFind(ctx context.Context, logger zerolog.Logger, namespace namespacePair, toFind documentBatch) documentBatch {
-	buffer := make(batch, BATCH_SIZE)
-	useOr := false
-	var coll *mongo.Collection
-	switch toFind.dir {
-	case util.SrcToTgt:
-		coll = c.targetCollection(namespace.Db, namespace.Collection)
-	case util.TgtToSrc:
-		coll = c.sourceCollection(namespace.Db, namespace.Collection)
-	default:
-		logger.Fatal().Msg("invalid comparison direction?")
+// returns the plan sampling sampleSize documents out of populations, sized by the seed's fraction when seeded
+func (c *Comparer) newPlan(logger zerolog.Logger, namespace namespacePair, populations util.Pair[int64], sampleSize int64) samplePlan {
+	population := util.Min64(populations.Source, populations.Target)
+	fraction := 0.0
+	if c.config.Compare.Seed != 0 {
+		sampleSize, fraction = c.seededSize(namespace, sampleSize, population)
+		logger.Info().Msgf("seeded sample selects %g of the hash space, pass --seedFraction %g with --seed %d to select the same documents again", fraction, fraction, c.config.Compare.Seed)
+		if warning := c.seededScanWarning(population); warning != "" {
+			logger.Warn().Msg(warning)
+		}
 	}
+	logger.Info().Msgf("using sample size of %d out of %d documents", sampleSize, population)
+	return samplePlan{size: sampleSize, population: populations, fraction: fraction}
+}
 
-	filters := bson.A{}
-	if toFind.dir == util.SrcToTgt && namespace.Partitioned.Target {
-		for _, value := range toFind.batch {
+// appends the stages shaping sampled documents for the comparison to the stages selecting them
+func (c *Comparer) samplePipeline(namespace namespacePair, pipeline bson.A) bson.A {
+	if projection := c.projection(namespace); projection != nil {
+		pipeline = append(pipeline, bson.D{{"$project", projection}})
+	}
+	if c.config.Compare.Hash {
+		pipeline = append(pipeline, hashStage(namespace))
+	}
+	return pipeline
+}
 
-			// TODO reduce duplication in this code
-			// if collection is sharded, include shard key value in query to target that shard
-			filter := bson.D{}
+// returns the sources drawing requested - drawn more random documents matching filter from each side
+func (c *Comparer) sampleSources(ctx context.Context, logger zerolog.Logger, namespace namespacePair, filter bson.D, plan samplePlan, drawn int64, requested int64) []sampleSource {
+	pipeline := c.samplePipeline(namespace, c.sampleStages(filter, plan, drawn, requested))
+	pipeline = append(pipeline, bson.D{{"$sort", bson.D{{"_id", 1}}}})
+	logger.Debug().Any("pipeline", pipeline).Msg("aggregating")
+	return []sampleSource{
+		{
+			dir:     util.SrcToTgt,
+			limiter: c.limiter.Source,
+			open: func() (*mongo.Cursor, error) {
+				return c.openSample(ctx, logger, "source", c.limiter.Source, c.sourceCollection(namespace), c.clusterTime.Source, pipeline)
+			},
+		},
+		{
+			dir:     util.TgtToSrc,
+			limiter: c.limiter.Target,
+			open: func() (*mongo.Cursor, error) {
+				return c.openSample(ctx, logger, "target", c.limiter.Target, c.targetCollection(namespace), c.clusterTime.Target, pipeline)
+			},
+		},
+	}
+}
 
-			useOr = true
-			elems, err := namespace.PartitionKey.Target.Elements()
-			if err != nil {
-				log.Error().Err(err)
-			}
-			for _, each := range elems {
-				filter = append(filter, bson.E{each.Key(), value.Lookup(each.Key())})
-			}
-			filter = append(filter, bson.E{"_id", value.Lookup("_id")})
-			filters = append(filters, filter)
+// opens a sample cursor on one side, retrying up to maxSampleRetries times
+func (c *Comparer) openSample(ctx context.Context, logger zerolog.Logger, side string, limiter *throttle.Limiter, coll *mongo.Collection, at *primitive.Timestamp, pipeline bson.A) (*mongo.Cursor, error) {
+	opts := options.Aggregate().SetAllowDiskUse(true).SetBatchSize(int32(util.Min(BATCH_SIZE, c.config.Compare.BatchDocs)))
+	// added retries to avoid $sample error described in HELP-46067
+	for attempt := 1; ; attempt++ {
+		cursor, err := aggregate(ctx, limiter, coll, at, pipeline, opts)
+		if err == nil {
+			return cursor, nil
 		}
-	} else if toFind.dir == util.TgtToSrc && namespace.Partitioned.Source {
-		for _, value := range toFind.batch {
+		if ctx.Err() != nil || attempt == maxSampleRetries {
+			return nil, fmt.Errorf("%s $sample: %w", side, err)
+		}
+		logger.Debug().Err(err).Msgf("Error sampling %s collection. Retrying...", side)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retryInterval):
+		}
+	}
+}
 
-			// TODO reduce duplication in this code
-			// if collection is sharded, include shard key value in query to target that shard
-			filter := bson.D{}
+// cuts the sample into batches of at most Compare.BatchDocs documents and Compare.BatchMB bytes, reserving each batch's
+// bytes from the budget before queueing it. The cursor's batch size follows the average document size seen so far so a
+// getMore returns about one batch. Documents already in seen are skipped and the rest are added to it when it is not nil
+func (c *Comparer) streamBatches(ctx context.Context, logger zerolog.Logger, jobs chan documentBatch, budget *byteBudget, dir util.Direction, limiter *throttle.Limiter, cursor *mongo.Cursor, seen map[string]struct{}) error {
+	logger = logger.With().Str("dir", string(dir)).Logger()
+	maxDocs, maxBytes := c.config.Compare.BatchDocs, c.config.Compare.BatchMB*MB
+	docCount, byteCount := 0, 0
+	batchCount := 0
+	current := documentBatch{dir: dir, batch: make(batch)}
 
-			useOr = true
-			elems, err := namespace.PartitionKey.Source.Elements()
-			if err != nil {
-				log.Error().Err(err)
+	flush := func() bool {
+		logger.Trace().Msgf("adding batch %d of %d documents (%d bytes) to be checked", batchCount+1, len(current.batch), current.bytes)
+		if !budget.acquire(ctx, current.bytes) {
+			return false
+		}
+		select {
+		case jobs <- current:
+		case <-ctx.Done():
+			budget.release(current.bytes)
+			return false
+		}
+		batchCount++
+		current = documentBatch{dir: dir, batch: make(batch)}
+		// size the next getMore from the average document so far
+		cursor.SetBatchSize(int32(util.Max(1, util.Min(maxDocs, maxBytes/util.Max(1, byteCount/docCount)))))
+		return true
+	}
+
+	logger.Debug().Msg("starting cursor walk")
+	for limiter.Next(ctx, cursor) {
+		var doc bson.Raw
+		err := cursor.Decode(&doc)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			continue
+		}
+		if seen != nil {
+			key := doc.Lookup("_id").String()
+			if _, ok := seen[key]; ok {
+				continue
 			}
-			for _, each := range elems {
-				filter = append(filter, bson.E{each.Key(), value.Lookup(each.Key())})
+			seen[key] = struct{}{}
+		}
+		if len(current.batch) > 0 && current.bytes+len(doc) > maxBytes {
+			if !flush() {
+				return nil
 			}
-			filter = append(filter, bson.E{"_id", value.Lookup("_id")})
-			filters = append(filters, filter)
 		}
-	} else {
-		for _, value := range toFind.batch {
-			filters = append(filters, value.Lookup("_id"))
+		current.batch.add(doc)
+		current.bytes += len(doc)
+		docCount++
+		byteCount += len(doc)
+		if len(current.batch) >= maxDocs {
+			if !flush() {
+				return nil
+			}
 		}
 	}
-
-	var query bson.D
-	if useOr {
-		query = bson.D{{"$or", filters}}
-	} else {
-		query = bson.D{{"_id", bson.D{{"$in", filters}}}}
+	// flush the rest when the sample did not land on a clean batch
+	if len(current.batch) != 0 {
+		if !flush() {
+			return nil
+		}
 	}
-	log.Debug().Msgf("sending find: %+v", query)
-	cursor, err := coll.Find(ctx, query, nil)
-
-	if err != nil {
-		log.Fatal().Err(err).Msg("")
+	// an interrupted walk is not an error, the caller checks ctx itself
+	if err := cursor.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("%s sample cursor: %w", dir, err)
 	}
-	defer cursor.Close(ctx)
-	for cursor.Next(ctx) {
-		var doc bson.Raw
-		cursor.Decode(&doc)
+	return nil
+}
 
-		buffer.add(doc)
+func (c *Comparer) batchFind(ctx context.Context, logger zerolog.Logger, namespace namespacePair, toFind documentBatch) (documentBatch, error) {
+	coll, at, limiter := c.lookupCollection(logger, namespace, toFind.dir)
+	// every document of the batch in a single reply, the server still caps a reply at 16MB
+	opts := options.Find().SetBatchSize(int32(len(toFind.batch)))
+	if projection := c.projection(namespace); projection != nil {
+		opts.SetProjection(projection)
 	}
+	buffer, err := c.lookup(ctx, logger, namespace, toFind, limiter, func(query bson.D) (*mongo.Cursor, error) {
+		log.Debug().Msgf("sending find: %+v", query)
+		return find(ctx, limiter, coll, at, query, opts)
+	})
 	if err != nil {
-		log.Fatal().Err(err).Msg("")
+		return documentBatch{}, fmt.Errorf("%s batch find: %w", toFind.dir, err)
 	}
 	logger.Trace().Msgf("buffer %s", buffer)
 	return documentBatch{
 		dir:   toFind.dir,
 		batch: buffer,
+	}, nil
+}
+
+// compares a source and target document under the namespace's ignored and compared fields. Returns nil when the documents match
+func (c *Comparer) compareDocs(namespace namespacePair, srcDoc bson.Raw, tgtDoc bson.Raw) (*doc.MismatchDetails, error) {
+	return doc.BsonUnorderedCompareRawDocumentWithOptions(srcDoc, tgtDoc, c.compareOptions(namespace))
+}
+
+func (c *Comparer) compareOptions(namespace namespacePair) doc.CompareOptions {
+	options := c.config.NamespaceOptions(namespace.String())
+	return doc.CompareOptions{
+		Ignore:             options.IgnoreFields,
+		Only:               options.CompareFields,
+		UnorderedArrays:    options.UnorderedArrays,
+		NumericEquivalence: c.config.Compare.NumericEquivalence,
+		Epsilon:            c.config.Compare.Epsilon,
 	}
 }
 
-func (c *Comparer) batchCompare(ctx context.Context, logger zerolog.Logger, namespace namespacePair, a documentBatch, b documentBatch) reporter.DocSummary {
-	var summary reporter.DocSummary
-	var outer, inner batch
-	if len(b.batch) > len(a.batch) {
-		outer, inner = b.batch, a.batch
-	} else {
-		outer, inner = a.batch, b.batch
+// returns the projection fetching only the fields compared for the namespace, nil to fetch whole documents.
+// Shard key fields are always fetched since documents are looked up by them on the other side
+func (c *Comparer) projection(namespace namespacePair) bson.D {
+	return c.compareOptions(namespace).Projection(shardKeyFields(namespace)...)
+}
+
+// returns the shard key fields of both sides
+func shardKeyFields(namespace namespacePair) []string {
+	fields := []string{}
+	for _, key := range []bson.Raw{namespace.PartitionKey.Source, namespace.PartitionKey.Target} {
+		elements, _ := key.Elements()
+		for _, each := range elements {
+			fields = append(fields, each.Key())
+		}
 	}
-	logger.Trace().Msgf("comparing outer %s, inner %s", outer, inner)
-	for key, aDoc := range outer {
+	return fields
+}
+
+func (c *Comparer) batchCompare(ctx context.Context, logger zerolog.Logger, namespace namespacePair, a documentBatch, b documentBatch) (reporter.DocSummary, []inconsistentDoc) {
+	var summary reporter.DocSummary
+	var inconsistent []inconsistentDoc
+	logger.Trace().Msgf("comparing sampled %s, looked up %s", a.batch, b.batch)
+	// every key of the sampled batch was looked up on the other side, so anything not found there is missing
+	for key, aDoc := range a.batch {
 		logger.Trace().Msgf("comparing key %s", key)
-		if bDoc, ok := inner[key]; ok {
-			comparison, err := doc.BsonUnorderedCompareRawDocumentWithDetails(aDoc, bDoc)
+		if bDoc, ok := b.batch[key]; ok {
+			srcDoc, tgtDoc := aDoc, bDoc
+			if a.dir == util.TgtToSrc {
+				srcDoc, tgtDoc = bDoc, aDoc
+			}
+			comparison, err := c.compareDocs(namespace, srcDoc, tgtDoc)
 			if err != nil {
 				log.Error().Err(err).Msg("")
 			}
@@ -286,6 +699,15 @@ func (c *Comparer) batchCompare(ctx context.Context, logger zerolog.Logger, name
 				summary.Equal++
 				continue
 			}
+			if comparison.Equivalent() {
+				logger.Debug().Msgf("%s only differs in ways the comparison tolerates", key)
+				if !c.config.SkipDocReports {
+					c.reporter.MinorMismatchDoc(namespace.Names(), a.dir, srcDoc, tgtDoc, comparison.Diffs)
+				}
+				summary.Equal++
+				summary.Minor++
+				continue
+			}
 			if len(comparison.MissingFieldOnDst) > 0 {
 				logger.Debug().Msgf("%s is missing fields on the target", key)
 			}
@@ -296,39 +718,67 @@ func (c *Comparer) batchCompare(ctx context.Context, logger zerolog.Logger, name
 				logger.Debug().Msgf("%s is different between the source and target", key)
 			}
 			if !c.config.SkipDocReports {
-				c.reporter.MismatchDoc(namespace.String(), a.dir, aDoc, bDoc)
+				c.reporter.MismatchDoc(namespace.Names(), a.dir, srcDoc, tgtDoc, comparison.Diffs)
 			}
+			inconsistent = append(inconsistent, inconsistentDoc{dir: a.dir, key: key, doc: aDoc})
 			summary.Different++
 		} else {
 			logger.Debug().Msgf("_id %v not found", key)
 			if !c.config.SkipDocReports {
-				c.reporter.MissingDoc(namespace.String(), a.dir, aDoc)
+				c.reporter.MissingDoc(namespace.Names(), a.dir, aDoc)
 			}
+			inconsistent = append(inconsistent, inconsistentDoc{dir: a.dir, key: key, doc: aDoc, missing: true})
 			summary.Missing++
 		}
 	}
-	return summary
+	return summary, inconsistent
 }
 
-func (c *Comparer) processDocs(ctx context.Context, logger zerolog.Logger, namespace namespacePair, jobs chan documentBatch, totals *collectionTotals) {
+func (c *Comparer) processDocs(ctx context.Context, logger zerolog.Logger, namespace namespacePair, jobs chan documentBatch, budget *byteBudget, totals *collectionTotals) {
 	for processing := range jobs {
-		dirLogger := logger.With().Str("dir", string(processing.dir)).Logger()
-		lookedUp := c.batchFind(ctx, dirLogger, namespace, processing)
-		summary := c.batchCompare(ctx, dirLogger, namespace, processing, lookedUp)
-		if summary.HasMismatches() {
-			c.reporter.SampleSummary(namespace.String(), processing.dir, summary)
-			totals.lock.Lock()
-			switch processing.dir {
-			case util.SrcToTgt:
-				totals.mismatchSrcToTgt += int64(summary.Different)
-				totals.missingTgt += int64(summary.Missing)
-				totals.sampledSrc += int64(summary.Equal) + int64(summary.Missing) + int64(summary.Different)
-			case util.TgtToSrc:
-				totals.mismatchTgtToSrc += int64(summary.Different)
-				totals.missingSrc += int64(summary.Missing)
-				totals.sampledTgt += int64(summary.Equal) + int64(summary.Missing) + int64(summary.Different)
-			}
-			totals.lock.Unlock()
+		// keep draining so the producer never blocks, but stop looking up documents once interrupted or failed
+		if ctx.Err() == nil && !totals.failed() {
+			c.processBatch(ctx, logger, namespace, processing, totals)
+		}
+		budget.release(processing.bytes)
+	}
+}
+
+func (c *Comparer) processBatch(ctx context.Context, logger zerolog.Logger, namespace namespacePair, processing documentBatch, totals *collectionTotals) {
+	dirLogger := logger.With().Str("dir", string(processing.dir)).Logger()
+	var summary reporter.DocSummary
+	var inconsistent []inconsistentDoc
+	if c.config.Compare.Hash {
+		var err error
+		summary, inconsistent, err = c.hashCompare(ctx, dirLogger, namespace, processing)
+		if err != nil {
+			totals.fail(err)
+			return
 		}
+	} else {
+		lookedUp, err := c.batchFind(ctx, dirLogger, namespace, processing)
+		if err != nil {
+			totals.fail(err)
+			return
+		}
+		summary, inconsistent = c.batchCompare(ctx, dirLogger, namespace, processing, lookedUp)
+	}
+	if summary.HasMismatches() || summary.Minor > 0 {
+		c.reporter.SampleSummary(namespace.Names(), totals.stratum, processing.dir, summary)
+	}
+	totals.lock.Lock()
+	defer totals.lock.Unlock()
+	switch processing.dir {
+	case util.SrcToTgt:
+		totals.mismatchSrcToTgt += int64(summary.Different)
+		totals.missingTgt += int64(summary.Missing)
+		totals.minorSrcToTgt += int64(summary.Minor)
+		totals.sampledSrc += int64(summary.Equal) + int64(summary.Missing) + int64(summary.Different)
+	case util.TgtToSrc:
+		totals.mismatchTgtToSrc += int64(summary.Different)
+		totals.missingSrc += int64(summary.Missing)
+		totals.minorTgtToSrc += int64(summary.Minor)
+		totals.sampledTgt += int64(summary.Equal) + int64(summary.Missing) + int64(summary.Different)
 	}
+	totals.inconsistent = append(totals.inconsistent, inconsistent...)
 }
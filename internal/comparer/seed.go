@@ -0,0 +1,84 @@
+package comparer
+
+import (
+	"fmt"
+	"math"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// populations from which a seeded sample warns about the collection scan each of its rounds costs
+const LARGE_SEEDED_POPULATION = 10_000_000
+
+// Returns the sample size and the fraction of the hash space a seeded sample selects. A fixed fraction (Compare.SeedFraction
+// or the namespace's seedFraction) selects the same documents whatever the counts, sized for the population. Otherwise the
+// fraction is derived from the sample size and population, which change with the counts between runs
+func (c *Comparer) seededSize(namespace namespacePair, sampleSize int64, population int64) (int64, float64) {
+	fraction := c.config.Compare.SeedFraction
+	if options := c.config.NamespaceOptions(namespace.String()); options.SeedFraction > 0 {
+		fraction = options.SeedFraction
+	}
+	if fraction > 0 {
+		return int64(math.Ceil(fraction * float64(population))), fraction
+	}
+	if population <= 0 || sampleSize >= population {
+		return sampleSize, 1
+	}
+	return sampleSize, float64(sampleSize) / float64(population)
+}
+
+// returns the fraction of the hash space holding the first n documents of a seeded sample
+func (p samplePlan) band(n int64) float64 {
+	if p.size <= 0 || n >= p.size {
+		return p.fraction
+	}
+	return p.fraction * float64(n) / float64(p.size)
+}
+
+// Matches the documents whose hash of their _id and Compare.Seed falls between the fractions low and high of the hash
+// space. The same seed and fractions select the same documents on every run and the bands of later rounds never select
+// a document twice. Like SampleRand the achieved size varies around the requested size. No index serves the hash, so
+// every round scans the whole collection (or the documents the filter selects) on each side, see seededScanWarning
+func (c *Comparer) seededMatch(low float64, high float64) bson.D {
+	hash := bson.D{{"$toHashedIndexKey", bson.D{{"id", "$_id"}, {"seed", c.config.Compare.Seed}}}}
+	conditions := bson.A{}
+	if low > 0 {
+		lower, ok := hashBound(low)
+		if !ok {
+			// everything was drawn already
+			lower = math.MaxInt64
+		}
+		conditions = append(conditions, bson.D{{"$gte", bson.A{hash, lower}}})
+	}
+	if upper, ok := hashBound(high); ok {
+		conditions = append(conditions, bson.D{{"$lt", bson.A{hash, upper}}})
+	}
+	return bson.D{{"$expr", bson.D{{"$and", conditions}}}}
+}
+
+// returns the hash below which a fraction of the hash space falls, or false when that covers every hash
+func hashBound(fraction float64) (int64, bool) {
+	if fraction >= 1 {
+		return 0, false
+	}
+	if fraction <= 0 {
+		return math.MinInt64, true
+	}
+	bound := float64(math.MinInt64) + fraction*math.Exp2(64)
+	if bound >= math.Exp2(63) {
+		return 0, false
+	}
+	return int64(bound), true
+}
+
+// returns a warning about the scans a seeded sample of a large population costs, empty when it is small
+func (c *Comparer) seededScanWarning(population int64) string {
+	if population < LARGE_SEEDED_POPULATION {
+		return ""
+	}
+	scans := "a full scan"
+	if c.config.Compare.Sequential {
+		scans = "a full scan per round"
+	}
+	return fmt.Sprintf("seeded samples hash the _id of every document with no index to serve it, drawing from %d documents costs %s of each side", population, scans)
+}
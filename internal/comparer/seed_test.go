@@ -0,0 +1,97 @@
+package comparer
+
+import (
+	"math"
+	"testing"
+
+	"sampler/internal/cfg"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestHashBound(t *testing.T) {
+	// nothing drawn starts at the lowest hash
+	bound, ok := hashBound(samplePlan{size: 100, fraction: 0.1}.band(0))
+	assert.True(t, ok)
+	assert.Equal(t, int64(math.MinInt64), bound)
+
+	// half of the hash space ends at 0
+	bound, ok = hashBound(0.5)
+	assert.True(t, ok)
+	assert.Equal(t, int64(0), bound)
+
+	// a sample of the whole population covers every hash
+	_, ok = hashBound(samplePlan{size: 100, fraction: 1}.band(100))
+	assert.False(t, ok)
+	_, ok = hashBound(1.5)
+	assert.False(t, ok)
+}
+
+func TestSamplePlanBand(t *testing.T) {
+	plan := samplePlan{size: 200, fraction: 0.02}
+	assert.Equal(t, 0.0, plan.band(0))
+	assert.InDelta(t, 0.01, plan.band(100), 1e-12)
+	assert.Equal(t, 0.02, plan.band(200))
+	// rounds never select beyond the plan's fraction
+	assert.Equal(t, 0.02, plan.band(400))
+}
+
+func TestSeededSize(t *testing.T) {
+	c := &Comparer{config: cfg.Configuration{}}
+	c.config.Compare.Seed = 7
+
+	// derived from the sample size, changes with the population
+	size, fraction := c.seededSize(namespacePair{}, 100, 1000)
+	assert.Equal(t, int64(100), size)
+	assert.Equal(t, 0.1, fraction)
+	size, fraction = c.seededSize(namespacePair{}, 100, 50)
+	assert.Equal(t, int64(100), size)
+	assert.Equal(t, 1.0, fraction)
+
+	// fixed, sized for the population
+	c.config.Compare.SeedFraction = 0.25
+	size, fraction = c.seededSize(namespacePair{}, 100, 1000)
+	assert.Equal(t, int64(250), size)
+	assert.Equal(t, 0.25, fraction)
+}
+
+func TestSeededMatch(t *testing.T) {
+	c := &Comparer{config: cfg.Configuration{}}
+	c.config.Compare.Seed = 7
+	plan := samplePlan{size: 200, fraction: 0.5}
+
+	conditions := func(match bson.D) bson.A {
+		return match[0].Value.(bson.D)[0].Value.(bson.A)
+	}
+	operator := func(condition interface{}) string {
+		return condition.(bson.D)[0].Key
+	}
+
+	// the first round has no lower bound
+	first := conditions(c.seededMatch(plan.band(0), plan.band(100)))
+	assert.Len(t, first, 1)
+	assert.Equal(t, "$lt", operator(first[0]))
+
+	// later rounds start where the drawn documents end
+	next := conditions(c.seededMatch(plan.band(100), plan.band(200)))
+	assert.Len(t, next, 2)
+	assert.Equal(t, "$gte", operator(next[0]))
+	assert.Equal(t, int64(math.MinInt64/2), next[0].(bson.D)[0].Value.(bson.A)[1])
+	assert.Equal(t, "$lt", operator(next[1]))
+	assert.Equal(t, int64(0), next[1].(bson.D)[0].Value.(bson.A)[1])
+
+	// a band covering every hash has no upper bound
+	whole := conditions(c.seededMatch(0.5, 1))
+	assert.Len(t, whole, 1)
+	assert.Equal(t, "$gte", operator(whole[0]))
+}
+
+func TestSeededScanWarning(t *testing.T) {
+	c := &Comparer{config: cfg.Configuration{Compare: cfg.Compare{Seed: 7}}}
+	assert.Empty(t, c.seededScanWarning(LARGE_SEEDED_POPULATION-1))
+	assert.Contains(t, c.seededScanWarning(LARGE_SEEDED_POPULATION), "a full scan of each side")
+
+	c.config.Compare.Sequential = true
+	assert.Contains(t, c.seededScanWarning(LARGE_SEEDED_POPULATION), "a full scan per round")
+}
@@ -0,0 +1,31 @@
+package comparer
+
+import (
+	"sampler/internal/util"
+
+	"github.com/rs/zerolog"
+)
+
+// Returns the cumulative size of the next round of a sequential sample after drawn documents, or drawn once it can stop.
+// A round without inconsistent documents stops the sample when the Wilson upper bound of both directions is within the
+// error rate, otherwise the sample doubles. Once a round finds an inconsistent document the sample jumps to its full
+// size to characterize how many differ
+func (c *Comparer) nextRound(logger zerolog.Logger, namespace namespacePair, totals *collectionTotals, drawn int64, full int64) int64 {
+	if drawn >= full {
+		return drawn
+	}
+	zscore, errRate := c.sampleParameters(namespace)
+	totals.lock.Lock()
+	defer totals.lock.Unlock()
+	if totals.hasMismatches() {
+		logger.Warn().Msgf("found %d inconsistent documents in %d sampled, escalating to the full sample of %d", len(totals.inconsistent), drawn, full)
+		return full
+	}
+	_, highSrc := util.WilsonInterval(0, totals.sampledSrc, zscore)
+	_, highTgt := util.WilsonInterval(0, totals.sampledTgt, zscore)
+	if highSrc <= errRate && highTgt <= errRate {
+		logger.Info().Msgf("no inconsistencies in %d source and %d target documents, the upper bounds %.4f%% and %.4f%% are within the error rate %.4f%%, stopping early", totals.sampledSrc, totals.sampledTgt, highSrc*100, highTgt*100, errRate*100)
+		return drawn
+	}
+	return util.Min64(drawn*2, full)
+}
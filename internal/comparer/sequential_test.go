@@ -0,0 +1,72 @@
+package comparer
+
+import (
+	"sampler/internal/cfg"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextRound(t *testing.T) {
+	tests := []struct {
+		name     string
+		errRate  float64
+		sampled  [2]int64
+		missing  int64
+		drawn    int64
+		full     int64
+		expected int64
+	}{
+		{
+			name:    "the full sample is drawn",
+			errRate: 0.01, sampled: [2]int64{1000, 1000}, drawn: 1000, full: 1000,
+			expected: 1000,
+		},
+		{
+			// the upper bound of 0 in 100 at 1.96 is about 3.7%
+			name:    "doubles while the upper bound exceeds the error rate",
+			errRate: 0.01, sampled: [2]int64{100, 100}, drawn: 100, full: 10000,
+			expected: 200,
+		},
+		{
+			name:    "doubling is capped at the full size",
+			errRate: 0.001, sampled: [2]int64{600, 600}, drawn: 600, full: 1000,
+			expected: 1000,
+		},
+		{
+			// the upper bound of 0 in 1000 at 1.96 is about 0.38%
+			name:    "stops once the upper bound is within the error rate",
+			errRate: 0.01, sampled: [2]int64{1000, 1000}, drawn: 1000, full: 10000,
+			expected: 1000,
+		},
+		{
+			name:    "both directions must be within the error rate",
+			errRate: 0.01, sampled: [2]int64{1000, 100}, drawn: 1000, full: 10000,
+			expected: 2000,
+		},
+		{
+			name:    "an inconsistency jumps to the full size",
+			errRate: 0.01, sampled: [2]int64{1000, 1000}, missing: 1, drawn: 1000, full: 10000,
+			expected: 10000,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Comparer{config: cfg.Configuration{Compare: cfg.Compare{Zscore: 1.96, ErrorRate: test.errRate}}}
+			totals := &collectionTotals{sampledSrc: test.sampled[0], sampledTgt: test.sampled[1], missingTgt: test.missing}
+			assert.Equal(t, test.expected, c.nextRound(zerolog.Nop(), namespacePair{}, totals, test.drawn, test.full))
+		})
+	}
+}
+
+func TestNextRoundNamespaceErrorRate(t *testing.T) {
+	c := &Comparer{config: cfg.Configuration{
+		Compare:    cfg.Compare{Zscore: 1.96, ErrorRate: 0.01},
+		Namespaces: map[string]cfg.NamespaceOptions{"shop.orders": {ErrorRate: 0.001}},
+	}}
+	totals := &collectionTotals{sampledSrc: 1000, sampledTgt: 1000}
+	assert.Equal(t, int64(1000), c.nextRound(zerolog.Nop(), namespacePair{Db: "shop", Collection: "users"}, totals, 1000, 10000))
+	// the namespace's error rate needs more documents
+	assert.Equal(t, int64(2000), c.nextRound(zerolog.Nop(), namespacePair{Db: "shop", Collection: "orders"}, totals, 1000, 10000))
+}
@@ -0,0 +1,320 @@
+package comparer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"sampler/internal/cfg"
+
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// most strata a namespace is split into by field, the values beyond the most common share one more stratum
+const MAX_STRATA = 100
+
+// A slice of the population sampled and reported on its own, filter selects its documents including the namespace's filter
+type stratum struct {
+	name   string
+	filter bson.D
+}
+
+// Returns the strata of a namespace, or a single unnamed stratum holding the namespace's filter when it is not split.
+// Strata are computed from the source and applied to both sides
+func (c *Comparer) strata(ctx context.Context, logger zerolog.Logger, namespace namespacePair) ([]stratum, error) {
+	filter := c.nsFilters[namespace.String()]
+	whole := []stratum{{filter: filter}}
+	var strata []stratum
+	var err error
+	switch c.config.Compare.Strata {
+	case cfg.StrataShard:
+		if !namespace.Partitioned.Source {
+			logger.Warn().Msg("collection is not sharded on the source, sampling without strata")
+			return whole, nil
+		}
+		strata, err = c.shardStrata(ctx, namespace)
+	case cfg.StrataTime:
+		strata, err = c.timeStrata(ctx, namespace, filter)
+	case cfg.StrataField:
+		strata, err = c.fieldStrata(ctx, namespace, filter)
+	default:
+		return whole, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s strata: %w", c.config.Compare.Strata, err)
+	}
+	if len(strata) == 0 {
+		logger.Warn().Msg("found no strata, sampling without strata")
+		return whole, nil
+	}
+	if filter != nil {
+		for i := range strata {
+			strata[i].filter = bson.D{{"$and", bson.A{filter, strata[i].filter}}}
+		}
+	}
+	logger.Info().Msgf("sampling %d strata", len(strata))
+	return strata, nil
+}
+
+// a range of shard key values owned by a shard, min inclusive and max exclusive
+type chunkRange struct {
+	min bson.Raw
+	max bson.Raw
+}
+
+// One stratum per shard owning chunks of the source collection, selecting the documents within its chunks' ranges.
+// Adjacent chunks of a shard are merged into one range
+func (c *Comparer) shardStrata(ctx context.Context, namespace namespacePair) ([]stratum, error) {
+	chunks, err := loadChunks(ctx, &c.sourceClient, namespace.String())
+	if err != nil {
+		return nil, err
+	}
+	ranges := make(map[string][]chunkRange)
+	for _, each := range chunks {
+		owned := ranges[each.shard]
+		if last := len(owned) - 1; last >= 0 && bytes.Equal(owned[last].max, each.min) {
+			owned[last].max = each.max
+			continue
+		}
+		ranges[each.shard] = append(owned, chunkRange{min: each.min, max: each.max})
+	}
+
+	key := namespace.PartitionKey.Source
+	strata := make([]stratum, 0, len(ranges))
+	for _, shard := range sortedKeys(ranges) {
+		or := bson.A{}
+		for _, each := range ranges[shard] {
+			or = append(or, chunkMatch(key, each))
+		}
+		strata = append(strata, stratum{name: "shard:" + shard, filter: bson.D{{"$or", or}}})
+	}
+	return strata, nil
+}
+
+// Matches the documents within a chunk's range with plain comparisons on the shard key fields so the shard key index
+// bounds the scan. Compound shard keys compare field by field like the shard key itself. Hashed fields hold hashes in
+// the chunks, which only $toHashedIndexKey in an $expr can compare and no index can serve
+func chunkMatch(key bson.Raw, chunk chunkRange) bson.D {
+	elements, _ := key.Elements()
+	fields := make([]string, 0, len(elements))
+	for _, each := range elements {
+		if kind, ok := each.Value().StringValueOK(); ok && kind == "hashed" {
+			return hashedChunkMatch(elements, chunk)
+		}
+		fields = append(fields, each.Key())
+	}
+	if len(fields) == 1 {
+		return bson.D{{fields[0], bson.D{{"$gte", chunk.min.Lookup(fields[0])}, {"$lt", chunk.max.Lookup(fields[0])}}}}
+	}
+	// the leading field's range alone bounds the index scan, the field by field comparisons select within it
+	and := bson.A{bson.D{{fields[0], bson.D{{"$gte", chunk.min.Lookup(fields[0])}, {"$lte", chunk.max.Lookup(fields[0])}}}}}
+	if lower := keyBound(fields, chunk.min, "$gt", "$gte"); lower != nil {
+		and = append(and, lower)
+	}
+	if upper := keyBound(fields, chunk.max, "$lt", "$lt"); upper != nil {
+		and = append(and, upper)
+	}
+	return bson.D{{"$and", and}}
+}
+
+// Matches the documents whose shard key compares to bound with strict on a leading field or last on the final one.
+// Trailing MinKey values of a bound compare like the fields before them and are dropped, nil when no field is left
+func keyBound(fields []string, bound bson.Raw, strict string, last string) bson.D {
+	values := make([]bson.RawValue, len(fields))
+	for i, field := range fields {
+		values[i] = bound.Lookup(field)
+	}
+	for len(values) > 0 && values[len(values)-1].Type == bsontype.MinKey {
+		values = values[:len(values)-1]
+	}
+	or := bson.A{}
+	for i := range values {
+		condition := bson.D{}
+		for j := 0; j < i; j++ {
+			condition = append(condition, bson.E{fields[j], values[j]})
+		}
+		operator := strict
+		if i == len(values)-1 {
+			operator = last
+		}
+		or = append(or, append(condition, bson.E{fields[i], bson.D{{operator, values[i]}}}))
+	}
+	switch len(or) {
+	case 0:
+		return nil
+	case 1:
+		return or[0].(bson.D)
+	}
+	return bson.D{{"$or", or}}
+}
+
+// matches the documents within a chunk's range of a shard key with a hashed field, comparing the shard key as an array
+func hashedChunkMatch(elements []bson.RawElement, chunk chunkRange) bson.D {
+	values, lower, upper := bson.A{}, bson.A{}, bson.A{}
+	for _, each := range elements {
+		var value interface{} = "$" + each.Key()
+		if kind, ok := each.Value().StringValueOK(); ok && kind == "hashed" {
+			value = bson.D{{"$toHashedIndexKey", value}}
+		}
+		values = append(values, value)
+		lower = append(lower, chunk.min.Lookup(each.Key()))
+		upper = append(upper, chunk.max.Lookup(each.Key()))
+	}
+	return bson.D{{"$expr", bson.D{{"$and", bson.A{
+		bson.D{{"$gte", bson.A{values, bson.D{{"$literal", lower}}}}},
+		bson.D{{"$lt", bson.A{values, bson.D{{"$literal", upper}}}}},
+	}}}}}
+}
+
+// Splits the ObjectId _ids matching filter on the source into Compare.StrataBuckets windows of equal length between the
+// oldest and newest, the last window is open ended. Documents whose _id is not an ObjectId are in no stratum
+func (c *Comparer) timeStrata(ctx context.Context, namespace namespacePair, filter bson.D) ([]stratum, error) {
+	oldest, found, err := c.edgeObjectID(ctx, namespace, filter, 1)
+	if err != nil || !found {
+		return nil, err
+	}
+	newest, _, err := c.edgeObjectID(ctx, namespace, filter, -1)
+	if err != nil {
+		return nil, err
+	}
+	return timeWindows(oldest.Timestamp(), newest.Timestamp(), c.config.Compare.StrataBuckets), nil
+}
+
+// Splits the ObjectId _ids from start to end into buckets windows of equal length, each from its start (inclusive) to
+// the next one's (exclusive). The last window is open ended so ObjectIds later in its final second are not lost
+func timeWindows(start time.Time, end time.Time, buckets int) []stratum {
+	// ObjectIds only hold whole seconds
+	width := (end.Sub(start) / time.Duration(buckets)).Truncate(time.Second)
+	if width < time.Second {
+		width = time.Second
+	}
+
+	strata := []stratum{}
+	for from := start; !from.After(end); from = from.Add(width) {
+		window := bson.D{{"$gte", timeObjectID(from)}}
+		if len(strata) == buckets-1 || from.Add(width).After(end) {
+			strata = append(strata, stratum{name: "time:" + from.UTC().Format(time.RFC3339), filter: bson.D{{"_id", window}}})
+			break
+		}
+		window = append(window, bson.E{"$lt", timeObjectID(from.Add(width))})
+		strata = append(strata, stratum{name: "time:" + from.UTC().Format(time.RFC3339), filter: bson.D{{"_id", window}}})
+	}
+	return strata
+}
+
+// returns the smallest ObjectId of a second, NewObjectIDFromTimestamp fills in the rest and would skip ObjectIds of it
+func timeObjectID(t time.Time) primitive.ObjectID {
+	var id primitive.ObjectID
+	binary.BigEndian.PutUint32(id[0:4], uint32(t.Unix()))
+	return id
+}
+
+// returns the smallest (order 1) or largest (order -1) ObjectId _id matching filter on the source
+func (c *Comparer) edgeObjectID(ctx context.Context, namespace namespacePair, filter bson.D, order int) (primitive.ObjectID, bool, error) {
+	match := bson.D{{"_id", bson.D{{"$type", "objectId"}}}}
+	if filter != nil {
+		match = bson.D{{"$and", bson.A{filter, match}}}
+	}
+	pipeline := bson.A{
+		bson.D{{"$match", match}},
+		bson.D{{"$sort", bson.D{{"_id", order}}}},
+		bson.D{{"$limit", 1}},
+		bson.D{{"$project", bson.D{{"_id", 1}}}},
+	}
+	cursor, err := aggregate(ctx, c.limiter.Source, c.sourceCollection(namespace), c.clusterTime.Source, pipeline, options.Aggregate())
+	if err != nil {
+		return primitive.ObjectID{}, false, err
+	}
+	defer cursor.Close(context.WithoutCancel(ctx))
+	if !cursor.Next(ctx) {
+		return primitive.ObjectID{}, false, cursor.Err()
+	}
+	return cursor.Current.Lookup("_id").ObjectID(), true, nil
+}
+
+// One stratum per value of the namespace's strata field matching filter on the source, most common first. Documents
+// missing the field are in the null stratum, values beyond the MAX_STRATA most common share one more stratum
+func (c *Comparer) fieldStrata(ctx context.Context, namespace namespacePair, filter bson.D) ([]stratum, error) {
+	field := c.config.Compare.StrataField
+	if options := c.config.NamespaceOptions(namespace.String()); options.StrataField != "" {
+		field = options.StrataField
+	}
+	if field == "" {
+		return nil, fmt.Errorf("no --strataField or strataField for %s", namespace.String())
+	}
+	pipeline := bson.A{}
+	if filter != nil {
+		pipeline = append(pipeline, bson.D{{"$match", filter}})
+	}
+	pipeline = append(pipeline,
+		bson.D{{"$group", bson.D{
+			{"_id", "$" + field},
+			{"n", bson.D{{"$sum", 1}}},
+			{"arrays", bson.D{{"$sum", bson.D{{"$cond", bson.A{bson.D{{"$isArray", bson.A{"$" + field}}}, 1, 0}}}}}},
+		}}},
+		// arrays are looked for among every value, not only the most common ones
+		bson.D{{"$facet", bson.D{
+			{"values", bson.A{
+				bson.D{{"$sort", bson.D{{"n", -1}, {"_id", 1}}}},
+				bson.D{{"$limit", MAX_STRATA + 1}},
+			}},
+			{"arrays", bson.A{
+				bson.D{{"$match", bson.D{{"arrays", bson.D{{"$gt", 0}}}}}},
+				bson.D{{"$limit", 1}},
+			}},
+		}}},
+	)
+	cursor, err := aggregate(ctx, c.limiter.Source, c.sourceCollection(namespace), c.clusterTime.Source, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.WithoutCancel(ctx))
+
+	if !cursor.Next(ctx) {
+		return nil, cursor.Err()
+	}
+	values, err := fieldValues(field, cursor.Current)
+	if err != nil {
+		return nil, err
+	}
+	return valueStrata(field, values), nil
+}
+
+// Returns the most common values of field from fieldStrata's result. A field holding arrays cannot be stratified, $group
+// keeps a whole array as one value while matching a value also matches the arrays holding it, so strata would overlap
+func fieldValues(field string, result bson.Raw) (bson.A, error) {
+	if arrays, _ := result.Lookup("arrays").Array().Values(); len(arrays) > 0 {
+		return nil, fmt.Errorf("%s holds arrays (e.x: %s), strata fields must hold a single value", field, arrays[0].Document().Lookup("_id"))
+	}
+	groups, _ := result.Lookup("values").Array().Values()
+	values := bson.A{}
+	for _, each := range groups {
+		values = append(values, each.Document().Lookup("_id"))
+	}
+	return values, nil
+}
+
+// One stratum per value of field in values, most common first. Values beyond the MAX_STRATA first share one more stratum
+func valueStrata(field string, values bson.A) []stratum {
+	rest := len(values) > MAX_STRATA
+	if rest {
+		values = values[:MAX_STRATA]
+	}
+	strata := make([]stratum, 0, len(values)+1)
+	for _, each := range values {
+		strata = append(strata, stratum{
+			name:   fmt.Sprintf("%s=%s", field, each),
+			filter: bson.D{{field, bson.D{{"$eq", each}}}},
+		})
+	}
+	if rest {
+		strata = append(strata, stratum{name: field + "=(other)", filter: bson.D{{field, bson.D{{"$nin", values}}}}})
+	}
+	return strata
+}
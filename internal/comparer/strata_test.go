@@ -0,0 +1,112 @@
+package comparer
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func testJSON(t *testing.T, filter bson.D) string {
+	json, err := bson.MarshalExtJSON(filter, false, false)
+	assert.Nil(t, err)
+	return string(json)
+}
+
+func TestChunkMatch(t *testing.T) {
+	single := chunkRange{min: testRaw(bson.D{{"x", primitive.MinKey{}}}), max: testRaw(bson.D{{"x", 10}})}
+	assert.Equal(t, `{"x":{"$gte":{"$minKey":1},"$lt":10}}`, testJSON(t, chunkMatch(testRaw(bson.D{{"x", 1}}), single)))
+
+	compound := chunkRange{min: testRaw(bson.D{{"a", 1}, {"b", 5}}), max: testRaw(bson.D{{"a", 3}, {"b", primitive.MinKey{}}})}
+	assert.Equal(t, `{"$and":[`+
+		`{"a":{"$gte":1,"$lte":3}},`+
+		`{"$or":[{"a":{"$gt":1}},{"a":1,"b":{"$gte":5}}]},`+
+		`{"a":{"$lt":3}}]}`,
+		testJSON(t, chunkMatch(testRaw(bson.D{{"a", 1}, {"b", 1}}), compound)))
+
+	// hashed fields can only be compared by their hash
+	hashed := chunkRange{min: testRaw(bson.D{{"_id", int64(0)}}), max: testRaw(bson.D{{"_id", primitive.MaxKey{}}})}
+	assert.Equal(t, "$expr", chunkMatch(testRaw(bson.D{{"_id", "hashed"}}), hashed)[0].Key)
+}
+
+func TestTimeWindows(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	windows := timeWindows(start, start.Add(100*time.Second), 4)
+	if assert.Len(t, windows, 4) {
+		for i, each := range windows {
+			from := start.Add(time.Duration(i) * 25 * time.Second)
+			assert.Equal(t, "time:"+from.Format(time.RFC3339), each.name)
+			bounds := each.filter[0].Value.(bson.D)
+			assert.Equal(t, timeObjectID(from), bounds[0].Value)
+			// each window ends where the next starts, the last one is open ended
+			if i < len(windows)-1 {
+				assert.Equal(t, bson.E{"$lt", timeObjectID(from.Add(25 * time.Second))}, bounds[1])
+			} else {
+				assert.Len(t, bounds, 1)
+			}
+		}
+	}
+
+	// every ObjectId of a window's first second is within it
+	first := primitive.NewObjectIDFromTimestamp(start.Add(25 * time.Second))
+	bound := windows[1].filter[0].Value.(bson.D)[0].Value.(primitive.ObjectID)
+	assert.GreaterOrEqual(t, bytes.Compare(first[:], bound[:]), 0)
+
+	// windows are at least a second long
+	assert.Len(t, timeWindows(start, start.Add(2*time.Second), 10), 3)
+	// a single ObjectId time is a single open ended window
+	windows = timeWindows(start, start, 10)
+	if assert.Len(t, windows, 1) {
+		assert.Len(t, windows[0].filter[0].Value.(bson.D), 1)
+	}
+}
+
+func TestValueStrata(t *testing.T) {
+	values := bson.A{}
+	for i := 0; i < MAX_STRATA+1; i++ {
+		values = append(values, fmt.Sprintf("v%d", i))
+	}
+	assert.Len(t, valueStrata("tenant", values[:MAX_STRATA]), MAX_STRATA)
+
+	strata := valueStrata("tenant", values)
+	if assert.Len(t, strata, MAX_STRATA+1) {
+		assert.Equal(t, "tenant=v0", strata[0].name)
+		assert.Equal(t, bson.D{{"tenant", bson.D{{"$eq", "v0"}}}}, strata[0].filter)
+		// the least common value is left to the other stratum with every value not returned
+		other := strata[MAX_STRATA]
+		assert.Equal(t, "tenant=(other)", other.name)
+		assert.Equal(t, values[:MAX_STRATA], other.filter[0].Value.(bson.D)[0].Value)
+	}
+}
+
+func TestFieldValues(t *testing.T) {
+	values, err := fieldValues("tenant", testRaw(bson.D{
+		{"values", bson.A{bson.D{{"_id", "acme"}, {"n", 10}, {"arrays", 0}}, bson.D{{"_id", nil}, {"n", 2}, {"arrays", 0}}}},
+		{"arrays", bson.A{}},
+	}))
+	assert.Nil(t, err)
+	if assert.Len(t, values, 2) {
+		assert.Equal(t, "acme", values[0].(bson.RawValue).StringValue())
+		// documents missing the field are in the null stratum
+		assert.Equal(t, bson.TypeNull, values[1].(bson.RawValue).Type)
+	}
+
+	// an array among the least common values still rejects the field
+	_, err = fieldValues("tags", testRaw(bson.D{
+		{"values", bson.A{bson.D{{"_id", "a"}, {"n", 10}, {"arrays", 0}}}},
+		{"arrays", bson.A{bson.D{{"_id", bson.A{"a", "b"}}, {"n", 1}, {"arrays", 1}}}},
+	}))
+	assert.ErrorContains(t, err, "tags holds arrays")
+}
+
+func TestStratumShare(t *testing.T) {
+	assert.Equal(t, int64(250), stratumShare(1000, 25, 100))
+	// every non empty stratum samples at least one document
+	assert.Equal(t, int64(1), stratumShare(10, 1, 1000))
+	assert.Equal(t, int64(0), stratumShare(1000, 0, 100))
+	assert.Equal(t, int64(0), stratumShare(1000, 10, 0))
+}
@@ -5,6 +5,7 @@ package doc
 
 import (
 	"fmt"
+	"strconv"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/bsontype"
@@ -14,26 +15,76 @@ type MismatchDetails struct {
 	MissingFieldOnSrc   []string
 	MissingFieldOnDst   []string
 	FieldContentsDiffer []string
+	// every differing leaf, keyed by its full dotted path (array elements use their index)
+	Diffs []FieldDiff
+}
+
+// reports whether the documents only differ in ways the options tolerate, e.x: a widened numeric type
+func (d *MismatchDetails) Equivalent() bool {
+	return len(d.MissingFieldOnSrc) == 0 && len(d.MissingFieldOnDst) == 0 && len(d.FieldContentsDiffer) == 0
+}
+
+// What makes a path differ, anything but VALUE_DIFFERS is a lower severity difference the documents are still equivalent under
+type DiffKind string
+
+const (
+	VALUE_DIFFERS DiffKind = ""
+	// numerically equal values of different numeric types, only reported with CompareOptions.NumericEquivalence
+	TYPE_DIFFERS DiffKind = "typeDiffers"
+	// an array with the same elements in a different order, only reported for CompareOptions.UnorderedArrays
+	ORDER_DIFFERS DiffKind = "orderDiffers"
+)
+
+// A single differing path between two documents. A value with a zero Type is missing on that side
+type FieldDiff struct {
+	Path string
+	Src  bson.RawValue
+	Dst  bson.RawValue
+	Kind DiffKind
 }
 
 // Compares two bson documents, ignoring order in the document and subdocuments, and returns the details
-// for the top level field only.  Returns nil if the documents match
-// stopOnMismatch: true if comparison should stop with the first mismatched field
+// for the top level field, plus the full dotted path of every differing leaf.  Returns nil if the documents match
 func BsonUnorderedCompareRawDocumentWithDetails(srcRaw, dstRaw bson.Raw) (*MismatchDetails, error) {
+	return compareRawDocumentWithDetails(srcRaw, dstRaw, CompareOptions{})
+}
+
+// Returns nil if the documents match. Documents that only differ in ways the options tolerate return details that
+// are Equivalent, with only lower severity Diffs
+func compareRawDocumentWithDetails(srcRaw, dstRaw bson.Raw, opts CompareOptions) (*MismatchDetails, error) {
 	srcElements, dstElements, err := parseDocuments(srcRaw, dstRaw)
 	if err != nil {
 		return nil, err
 	}
-	return bsonUnorderedCompareRawElements(srcElements, dstElements, false /* stopOnMismatch */)
+	details, tolerated, err := bsonUnorderedCompareRawElements("", srcElements, dstElements, false /* stopOnMismatch */, opts)
+	if err != nil {
+		return nil, err
+	}
+	if details == nil && !tolerated {
+		return nil, nil
+	}
+	if details == nil {
+		details = &MismatchDetails{}
+	}
+	details.Diffs, err = diffRawElements("", srcElements, dstElements, opts)
+	if err != nil {
+		return nil, err
+	}
+	return details, nil
 }
 
 // Compares two bson documents, returns true if they match.  No details provided.
 func BsonUnorderedCompareRawDocument(srcRaw, dstRaw bson.Raw) (bool, error) {
+	return compareRawDocument(srcRaw, dstRaw, CompareOptions{})
+}
+
+// returns true if the documents match or only differ in ways the options tolerate
+func compareRawDocument(srcRaw, dstRaw bson.Raw, opts CompareOptions) (bool, error) {
 	srcElements, dstElements, err := parseDocuments(srcRaw, dstRaw)
 	if err != nil {
 		return false, err
 	}
-	result, err := bsonUnorderedCompareRawElements(srcElements, dstElements, true /* stopOnMismatch */)
+	result, _, err := bsonUnorderedCompareRawElements("", srcElements, dstElements, true /* stopOnMismatch */, opts)
 	return result == nil, err
 }
 
@@ -52,11 +103,13 @@ func parseDocuments(srcRaw, dstRaw bson.Raw) (srcElements, dstElements []bson.Ra
 	return
 }
 
-// Compares two sets of bson elements, ignoring order.
-// Returns all mismatches if stopOnMismatch is false, only the first if it is true.
-func bsonUnorderedCompareRawElements(srcElements, dstElements []bson.RawElement, stopOnMismatch bool) (*MismatchDetails, error) {
+// Compares two sets of bson elements found at path, ignoring order.
+// Returns all mismatches if stopOnMismatch is false, only the first if it is true, and whether any
+// difference was tolerated by the options.
+func bsonUnorderedCompareRawElements(path string, srcElements, dstElements []bson.RawElement, stopOnMismatch bool, opts CompareOptions) (*MismatchDetails, bool, error) {
 	var mismatchDetails MismatchDetails
 	anyMismatch := false
+	anyTolerated := false
 	srcMap := map[string]bson.RawValue{}
 	srcMapUsed := map[string]bool{}
 	for _, v := range srcElements {
@@ -72,17 +125,18 @@ func bsonUnorderedCompareRawElements(srcElements, dstElements []bson.RawElement,
 			anyMismatch = true
 		} else {
 			srcMapUsed[key] = true
-			result, err := bsonUnorderedCompareRawValue(srcValue, dstValue)
+			result, tolerated, err := bsonUnorderedCompareRawValue(joinPath(path, key), srcValue, dstValue, opts)
 			if err != nil {
-				return nil, err
+				return nil, false, err
 			}
+			anyTolerated = anyTolerated || tolerated
 			if !result {
 				mismatchDetails.FieldContentsDiffer = append(mismatchDetails.FieldContentsDiffer, key)
 				anyMismatch = true
 			}
 		}
 		if stopOnMismatch && anyMismatch {
-			return &mismatchDetails, nil
+			return &mismatchDetails, anyTolerated, nil
 		}
 	}
 
@@ -94,53 +148,306 @@ func bsonUnorderedCompareRawElements(srcElements, dstElements []bson.RawElement,
 				mismatchDetails.MissingFieldOnDst = append(mismatchDetails.MissingFieldOnDst, key)
 				anyMismatch = true
 				if stopOnMismatch {
-					return &mismatchDetails, nil
+					return &mismatchDetails, anyTolerated, nil
 				}
 			}
 		}
 	}
 	if anyMismatch {
-		return &mismatchDetails, nil
+		return &mismatchDetails, anyTolerated, nil
 	}
-	return nil, nil
+	return nil, anyTolerated, nil
 }
 
-// Returns true if the values match, ignoring order in any subdocuments.
-func bsonUnorderedCompareRawValue(srcValue, dstValue bson.RawValue) (bool, error) {
+// Returns true if the values at path match, ignoring order in any subdocuments, and whether a difference was tolerated by the options.
+func bsonUnorderedCompareRawValue(path string, srcValue, dstValue bson.RawValue, opts CompareOptions) (bool, bool, error) {
+	if opts.NumericEquivalence && isNumeric(srcValue) && isNumeric(dstValue) {
+		equal := numericEqual(srcValue, dstValue, opts.Epsilon)
+		return equal, equal && srcValue.Type != dstValue.Type, nil
+	}
 	if srcValue.Type != dstValue.Type {
-		return false, nil
+		return false, false, nil
 	}
 
 	switch srcValue.Type {
 	case bsontype.Array:
-		return bsonUnorderedCompareRawArray(srcValue.Array(), dstValue.Array())
+		if opts.unorderedArray(path) {
+			matches, _, orderDiffers, tolerated, err := matchRawArrays(path, srcValue.Array(), dstValue.Array(), opts)
+			return matches, orderDiffers || tolerated, err
+		}
+		return bsonUnorderedCompareRawArray(path, srcValue.Array(), dstValue.Array(), opts)
 	case bsontype.EmbeddedDocument:
-		return BsonUnorderedCompareRawDocument(srcValue.Document(), dstValue.Document())
+		srcElements, dstElements, err := parseDocuments(srcValue.Document(), dstValue.Document())
+		if err != nil {
+			return false, false, err
+		}
+		result, tolerated, err := bsonUnorderedCompareRawElements(path, srcElements, dstElements, true /* stopOnMismatch */, opts)
+		return result == nil, tolerated, err
 	default:
-		return srcValue.Equal(dstValue), nil
+		return srcValue.Equal(dstValue), false, nil
 	}
 }
 
 // Compares two bson arrays, comparing subdocuments ignoring order.  The array order is still significant.
-// Returns true if the arrays match.
-func bsonUnorderedCompareRawArray(srcRaw, dstRaw bson.Raw) (bool, error) {
+// Returns true if the arrays match, and whether a difference was tolerated by the options.
+func bsonUnorderedCompareRawArray(path string, srcRaw, dstRaw bson.Raw, opts CompareOptions) (bool, bool, error) {
 
 	srcElements, dstElements, err := parseDocuments(srcRaw, dstRaw)
 	if err != nil {
-		return false, err
+		return false, false, err
 	}
 	if len(srcElements) != len(dstElements) {
-		return false, nil
+		return false, false, nil
 	}
+	anyTolerated := false
 	for i, srcElement := range srcElements {
 		dstElement := dstElements[i]
 		if srcElement.Key() != dstElement.Key() {
-			return false, fmt.Errorf("Array keys differ: %s %s", srcElement.Key(), dstElement.Key())
+			return false, false, fmt.Errorf("Array keys differ: %s %s", srcElement.Key(), dstElement.Key())
 		}
-		matches, err := bsonUnorderedCompareRawValue(srcElement.Value(), dstElement.Value())
+		matches, tolerated, err := bsonUnorderedCompareRawValue(joinPath(path, srcElement.Key()), srcElement.Value(), dstElement.Value(), opts)
 		if err != nil || !matches {
-			return false, err
+			return false, false, err
+		}
+		anyTolerated = anyTolerated || tolerated
+	}
+	return true, anyTolerated, nil
+}
+
+// Compares two arrays as multisets, pairing each source element with a distinct equal destination element, trying the
+// same index first. Under tolerances equality is not transitive (with an epsilon of 0.1, 1.0 equals 1.1 which equals
+// 1.2), so a pairing taken first may be undone for one pairing every element when there is one. Returns whether every
+// element was paired, the destination index paired with each source element (-1 when unpaired), whether the pairing
+// reorders the array and whether any paired elements only match under the options' tolerances
+func matchRawArrays(path string, srcRaw, dstRaw bson.Raw, opts CompareOptions) (bool, []int, bool, bool, error) {
+	srcValues, err := srcRaw.Values()
+	if err != nil {
+		return false, nil, false, false, fmt.Errorf("Error parsing source array for compare: %s", err)
+	}
+	dstValues, err := dstRaw.Values()
+	if err != nil {
+		return false, nil, false, false, fmt.Errorf("Error parsing dest array for compare: %s", err)
+	}
+
+	// comparisons are memoized since augmenting paths revisit them, 0 when not compared yet
+	const (
+		unequal = iota + 1
+		equal
+		tolerated
+	)
+	compared := make([][]int8, len(srcValues))
+	var compareErr error
+	pairable := func(i, j int) bool {
+		if compared[i] == nil {
+			compared[i] = make([]int8, len(dstValues))
+		}
+		if compared[i][j] == 0 {
+			matches, tolerance, err := bsonUnorderedCompareRawValue(joinPath(path, strconv.Itoa(i)), srcValues[i], dstValues[j], opts)
+			switch {
+			case err != nil:
+				compareErr = err
+				compared[i][j] = unequal
+			case !matches:
+				compared[i][j] = unequal
+			case tolerance:
+				compared[i][j] = tolerated
+			default:
+				compared[i][j] = equal
+			}
+		}
+		return compared[i][j] != unequal
+	}
+
+	pairs := make([]int, len(srcValues))
+	// the source index paired with each destination element, -1 when unused
+	owners := make([]int, len(dstValues))
+	for j := range owners {
+		owners[j] = -1
+	}
+	// pairs source element i with an unused destination element, or one whose owner can be paired with another
+	var augment func(i int, visited []bool) bool
+	augment = func(i int, visited []bool) bool {
+		candidates := make([]int, 0, len(dstValues))
+		if i < len(dstValues) {
+			candidates = append(candidates, i)
 		}
+		for j := range dstValues {
+			if j != i {
+				candidates = append(candidates, j)
+			}
+		}
+		for _, j := range candidates {
+			if visited[j] || !pairable(i, j) {
+				continue
+			}
+			visited[j] = true
+			if owners[j] == -1 || augment(owners[j], visited) {
+				pairs[i], owners[j] = j, i
+				return true
+			}
+		}
+		return false
+	}
+
+	matches := len(srcValues) == len(dstValues)
+	for i := range srcValues {
+		pairs[i] = -1
+		if !augment(i, make([]bool, len(dstValues))) {
+			matches = false
+		}
+		if compareErr != nil {
+			return false, nil, false, false, compareErr
+		}
+	}
+	orderDiffers, anyTolerated := false, false
+	for i, j := range pairs {
+		if j == -1 {
+			continue
+		}
+		orderDiffers = orderDiffers || j != i
+		anyTolerated = anyTolerated || compared[i][j] == tolerated
+	}
+	return matches, pairs, orderDiffers, anyTolerated, nil
+}
+
+// Walks two sets of bson elements, ignoring order, and returns every differing leaf prefixed by path.
+// Source keys are visited first in source order, then keys only present on the destination
+func diffRawElements(path string, srcElements, dstElements []bson.RawElement, opts CompareOptions) ([]FieldDiff, error) {
+	var diffs []FieldDiff
+	dstMap := map[string]bson.RawValue{}
+	for _, v := range dstElements {
+		dstMap[v.Key()] = v.Value()
+	}
+
+	srcUsed := map[string]bool{}
+	for _, srcElement := range srcElements {
+		key := srcElement.Key()
+		srcUsed[key] = true
+		dstValue, ok := dstMap[key]
+		if !ok {
+			diffs = append(diffs, FieldDiff{Path: joinPath(path, key), Src: srcElement.Value()})
+			continue
+		}
+		sub, err := diffRawValues(joinPath(path, key), srcElement.Value(), dstValue, opts)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, sub...)
+	}
+	for _, dstElement := range dstElements {
+		if !srcUsed[dstElement.Key()] {
+			diffs = append(diffs, FieldDiff{Path: joinPath(path, dstElement.Key()), Dst: dstElement.Value()})
+		}
+	}
+	return diffs, nil
+}
+
+// Returns the differing leaves between two values, recursing into subdocuments and arrays of the same type
+func diffRawValues(path string, srcValue, dstValue bson.RawValue, opts CompareOptions) ([]FieldDiff, error) {
+	if opts.NumericEquivalence && isNumeric(srcValue) && isNumeric(dstValue) {
+		switch {
+		case !numericEqual(srcValue, dstValue, opts.Epsilon):
+			return []FieldDiff{{Path: path, Src: srcValue, Dst: dstValue}}, nil
+		case srcValue.Type != dstValue.Type:
+			return []FieldDiff{{Path: path, Src: srcValue, Dst: dstValue, Kind: TYPE_DIFFERS}}, nil
+		default:
+			return nil, nil
+		}
+	}
+	if srcValue.Type != dstValue.Type {
+		return []FieldDiff{{Path: path, Src: srcValue, Dst: dstValue}}, nil
+	}
+
+	switch srcValue.Type {
+	case bsontype.Array:
+		if opts.unorderedArray(path) {
+			return diffUnorderedRawArray(path, srcValue, dstValue, opts)
+		}
+		return diffRawArray(path, srcValue.Array(), dstValue.Array(), opts)
+	case bsontype.EmbeddedDocument:
+		srcElements, dstElements, err := parseDocuments(srcValue.Document(), dstValue.Document())
+		if err != nil {
+			return nil, err
+		}
+		return diffRawElements(path, srcElements, dstElements, opts)
+	default:
+		if srcValue.Equal(dstValue) {
+			return nil, nil
+		}
+		return []FieldDiff{{Path: path, Src: srcValue, Dst: dstValue}}, nil
+	}
+}
+
+// Compares two arrays index by index, elements past the end of the shorter array are reported as missing
+func diffRawArray(path string, srcRaw, dstRaw bson.Raw, opts CompareOptions) ([]FieldDiff, error) {
+	srcValues, err := srcRaw.Values()
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing source array for compare: %s", err)
+	}
+	dstValues, err := dstRaw.Values()
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing dest array for compare: %s", err)
+	}
+
+	var diffs []FieldDiff
+	for i := 0; i < len(srcValues) || i < len(dstValues); i++ {
+		elemPath := joinPath(path, strconv.Itoa(i))
+		switch {
+		case i >= len(dstValues):
+			diffs = append(diffs, FieldDiff{Path: elemPath, Src: srcValues[i]})
+		case i >= len(srcValues):
+			diffs = append(diffs, FieldDiff{Path: elemPath, Dst: dstValues[i]})
+		default:
+			sub, err := diffRawValues(elemPath, srcValues[i], dstValues[i], opts)
+			if err != nil {
+				return nil, err
+			}
+			diffs = append(diffs, sub...)
+		}
+	}
+	return diffs, nil
+}
+
+// Diffs two arrays compared as multisets. Unpaired elements are reported as missing on the other side under their own
+// index, arrays that only differ by order are reported once as ORDER_DIFFERS
+func diffUnorderedRawArray(path string, srcValue, dstValue bson.RawValue, opts CompareOptions) ([]FieldDiff, error) {
+	matches, pairs, orderDiffers, _, err := matchRawArrays(path, srcValue.Array(), dstValue.Array(), opts)
+	if err != nil {
+		return nil, err
+	}
+	srcValues, _ := srcValue.Array().Values()
+	dstValues, _ := dstValue.Array().Values()
+
+	var diffs []FieldDiff
+	if matches && orderDiffers {
+		diffs = append(diffs, FieldDiff{Path: path, Src: srcValue, Dst: dstValue, Kind: ORDER_DIFFERS})
+	}
+	used := make([]bool, len(dstValues))
+	for i, j := range pairs {
+		elemPath := joinPath(path, strconv.Itoa(i))
+		if j == -1 {
+			diffs = append(diffs, FieldDiff{Path: elemPath, Src: srcValues[i]})
+			continue
+		}
+		used[j] = true
+		// paired elements can still differ in tolerated ways
+		sub, err := diffRawValues(elemPath, srcValues[i], dstValues[j], opts)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, sub...)
+	}
+	for j, each := range dstValues {
+		if !used[j] {
+			diffs = append(diffs, FieldDiff{Path: joinPath(path, strconv.Itoa(j)), Dst: each})
+		}
+	}
+	return diffs, nil
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
 	}
-	return true, nil
+	return path + "." + key
 }
@@ -7,11 +7,14 @@ package doc
 // a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
 
 import (
+	"math"
 	"testing"
 
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 func compareDocuments(srcDoc, dstDoc bson.D) (*MismatchDetails, error) {
@@ -237,3 +240,229 @@ func TestBSONUnorderedCompareArrays(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Nil(t, result)
 }
+
+func TestBSONUnorderedCompareDiffs(t *testing.T) {
+	srcDoc := bson.D{
+		{"_id", "a"},
+		{"a", 1},
+		{"b", bson.D{{"c", 1}, {"d", bson.D{{"e", "x"}}}}},
+		{"arr", bson.A{1, bson.D{{"f", 2}}, 3}},
+		{"g", 1}}
+	dstDoc := bson.D{
+		{"_id", "a"},
+		{"a", int64(1)},
+		{"b", bson.D{{"d", bson.D{{"e", "y"}}}, {"c", 1}}},
+		{"arr", bson.A{1, bson.D{{"f", 3}}}},
+		{"h", 1}}
+	result, err := compareDocuments(srcDoc, dstDoc)
+	assert.Nil(t, err)
+	if assert.NotNil(t, result) {
+		assert.ElementsMatch(t, result.FieldContentsDiffer, []string{"a", "b", "arr"})
+		paths := []string{}
+		for _, each := range result.Diffs {
+			paths = append(paths, each.Path)
+		}
+		assert.Equal(t, []string{"a", "b.d.e", "arr.1.f", "arr.2", "g", "h"}, paths)
+
+		assert.Equal(t, bsontype.Int32, result.Diffs[0].Src.Type)
+		assert.Equal(t, bsontype.Int64, result.Diffs[0].Dst.Type)
+		assert.Equal(t, "x", result.Diffs[1].Src.StringValue())
+		assert.Equal(t, "y", result.Diffs[1].Dst.StringValue())
+		// elements past the end of the target array and fields only on one side have no value on the other
+		assert.Equal(t, bsontype.Type(0), result.Diffs[3].Dst.Type)
+		assert.Equal(t, bsontype.Type(0), result.Diffs[4].Dst.Type)
+		assert.Equal(t, bsontype.Type(0), result.Diffs[5].Src.Type)
+	}
+
+	// matching documents have no diffs to report
+	result, err = compareDocuments(srcDoc, srcDoc)
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+}
+
+func TestBSONUnorderedCompareOptions(t *testing.T) {
+	srcDoc := bson.D{
+		{"_id", "a"},
+		{"a", 1},
+		{"meta", bson.D{{"by", "x"}, {"at", 1}}},
+		{"items", bson.A{bson.D{{"sku", 1}, {"seen", 1}}, bson.D{{"sku", 2}, {"seen", 2}}}}}
+	dstDoc := bson.D{
+		{"_id", "a"},
+		{"a", 1},
+		{"meta", bson.D{{"by", "y"}, {"at", 1}}},
+		{"items", bson.A{bson.D{{"sku", 1}, {"seen", 3}}, bson.D{{"sku", 2}, {"seen", 4}}}},
+		{"_migratedAt", 5}}
+	compare := func(opts CompareOptions) *MismatchDetails {
+		src, _ := bson.Marshal(srcDoc)
+		dst, _ := bson.Marshal(dstDoc)
+		result, err := BsonUnorderedCompareRawDocumentWithOptions(src, dst, opts)
+		assert.Nil(t, err)
+		return result
+	}
+
+	// ignored paths continue into array elements, with or without naming them
+	assert.Nil(t, compare(CompareOptions{Ignore: []string{"_migratedAt", "meta.by", "items.seen"}}))
+	assert.Nil(t, compare(CompareOptions{Ignore: []string{"_migratedAt", "meta.*", "items.*.seen"}}))
+	result := compare(CompareOptions{Ignore: []string{"_migratedAt", "items.0.seen"}})
+	if assert.NotNil(t, result) {
+		assert.ElementsMatch(t, result.FieldContentsDiffer, []string{"meta", "items"})
+		assert.Empty(t, result.MissingFieldOnSrc)
+	}
+
+	// only compares the listed paths, fields outside them are not reported as missing
+	assert.Nil(t, compare(CompareOptions{Only: []string{"a", "items.sku", "meta.at"}}))
+	result = compare(CompareOptions{Only: []string{"a", "meta"}})
+	if assert.NotNil(t, result) {
+		assert.ElementsMatch(t, result.FieldContentsDiffer, []string{"meta"})
+		assert.Empty(t, result.MissingFieldOnSrc)
+	}
+}
+
+func TestBSONUnorderedCompareNumericEquivalence(t *testing.T) {
+	decimal, _ := primitive.ParseDecimal128("5.0")
+	sum := 0.1
+	sum += 0.2
+	srcDoc := bson.D{{"_id", 1}, {"a", int32(5)}, {"b", bson.A{int64(7)}}, {"c", sum}, {"d", 5}}
+	dstDoc := bson.D{{"_id", 1}, {"a", int64(5)}, {"b", bson.A{7.0}}, {"c", 0.3}, {"d", decimal}}
+	compare := func(opts CompareOptions) *MismatchDetails {
+		src, _ := bson.Marshal(srcDoc)
+		dst, _ := bson.Marshal(dstDoc)
+		result, err := BsonUnorderedCompareRawDocumentWithOptions(src, dst, opts)
+		assert.Nil(t, err)
+		return result
+	}
+
+	result := compare(CompareOptions{})
+	if assert.NotNil(t, result) {
+		assert.ElementsMatch(t, result.FieldContentsDiffer, []string{"a", "b", "c", "d"})
+		assert.False(t, result.Equivalent())
+	}
+
+	// without an epsilon 0.1 + 0.2 is not 0.3
+	result = compare(CompareOptions{NumericEquivalence: true})
+	if assert.NotNil(t, result) {
+		assert.Equal(t, result.FieldContentsDiffer, []string{"c"})
+	}
+
+	// equivalent documents still report every type change
+	result = compare(CompareOptions{NumericEquivalence: true, Epsilon: 1e-9})
+	if assert.NotNil(t, result) {
+		assert.True(t, result.Equivalent())
+		paths := []string{}
+		for _, each := range result.Diffs {
+			assert.Equal(t, TYPE_DIFFERS, each.Kind)
+			paths = append(paths, each.Path)
+		}
+		assert.Equal(t, []string{"a", "b.0", "d"}, paths)
+	}
+}
+
+func TestBSONUnorderedCompareNumericEquivalenceSpecialValues(t *testing.T) {
+	decimalNaN, _ := primitive.ParseDecimal128("NaN")
+	decimalInf, _ := primitive.ParseDecimal128("Infinity")
+	compare := func(srcDoc, dstDoc bson.D) *MismatchDetails {
+		src, _ := bson.Marshal(srcDoc)
+		dst, _ := bson.Marshal(dstDoc)
+		result, err := BsonUnorderedCompareRawDocumentWithOptions(src, dst, CompareOptions{NumericEquivalence: true, Epsilon: 1e-9})
+		assert.Nil(t, err)
+		return result
+	}
+
+	// identical infinities and NaNs match with an epsilon, without panicking on the difference of infinities
+	assert.Nil(t, compare(
+		bson.D{{"_id", 1}, {"a", math.Inf(1)}, {"b", math.Inf(-1)}, {"c", math.NaN()}, {"d", decimalNaN}, {"e", decimalInf}},
+		bson.D{{"_id", 1}, {"a", math.Inf(1)}, {"b", math.Inf(-1)}, {"c", math.NaN()}, {"d", decimalNaN}, {"e", decimalInf}}))
+
+	// NaN and infinity of another numeric type are only a type change
+	result := compare(bson.D{{"_id", 1}, {"a", math.NaN()}, {"b", math.Inf(1)}}, bson.D{{"_id", 1}, {"a", decimalNaN}, {"b", decimalInf}})
+	if assert.NotNil(t, result) {
+		assert.True(t, result.Equivalent())
+	}
+
+	result = compare(bson.D{{"_id", 1}, {"a", math.Inf(1)}, {"b", math.NaN()}}, bson.D{{"_id", 1}, {"a", math.Inf(-1)}, {"b", 1.0}})
+	if assert.NotNil(t, result) {
+		assert.ElementsMatch(t, []string{"a", "b"}, result.FieldContentsDiffer)
+	}
+}
+
+func TestBSONUnorderedCompareUnorderedArrays(t *testing.T) {
+	srcDoc := bson.D{
+		{"_id", 1},
+		{"tags", bson.A{"a", "b", "b"}},
+		{"items", bson.A{bson.D{{"roles", bson.A{bson.D{{"x", 1}, {"y", 2}}, "r"}}}}},
+		{"list", bson.A{1, 2}}}
+	dstDoc := bson.D{
+		{"_id", 1},
+		{"tags", bson.A{"b", "a", "b"}},
+		{"items", bson.A{bson.D{{"roles", bson.A{"r", bson.D{{"y", 2}, {"x", 1}}}}}}},
+		{"list", bson.A{2, 1}}}
+	compare := func(opts CompareOptions) *MismatchDetails {
+		src, _ := bson.Marshal(srcDoc)
+		dst, _ := bson.Marshal(dstDoc)
+		result, err := BsonUnorderedCompareRawDocumentWithOptions(src, dst, opts)
+		assert.Nil(t, err)
+		return result
+	}
+
+	result := compare(CompareOptions{})
+	if assert.NotNil(t, result) {
+		assert.ElementsMatch(t, result.FieldContentsDiffer, []string{"tags", "items", "list"})
+	}
+
+	// arrays that only differ by order are equivalent, reporting the order change once per array
+	result = compare(CompareOptions{UnorderedArrays: []string{"tags", "items.roles"}})
+	if assert.NotNil(t, result) {
+		assert.Equal(t, []string{"list"}, result.FieldContentsDiffer)
+	}
+	result = compare(CompareOptions{UnorderedArrays: []string{"tags", "items.roles", "list"}})
+	if assert.NotNil(t, result) {
+		assert.True(t, result.Equivalent())
+		paths := []string{}
+		for _, each := range result.Diffs {
+			assert.Equal(t, ORDER_DIFFERS, each.Kind)
+			paths = append(paths, each.Path)
+		}
+		assert.Equal(t, []string{"tags", "items.0.roles", "list"}, paths)
+	}
+
+	// multiplicity still matters, unpaired elements are missing on the other side
+	dstDoc[1] = bson.E{"tags", bson.A{"b", "a", "c"}}
+	result = compare(CompareOptions{UnorderedArrays: []string{"*", "items.roles"}})
+	if assert.NotNil(t, result) {
+		assert.Equal(t, []string{"tags"}, result.FieldContentsDiffer)
+		assert.Equal(t, FieldDiff{Path: "tags.2", Src: result.Diffs[0].Src}, result.Diffs[0])
+		assert.Equal(t, "c", result.Diffs[1].Dst.StringValue())
+	}
+}
+
+func TestCompareOptionsProjection(t *testing.T) {
+	assert.Nil(t, CompareOptions{}.Projection("region"))
+	assert.Equal(t, bson.D{{"_migratedAt", 0}, {"meta.by", 0}},
+		CompareOptions{Ignore: []string{"meta.by", "items.*.seen", "_migratedAt", "region.x"}}.Projection("region"))
+	assert.Equal(t, bson.D{{"a", 1}, {"items", 1}, {"region", 1}},
+		CompareOptions{Only: []string{"items.0.sku", "a", "items.price"}}.Projection("region"))
+	assert.Nil(t, CompareOptions{Only: []string{"*.sku"}}.Projection())
+}
+
+func TestBSONUnorderedCompareUnorderedArraysWithinEpsilon(t *testing.T) {
+	compare := func(src, dst bson.A) *MismatchDetails {
+		srcRaw, _ := bson.Marshal(bson.D{{"_id", 1}, {"list", src}})
+		dstRaw, _ := bson.Marshal(bson.D{{"_id", 1}, {"list", dst}})
+		result, err := BsonUnorderedCompareRawDocumentWithOptions(srcRaw, dstRaw,
+			CompareOptions{NumericEquivalence: true, Epsilon: 0.15, UnorderedArrays: []string{"list"}})
+		assert.Nil(t, err)
+		return result
+	}
+
+	// taking the first equal element pairs 1.1 with 1.1 and leaves 1.0 with 1.2, pairing 1.1 with 1.2 matches them all
+	result := compare(bson.A{1.1, 1.0}, bson.A{1.1, 1.2})
+	if assert.NotNil(t, result) {
+		assert.True(t, result.Equivalent())
+	}
+	assert.Nil(t, compare(bson.A{1.1, 1.2}, bson.A{1.1, 1.2}))
+
+	result = compare(bson.A{1.1, 1.0}, bson.A{1.3, 1.2})
+	if assert.NotNil(t, result) {
+		assert.Equal(t, []string{"list"}, result.FieldContentsDiffer)
+	}
+}
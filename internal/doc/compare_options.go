@@ -0,0 +1,281 @@
+package doc
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// matches any single field name or array index in a path
+const PATH_WILDCARD = "*"
+
+// Options of a document comparison, the zero value compares every field. Paths are dotted field names where
+// PATH_WILDCARD matches any single field or array index, a numeric segment matches that array index, and a path
+// continues into the documents of an array without naming the index (e.x: items.price matches items.3.price)
+type CompareOptions struct {
+	// paths whose values are not compared
+	Ignore []string
+	// when set only these paths (and everything under them) are compared, _id is always compared
+	Only []string
+	// treats numerically equal int32, int64, double and decimal128 values as equal, reporting a differing type as TYPE_DIFFERS
+	NumericEquivalence bool
+	// largest difference tolerated between numbers when either is a double, only used with NumericEquivalence
+	Epsilon float64
+	// paths of arrays compared as multisets, an array holding the same elements in another order is reported as ORDER_DIFFERS
+	UnorderedArrays []string
+}
+
+func (o CompareOptions) prunes() bool {
+	return len(o.Ignore) > 0 || len(o.Only) > 0
+}
+
+// reports whether the array at path is compared as a multiset
+func (o CompareOptions) unorderedArray(path string) bool {
+	if len(o.UnorderedArrays) == 0 {
+		return false
+	}
+	segments := strings.Split(path, ".")
+	for _, each := range o.UnorderedArrays {
+		if matchPath(strings.Split(each, "."), segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches a concrete path against a pattern, an array index the pattern does not name is skipped like the implicit
+// array traversal of prune
+func matchPath(pattern []string, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if len(path) == 0 {
+		return false
+	}
+	if (pattern[0] == path[0] || pattern[0] == PATH_WILDCARD) && matchPath(pattern[1:], path[1:]) {
+		return true
+	}
+	if _, err := strconv.Atoi(path[0]); err == nil {
+		return matchPath(pattern, path[1:])
+	}
+	return false
+}
+
+// Compares two bson documents like BsonUnorderedCompareRawDocumentWithDetails after removing the fields the options
+// exclude from both. Returns nil if the documents match, documents that only differ in ways the options tolerate
+// return details that are Equivalent
+func BsonUnorderedCompareRawDocumentWithOptions(srcRaw, dstRaw bson.Raw, opts CompareOptions) (*MismatchDetails, error) {
+	if !opts.prunes() {
+		return compareRawDocumentWithDetails(srcRaw, dstRaw, opts)
+	}
+	src, err := opts.prune(srcRaw)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := opts.prune(dstRaw)
+	if err != nil {
+		return nil, err
+	}
+	return compareRawDocumentWithDetails(src, dst, opts)
+}
+
+// A pattern partially matched down to the current field, next is the index of the segment to match next
+type pathState struct {
+	segments []string
+	next     int
+}
+
+func newStates(paths []string) []pathState {
+	states := make([]pathState, 0, len(paths))
+	for _, each := range paths {
+		states = append(states, pathState{segments: strings.Split(each, ".")})
+	}
+	return states
+}
+
+// matches key against every state, returning whether a pattern ended on it and the states continuing under it
+func advance(states []pathState, key string) (bool, []pathState) {
+	full := false
+	var next []pathState
+	for _, each := range states {
+		segment := each.segments[each.next]
+		if segment != key && segment != PATH_WILDCARD {
+			continue
+		}
+		if each.next+1 == len(each.segments) {
+			full = true
+		} else {
+			next = append(next, pathState{segments: each.segments, next: each.next + 1})
+		}
+	}
+	return full, next
+}
+
+// returns a copy of the document without the ignored fields and, when comparing only some fields, without the rest
+func (o CompareOptions) prune(raw bson.Raw) (bson.Raw, error) {
+	only := o.Only
+	if len(only) > 0 {
+		only = append([]string{"_id"}, only...)
+	}
+	pruned, _, err := pruneDocument(raw, newStates(o.Ignore), newStates(only), len(only) > 0)
+	return pruned, err
+}
+
+// prunes a single document, returns whether anything was kept
+func pruneDocument(raw bson.Raw, ignore []pathState, only []pathState, onlyMode bool) (bson.Raw, bool, error) {
+	elements, err := raw.Elements()
+	if err != nil {
+		return nil, false, err
+	}
+	kept := bson.D{}
+	for _, element := range elements {
+		value, keep, err := pruneValue(element.Key(), element.Value(), ignore, only, onlyMode, false)
+		if err != nil {
+			return nil, false, err
+		}
+		if keep {
+			kept = append(kept, bson.E{element.Key(), value})
+		}
+	}
+	pruned, err := bson.Marshal(kept)
+	return pruned, len(kept) > 0, err
+}
+
+// prunes a single array, elements are matched by index as well as continuing the paths of the array itself
+func pruneArray(raw bson.Raw, ignore []pathState, only []pathState, onlyMode bool) (bson.RawValue, bool, error) {
+	values, err := raw.Values()
+	if err != nil {
+		return bson.RawValue{}, false, err
+	}
+	kept := bson.A{}
+	for i, each := range values {
+		value, keep, err := pruneValue(strconv.Itoa(i), each, ignore, only, onlyMode, true)
+		if err != nil {
+			return bson.RawValue{}, false, err
+		}
+		if keep {
+			kept = append(kept, value)
+		}
+	}
+	valueType, array, err := bson.MarshalValue(kept)
+	return bson.RawValue{Type: valueType, Value: array}, len(kept) > 0, err
+}
+
+// returns the pruned value of a field or array element and whether to keep it at all. The documents of an array
+// are also matched against the array's own paths, so a path does not need to name their index
+func pruneValue(key string, value bson.RawValue, ignore []pathState, only []pathState, onlyMode bool, element bool) (bson.RawValue, bool, error) {
+	implicit := element && value.Type == bsontype.EmbeddedDocument
+	ignored, ignoreNext := advance(ignore, key)
+	if ignored {
+		return value, false, nil
+	}
+	if implicit {
+		ignoreNext = append(ignoreNext, ignore...)
+	}
+	onlyNext := only
+	if onlyMode {
+		var included bool
+		included, onlyNext = advance(only, key)
+		if implicit {
+			onlyNext = append(onlyNext, only...)
+		}
+		if included {
+			// everything under an included path is compared
+			onlyMode, onlyNext = false, nil
+		} else if len(onlyNext) == 0 {
+			return value, false, nil
+		}
+	}
+	if len(ignoreNext) == 0 && !onlyMode {
+		return value, true, nil
+	}
+
+	switch value.Type {
+	case bsontype.EmbeddedDocument:
+		pruned, anyKept, err := pruneDocument(value.Document(), ignoreNext, onlyNext, onlyMode)
+		if err != nil {
+			return value, false, err
+		}
+		return bson.RawValue{Type: bsontype.EmbeddedDocument, Value: pruned}, anyKept || !onlyMode, nil
+	case bsontype.Array:
+		pruned, anyKept, err := pruneArray(value.Array(), ignoreNext, onlyNext, onlyMode)
+		return pruned, anyKept || !onlyMode, err
+	default:
+		// a path continuing into a scalar never reaches an included field
+		return value, !onlyMode, nil
+	}
+}
+
+// Returns a server side projection that removes at least the fields the options exclude but never the required
+// fields (e.x: the shard key used to look up documents), or nil when the options cannot be expressed as one.
+// Paths with wildcards or array indexes are projected up to their parent and left to the comparison
+func (o CompareOptions) Projection(required ...string) bson.D {
+	if len(o.Only) > 0 {
+		include := append([]string{}, required...)
+		for _, each := range o.Only {
+			prefix := projectablePrefix(each)
+			if prefix == "" {
+				return nil
+			}
+			include = append(include, prefix)
+		}
+		projection := bson.D{}
+		for _, each := range withoutNested(include) {
+			projection = append(projection, bson.E{each, 1})
+		}
+		return projection
+	}
+
+	exclude := []string{}
+	for _, each := range o.Ignore {
+		// a partially projected exclusion would remove fields that are still compared
+		if projectablePrefix(each) != each || each == "_id" || overlaps(each, required) {
+			continue
+		}
+		exclude = append(exclude, each)
+	}
+	if len(exclude) == 0 {
+		return nil
+	}
+	projection := bson.D{}
+	for _, each := range withoutNested(exclude) {
+		projection = append(projection, bson.E{each, 0})
+	}
+	return projection
+}
+
+// returns the path up to its first wildcard or array index
+func projectablePrefix(path string) string {
+	segments := strings.Split(path, ".")
+	for i, each := range segments {
+		if _, err := strconv.Atoi(each); err == nil || each == PATH_WILDCARD {
+			return strings.Join(segments[:i], ".")
+		}
+	}
+	return path
+}
+
+// reports whether path is a parent or child of any of the others
+func overlaps(path string, others []string) bool {
+	for _, each := range others {
+		if each == path || strings.HasPrefix(each, path+".") || strings.HasPrefix(path, each+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// sorts and removes duplicate paths and paths under another path, which a projection rejects as a collision
+func withoutNested(paths []string) []string {
+	sort.Strings(paths)
+	ret := []string{}
+	for _, each := range paths {
+		if !overlaps(each, ret) {
+			ret = append(ret, each)
+		}
+	}
+	return ret
+}
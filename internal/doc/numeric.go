@@ -0,0 +1,97 @@
+package doc
+
+import (
+	"math"
+	"math/big"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+func isNumeric(value bson.RawValue) bool {
+	switch value.Type {
+	case bsontype.Int32, bsontype.Int64, bsontype.Double, bsontype.Decimal128:
+		return true
+	}
+	return false
+}
+
+// compares two numeric values of any numeric type. Doubles are compared within epsilon, everything else exactly.
+// NaN equals NaN like it does without NumericEquivalence, and infinities only equal an infinity of the same sign
+func numericEqual(srcValue, dstValue bson.RawValue, epsilon float64) bool {
+	if srcValue.Equal(dstValue) {
+		return true
+	}
+	if srcNaN, dstNaN := isNaN(srcValue), isNaN(dstValue); srcNaN || dstNaN {
+		return srcNaN && dstNaN
+	}
+	src, ok := bigFloat(srcValue)
+	if !ok {
+		return false
+	}
+	dst, ok := bigFloat(dstValue)
+	if !ok {
+		return false
+	}
+	// the difference of two infinities of the same sign is undefined
+	if src.IsInf() || dst.IsInf() {
+		return src.Cmp(dst) == 0
+	}
+	if epsilon > 0 && (srcValue.Type == bsontype.Double || dstValue.Type == bsontype.Double) {
+		diff, _ := new(big.Float).Sub(src, dst).Float64()
+		return math.Abs(diff) <= epsilon
+	}
+	return src.Cmp(dst) == 0
+}
+
+func isNaN(value bson.RawValue) bool {
+	switch value.Type {
+	case bsontype.Double:
+		return math.IsNaN(value.Double())
+	case bsontype.Decimal128:
+		return value.Decimal128().IsNaN()
+	}
+	return false
+}
+
+// converts a numeric value exactly, not ok for NaN
+func bigFloat(value bson.RawValue) (*big.Float, bool) {
+	switch value.Type {
+	case bsontype.Int32:
+		return new(big.Float).SetInt64(int64(value.Int32())), true
+	case bsontype.Int64:
+		return new(big.Float).SetInt64(value.Int64()), true
+	case bsontype.Double:
+		double := value.Double()
+		if math.IsNaN(double) {
+			return nil, false
+		}
+		return big.NewFloat(double), true
+	case bsontype.Decimal128:
+		decimal := value.Decimal128()
+		if decimal.IsNaN() {
+			return nil, false
+		}
+		if decimal.IsInf() != 0 {
+			return new(big.Float).SetInf(decimal.IsInf() < 0), true
+		}
+		coefficient, exponent, err := decimal.BigInt()
+		if err != nil {
+			return nil, false
+		}
+		f := new(big.Float).SetPrec(256).SetInt(coefficient)
+		scale := new(big.Float).SetPrec(256).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(exponent))), nil))
+		if exponent < 0 {
+			return f.Quo(f, scale), true
+		}
+		return f.Mul(f, scale), true
+	}
+	return nil, false
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
@@ -10,8 +10,10 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-func Init(verbosity string, filepath string, startTime time.Time) {
+// Sets up the global logger, console output goes to stderr instead of stdout when stdout is reserved for reports
+func Init(verbosity string, filepath string, startTime time.Time, useStderr bool) {
 	zerolog.TimeFieldFormat = time.RFC3339
+	console := zerolog.ConsoleWriter{Out: consoleOut(useStderr)}
 	if filepath != "" {
 		runLogFile, err := os.OpenFile(
 			util.CleanPath(filepath)+"/sampler-"+startTime.Local().Format(time.RFC3339)+".log",
@@ -22,10 +24,10 @@ func Init(verbosity string, filepath string, startTime time.Time) {
 			panic(err)
 		}
 		fileLogger := zerolog.New(runLogFile).With().Logger()
-		writers := io.MultiWriter(zerolog.ConsoleWriter{Out: os.Stdout}, fileLogger)
+		writers := io.MultiWriter(console, fileLogger)
 		log.Logger = log.Output(writers)
 	} else {
-		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
+		log.Logger = log.Output(console)
 	}
 
 	var level zerolog.Level
@@ -45,3 +47,11 @@ func Init(verbosity string, filepath string, startTime time.Time) {
 	}
 	zerolog.SetGlobalLevel(level)
 }
+
+// returns where console logs are written, stderr when stdout is reserved for reports
+func consoleOut(useStderr bool) io.Writer {
+	if useStderr {
+		return os.Stderr
+	}
+	return os.Stdout
+}
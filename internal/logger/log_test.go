@@ -0,0 +1,14 @@
+package logger
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsoleOut(t *testing.T) {
+	assert.Equal(t, os.Stdout, consoleOut(false))
+	// stdout is reserved for the stdout report sink
+	assert.Equal(t, os.Stderr, consoleOut(true))
+}
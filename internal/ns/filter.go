@@ -0,0 +1,188 @@
+package ns
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A single include or exclude pattern. Globs are split into a database and a collection part so they can be pushed
+// down to listDatabases and listCollections, regexes only match the whole namespace
+type pattern struct {
+	raw string
+	// set for regex patterns
+	full *regexp.Regexp
+	// set for globs
+	db   *regexp.Regexp
+	coll *regexp.Regexp
+}
+
+// Selects namespaces by --include and --exclude patterns. A namespace is selected when it matches any include
+// (or there are none) and no exclude. Patterns are either:
+//   - a glob over db.coll where * matches any run of characters and ? a single one (e.x: tenant_*.orders), a
+//     pattern without a collection part selects the whole database (e.x: tenant_* is tenant_*.*)
+//   - a regex over the whole db.coll between slashes (e.x: /^tenant_[0-9]+\.(orders|users)$/)
+type Filter struct {
+	include []pattern
+	exclude []pattern
+}
+
+func NewFilter(include []string, exclude []string) (*Filter, error) {
+	f := &Filter{}
+	for _, each := range include {
+		p, err := parsePattern(each)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, p)
+	}
+	for _, each := range exclude {
+		p, err := parsePattern(each)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, p)
+	}
+	return f, nil
+}
+
+func parsePattern(raw string) (pattern, error) {
+	if len(raw) > 1 && strings.HasPrefix(raw, "/") && strings.HasSuffix(raw, "/") {
+		full, err := regexp.Compile(raw[1 : len(raw)-1])
+		if err != nil {
+			return pattern{}, fmt.Errorf("invalid namespace regex %s: %w", raw, err)
+		}
+		return pattern{raw: raw, full: full}, nil
+	}
+	db, coll, found := strings.Cut(raw, ".")
+	if !found {
+		coll = "*"
+	}
+	if db == "" || coll == "" {
+		return pattern{}, fmt.Errorf("invalid namespace pattern %q, expected <db>[.<coll>] or /<regex>/", raw)
+	}
+	return pattern{
+		raw:  raw,
+		db:   globRegex(db),
+		coll: globRegex(coll),
+	}, nil
+}
+
+// translates a glob into an anchored regex
+func globRegex(glob string) *regexp.Regexp {
+	quoted := regexp.QuoteMeta(glob)
+	quoted = strings.ReplaceAll(quoted, `\*`, ".*")
+	quoted = strings.ReplaceAll(quoted, `\?`, ".")
+	return regexp.MustCompile("^" + quoted + "$")
+}
+
+func (p pattern) isGlob() bool {
+	return p.db != nil
+}
+
+// a glob excluding every collection of a database can exclude the database itself
+func (p pattern) wholeDatabase() bool {
+	return p.isGlob() && p.coll.String() == "^.*$"
+}
+
+func (f *Filter) Empty() bool {
+	return f == nil || (len(f.include) == 0 && len(f.exclude) == 0)
+}
+
+// reports whether the namespace is selected by the patterns
+func (f *Filter) Match(namespace string) bool {
+	if f.Empty() {
+		return true
+	}
+	included := len(f.include) == 0
+	for _, each := range f.include {
+		if each.match(namespace) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, each := range f.exclude {
+		if each.match(namespace) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p pattern) match(namespace string) bool {
+	if p.isGlob() {
+		db, coll, _ := strings.Cut(namespace, ".")
+		return p.db.MatchString(db) && p.coll.MatchString(coll)
+	}
+	return p.full.MatchString(namespace)
+}
+
+// server side listDatabases name conditions. Includes are only pushed down when every include is a glob, since a
+// namespace regex cannot be split into a database part. Excludes are only pushed down for whole databases
+func (f *Filter) databaseConditions() bson.D {
+	conditions := bson.D{}
+	if f.Empty() {
+		return conditions
+	}
+	all := func(p pattern) bool { return true }
+	db := func(p pattern) *regexp.Regexp { return p.db }
+	if in, ok := includeRegexes(f.include, all, db); ok {
+		conditions = append(conditions, bson.E{"$in", in})
+	}
+	if nin := excludeRegexes(f.exclude, pattern.wholeDatabase, db); len(nin) > 0 {
+		conditions = append(conditions, bson.E{"$nin", nin})
+	}
+	return conditions
+}
+
+// server side listCollections name conditions for a database, built from the globs whose database part matches it
+func (f *Filter) collectionConditions(db string) bson.D {
+	conditions := bson.D{}
+	if f.Empty() {
+		return conditions
+	}
+	forDB := func(p pattern) bool { return p.db.MatchString(db) }
+	coll := func(p pattern) *regexp.Regexp { return p.coll }
+	if in, ok := includeRegexes(f.include, forDB, coll); ok {
+		conditions = append(conditions, bson.E{"$in", in})
+	}
+	if nin := excludeRegexes(f.exclude, forDB, coll); len(nin) > 0 {
+		conditions = append(conditions, bson.E{"$nin", nin})
+	}
+	return conditions
+}
+
+// returns the server side regexes of the selected includes, not ok when there are no includes or one of them is a
+// namespace regex since pushing down only some of the includes would drop namespaces the others select
+func includeRegexes(patterns []pattern, selected func(pattern) bool, part func(pattern) *regexp.Regexp) (bson.A, bool) {
+	if len(patterns) == 0 {
+		return nil, false
+	}
+	regexes := bson.A{}
+	for _, each := range patterns {
+		if !each.isGlob() {
+			return nil, false
+		}
+		if selected(each) {
+			regexes = append(regexes, primitive.Regex{Pattern: part(each).String()})
+		}
+	}
+	return regexes, true
+}
+
+// returns the server side regexes of the selected excludes, namespace regexes are only applied client side
+func excludeRegexes(patterns []pattern, selected func(pattern) bool, part func(pattern) *regexp.Regexp) bson.A {
+	regexes := bson.A{}
+	for _, each := range patterns {
+		if each.isGlob() && selected(each) {
+			regexes = append(regexes, primitive.Regex{Pattern: part(each).String()})
+		}
+	}
+	return regexes
+}
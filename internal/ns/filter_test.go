@@ -0,0 +1,193 @@
+package ns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNewFilterInvalidPatterns(t *testing.T) {
+	for _, each := range []string{".orders", "shop.", "/(/"} {
+		_, err := NewFilter([]string{each}, nil)
+		assert.Error(t, err, each)
+		_, err = NewFilter(nil, []string{each})
+		assert.Error(t, err, each)
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		include   []string
+		exclude   []string
+		matches   []string
+		unmatched []string
+	}{
+		{
+			name:    "empty",
+			matches: []string{"shop.orders", "admin.users"},
+		},
+		{
+			name:      "glob",
+			include:   []string{"tenant_*.orders"},
+			matches:   []string{"tenant_1.orders", "tenant_acme.orders"},
+			unmatched: []string{"tenant_1.users", "shop.orders", "tenant_1.orders_old"},
+		},
+		{
+			name:      "single character",
+			include:   []string{"tenant_?.orders"},
+			matches:   []string{"tenant_1.orders"},
+			unmatched: []string{"tenant_12.orders"},
+		},
+		{
+			name:      "whole database",
+			include:   []string{"shop"},
+			matches:   []string{"shop.orders", "shop.users"},
+			unmatched: []string{"shop2.orders"},
+		},
+		{
+			name:      "dots are literal",
+			include:   []string{"shop.a.b"},
+			matches:   []string{"shop.a.b"},
+			unmatched: []string{"shop.aXb"},
+		},
+		{
+			name:      "regex",
+			include:   []string{`/^tenant_[0-9]+\.(orders|users)$/`},
+			matches:   []string{"tenant_1.orders", "tenant_22.users"},
+			unmatched: []string{"tenant_a.orders", "tenant_1.carts"},
+		},
+		{
+			name:      "exclude",
+			exclude:   []string{"shop.tmp_*", "/^logs\\./"},
+			matches:   []string{"shop.orders", "other.tmp_1"},
+			unmatched: []string{"shop.tmp_1", "logs.app"},
+		},
+		{
+			name:      "exclude wins over include",
+			include:   []string{"shop"},
+			exclude:   []string{"shop.users"},
+			matches:   []string{"shop.orders"},
+			unmatched: []string{"shop.users", "other.orders"},
+		},
+		{
+			name:      "any include",
+			include:   []string{"shop.orders", "/^billing\\./"},
+			matches:   []string{"shop.orders", "billing.invoices"},
+			unmatched: []string{"shop.users"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := NewFilter(test.include, test.exclude)
+			assert.Nil(t, err)
+			for _, each := range test.matches {
+				assert.True(t, f.Match(each), each)
+			}
+			for _, each := range test.unmatched {
+				assert.False(t, f.Match(each), each)
+			}
+		})
+	}
+}
+
+func TestNilFilterMatchesEverything(t *testing.T) {
+	var f *Filter
+	assert.True(t, f.Empty())
+	assert.True(t, f.Match("shop.orders"))
+	assert.Equal(t, bson.D{}, f.databaseConditions())
+	assert.Equal(t, bson.D{}, f.collectionConditions("shop"))
+}
+
+func TestDatabaseConditions(t *testing.T) {
+	tests := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		expected bson.D
+	}{
+		{
+			name:     "globs are pushed down",
+			include:  []string{"tenant_*.orders", "shop"},
+			expected: bson.D{{"$in", bson.A{primitive.Regex{Pattern: "^tenant_.*$"}, primitive.Regex{Pattern: "^shop$"}}}},
+		},
+		{
+			// the regex could select databases no glob does
+			name:     "a regex include disables the pushdown",
+			include:  []string{"shop.orders", "/^billing\\./"},
+			expected: bson.D{},
+		},
+		{
+			name:     "only whole database excludes are pushed down",
+			exclude:  []string{"logs", "shop.tmp_*", "/^audit\\./"},
+			expected: bson.D{{"$nin", bson.A{primitive.Regex{Pattern: "^logs$"}}}},
+		},
+		{
+			name:    "includes and excludes",
+			include: []string{"tenant_*"},
+			exclude: []string{"tenant_test"},
+			expected: bson.D{
+				{"$in", bson.A{primitive.Regex{Pattern: "^tenant_.*$"}}},
+				{"$nin", bson.A{primitive.Regex{Pattern: "^tenant_test$"}}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := NewFilter(test.include, test.exclude)
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, f.databaseConditions())
+		})
+	}
+}
+
+func TestCollectionConditions(t *testing.T) {
+	tests := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		db       string
+		expected bson.D
+	}{
+		{
+			name:     "globs of the database",
+			include:  []string{"shop.orders", "shop.user?", "other.carts"},
+			db:       "shop",
+			expected: bson.D{{"$in", bson.A{primitive.Regex{Pattern: "^orders$"}, primitive.Regex{Pattern: "^user.$"}}}},
+		},
+		{
+			name:     "database glob",
+			include:  []string{"tenant_*.orders"},
+			db:       "tenant_1",
+			expected: bson.D{{"$in", bson.A{primitive.Regex{Pattern: "^orders$"}}}},
+		},
+		{
+			name:     "a regex include disables the pushdown",
+			include:  []string{"shop.orders", "/^shop\\.u/"},
+			db:       "shop",
+			expected: bson.D{},
+		},
+		{
+			name:     "excludes of the database",
+			exclude:  []string{"shop.tmp_*", "other.orders", "/^shop\\.x/"},
+			db:       "shop",
+			expected: bson.D{{"$nin", bson.A{primitive.Regex{Pattern: "^tmp_.*$"}}}},
+		},
+		{
+			// no include selects a collection of the database
+			name:     "no include for the database",
+			include:  []string{"other.orders"},
+			db:       "shop",
+			expected: bson.D{{"$in", bson.A{}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := NewFilter(test.include, test.exclude)
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, f.collectionConditions(test.db))
+		})
+	}
+}
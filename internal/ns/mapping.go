@@ -0,0 +1,148 @@
+package ns
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// how a mapping rule's from is matched against a source namespace
+const (
+	// from is a db.coll namespace, or a database to rename every collection of
+	MatchExact = "exact"
+	// from is a prefix of the namespace, replaced by to
+	MatchPrefix = "prefix"
+	// from is a regex matched against the whole namespace, to may reference its groups (e.x: $1)
+	MatchRegex = "regex"
+)
+
+// Renames source namespaces to the target namespace they were migrated to
+type MappingRule struct {
+	From  string `yaml:"from"`
+	To    string `yaml:"to"`
+	Match string `yaml:"match"`
+}
+
+// Resolves source namespaces to target namespaces, the first matching rule wins
+type Mapper struct {
+	rules []MappingRule
+	regex []*regexp.Regexp
+}
+
+func NewMapper(rules []MappingRule) (*Mapper, error) {
+	m := &Mapper{
+		rules: make([]MappingRule, len(rules)),
+		regex: make([]*regexp.Regexp, len(rules)),
+	}
+	for i, rule := range rules {
+		if rule.Match == "" {
+			rule.Match = MatchExact
+		}
+		if rule.From == "" || rule.To == "" {
+			return nil, fmt.Errorf("mapping %q -> %q: from and to are required", rule.From, rule.To)
+		}
+		switch rule.Match {
+		case MatchExact:
+			if strings.Contains(rule.From, ".") != strings.Contains(rule.To, ".") {
+				return nil, fmt.Errorf("mapping %q -> %q: must map a database to a database or a namespace to a namespace", rule.From, rule.To)
+			}
+		case MatchPrefix:
+		case MatchRegex:
+			regex, err := regexp.Compile("^(?:" + rule.From + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("mapping %q: %w", rule.From, err)
+			}
+			m.regex[i] = regex
+		default:
+			return nil, fmt.Errorf("mapping %q: unknown match %q, expected one of [ %s | %s | %s ]", rule.From, rule.Match, MatchExact, MatchPrefix, MatchRegex)
+		}
+		m.rules[i] = rule
+	}
+	return m, nil
+}
+
+func (m *Mapper) Empty() bool {
+	return m == nil || len(m.rules) == 0
+}
+
+// returns the target namespace a source namespace maps to, itself when no rule matches
+func (m *Mapper) Map(namespace string) string {
+	if m == nil {
+		return namespace
+	}
+	for i, rule := range m.rules {
+		mapped, ok := m.apply(i, rule, namespace)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(mapped, "."); i <= 0 || i == len(mapped)-1 {
+			log.Error().Msgf("mapping %q maps %s to %q which is not a namespace, comparing it unmapped", rule.From, namespace, mapped)
+			return namespace
+		}
+		return mapped
+	}
+	return namespace
+}
+
+func (m *Mapper) apply(i int, rule MappingRule, namespace string) (string, bool) {
+	switch rule.Match {
+	case MatchExact:
+		if namespace == rule.From {
+			return rule.To, true
+		}
+		// a database rule keeps the collection name
+		if db, coll, found := strings.Cut(namespace, "."); found && db == rule.From {
+			return rule.To + "." + coll, true
+		}
+	case MatchPrefix:
+		if strings.HasPrefix(namespace, rule.From) {
+			return rule.To + namespace[len(rule.From):], true
+		}
+	case MatchRegex:
+		if m.regex[i].MatchString(namespace) {
+			return m.regex[i].ReplaceAllString(namespace, rule.To), true
+		}
+	}
+	return "", false
+}
+
+// returns the target database every collection of a source database maps into when the rules decide it by the
+// database name alone, not ok when a rule may map its collections apart (e.x: a namespace or regex rule)
+func (m *Mapper) TargetDatabase(db string) (string, bool) {
+	if m == nil {
+		return db, true
+	}
+	for _, rule := range m.rules {
+		switch rule.Match {
+		case MatchExact:
+			if rule.From == db {
+				return rule.To, true
+			}
+			if strings.HasPrefix(rule.From, db+".") {
+				return "", false
+			}
+		case MatchPrefix:
+			if strings.HasPrefix(rule.From, db+".") {
+				return "", false
+			}
+			if !strings.HasPrefix(db, rule.From) {
+				continue
+			}
+			// the prefix is part of the database name, the rest of the database name is kept
+			i := strings.Index(rule.To, ".")
+			switch {
+			case i == 0:
+				// never maps to a namespace, so every collection is compared unmapped
+				return db, true
+			case i > 0:
+				return rule.To[:i], true
+			}
+			return rule.To + db[len(rule.From):], true
+		case MatchRegex:
+			return "", false
+		}
+	}
+	return db, true
+}
@@ -0,0 +1,137 @@
+package ns
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMapperInvalidRules(t *testing.T) {
+	for _, rule := range []MappingRule{
+		{From: "shop.orders"},
+		{To: "shop.orders"},
+		{From: "shop", To: "store.orders"},
+		{From: "shop.orders", To: "store"},
+		{From: "(", To: "store.orders", Match: MatchRegex},
+		{From: "shop", To: "store", Match: "glob"},
+	} {
+		_, err := NewMapper([]MappingRule{rule})
+		assert.Error(t, err, rule.From)
+	}
+}
+
+func TestMapperMap(t *testing.T) {
+	m, err := NewMapper([]MappingRule{
+		{From: "shop.orders", To: "store.purchases"},
+		{From: "shop", To: "store"},
+		{From: "legacy_", To: "v2_", Match: MatchPrefix},
+		{From: `tenant_([0-9]+)\.(.*)`, To: "tenants.t${1}_$2", Match: MatchRegex},
+	})
+	assert.Nil(t, err)
+	tests := []struct {
+		namespace string
+		expected  string
+	}{
+		// exact namespace
+		{"shop.orders", "store.purchases"},
+		// database rename keeps the collection
+		{"shop.users", "store.users"},
+		{"shopping.users", "shopping.users"},
+		{"legacy_db.users", "v2_db.users"},
+		{"tenant_12.orders", "tenants.t12_orders"},
+		{"tenant_x.orders", "tenant_x.orders"},
+		// unmatched namespaces map to themselves
+		{"other.users", "other.users"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, m.Map(test.namespace), test.namespace)
+	}
+}
+
+func TestMapperFirstRuleWins(t *testing.T) {
+	m, err := NewMapper([]MappingRule{
+		{From: "legacy_", To: "v2_", Match: MatchPrefix},
+		{From: "legacy_shop.orders", To: "store.orders"},
+		{From: `legacy_(.*)`, To: "regex_$1", Match: MatchRegex},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "v2_shop.orders", m.Map("legacy_shop.orders"))
+
+	m, err = NewMapper([]MappingRule{
+		{From: "legacy_shop", To: "store"},
+		{From: "legacy_shop.orders", To: "store.purchases"},
+	})
+	assert.Nil(t, err)
+	// the database rule comes first and keeps the collection name
+	assert.Equal(t, "store.orders", m.Map("legacy_shop.orders"))
+}
+
+func TestMapperInvalidNamespaceFallsBack(t *testing.T) {
+	m, err := NewMapper([]MappingRule{
+		{From: "shop.", To: "store", Match: MatchPrefix},
+		{From: "shop", To: "other"},
+	})
+	assert.Nil(t, err)
+	// the prefix rule matches first and drops the dot, so the namespace is compared unmapped
+	assert.Equal(t, "shop.orders", m.Map("shop.orders"))
+
+	m, err = NewMapper([]MappingRule{{From: `(.*)\.(.*)`, To: "$2.", Match: MatchRegex}})
+	assert.Nil(t, err)
+	assert.Equal(t, "shop.orders", m.Map("shop.orders"))
+}
+
+func TestNilMapper(t *testing.T) {
+	var m *Mapper
+	assert.True(t, m.Empty())
+	assert.Equal(t, "shop.orders", m.Map("shop.orders"))
+}
+
+func TestMapperTargetDatabase(t *testing.T) {
+	m, err := NewMapper([]MappingRule{
+		{From: "shop.orders", To: "store.purchases"},
+		{From: "shop", To: "store"},
+		{From: "legacy_", To: "v2_", Match: MatchPrefix},
+		{From: "old_", To: "archive.old_", Match: MatchPrefix},
+		{From: "logs.", To: "audit.", Match: MatchPrefix},
+	})
+	assert.Nil(t, err)
+	tests := []struct {
+		db       string
+		expected string
+		ok       bool
+	}{
+		// the namespace rule moves one collection apart from the database rule
+		{"shop", "", false},
+		{"legacy_db", "v2_db", true},
+		{"old_db", "archive", true},
+		{"logs", "", false},
+		{"other", "other", true},
+	}
+	for _, test := range tests {
+		target, ok := m.TargetDatabase(test.db)
+		assert.Equal(t, test.ok, ok, test.db)
+		assert.Equal(t, test.expected, target, test.db)
+		if ok {
+			db, _, _ := strings.Cut(m.Map(test.db+".users"), ".")
+			assert.Equal(t, test.expected, db, test.db)
+		}
+	}
+
+	m, err = NewMapper([]MappingRule{
+		{From: "shop", To: "store"},
+		{From: "shop.orders", To: "store.purchases"},
+		{From: `tenant_([0-9]+)\.(.*)`, To: "tenants.t${1}_$2", Match: MatchRegex},
+	})
+	assert.Nil(t, err)
+	target, ok := m.TargetDatabase("shop")
+	assert.True(t, ok)
+	assert.Equal(t, "store", target)
+	_, ok = m.TargetDatabase("tenant_1")
+	assert.False(t, ok)
+
+	var nilMapper *Mapper
+	target, ok = nilMapper.TargetDatabase("shop")
+	assert.True(t, ok)
+	assert.Equal(t, "shop", target)
+}
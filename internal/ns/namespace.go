@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"sort"
 
 	"sampler/internal/util"
 
@@ -29,10 +30,14 @@ func (ns Namespace) GetName() string {
 }
 
 func (src Namespace) Equal(tgt any) bool {
+	return src.Specification.Name == tgt.(Namespace).Specification.Name && src.EqualOptions(tgt.(Namespace))
+}
+
+// compares everything but the name, e.x: for a collection renamed on the target
+func (src Namespace) EqualOptions(tgt Namespace) bool {
 	a := src.Specification
-	b := tgt.(Namespace).Specification
-	return a.Name == b.Name &&
-		a.ReadOnly == b.ReadOnly &&
+	b := tgt.Specification
+	return a.ReadOnly == b.ReadOnly &&
 		a.Type == b.Type &&
 		a.IDIndex.Name == b.IDIndex.Name &&
 		bytes.Equal(a.Options, b.Options)
@@ -48,10 +53,10 @@ var (
 )
 
 // Get a single user namespace
-func GetOneUserCollections(client *mongo.Client, dbName string, collName string) (Namespace, error) {
+func GetOneUserCollections(ctx context.Context, client *mongo.Client, dbName string, collName string) (Namespace, error) {
 	db := client.Database(dbName)
 	filter := bson.D{{"name", collName}}
-	specifications, err := db.ListCollectionSpecifications(context.TODO(), filter, nil)
+	specifications, err := db.ListCollectionSpecifications(ctx, filter, nil)
 	if err != nil {
 		return Namespace{}, err
 	}
@@ -62,48 +67,92 @@ func GetOneUserCollections(client *mongo.Client, dbName string, collName string)
 	return Namespace{Db: dbName, Collection: spec.Name, Specification: spec}, nil
 }
 
-// Lists all the user collections on a cluster.  Unlike mongosync, we don't use the internal $listCatalog, since we need to
-// work on old versions without that command. This means this does not run with read concern majority.
-func AllUserCollections(client *mongo.Client, includeViews bool, additionalExcludedDBs ...string) ([]Namespace, error) {
-	excludedDBs := []string{}
-	excludedDBs = append(excludedDBs, additionalExcludedDBs...)
-	excludedDBs = append(excludedDBs, ExcludedSystemDBs...)
+// Lists the sorted names of the user databases on a cluster that may hold collections selected by the filter
+func UserDatabases(ctx context.Context, client *mongo.Client, nsFilter *Filter, additionalExcludedDBs ...string) ([]string, error) {
+	excludedDBs := bson.A{}
+	for _, each := range additionalExcludedDBs {
+		excludedDBs = append(excludedDBs, each)
+	}
+	for _, each := range ExcludedSystemDBs {
+		excludedDBs = append(excludedDBs, each)
+	}
+	dbFilter := mergeNameConditions(bson.D{{"$nin", excludedDBs}}, nsFilter.databaseConditions())
 
-	dbNames, err := client.ListDatabaseNames(context.TODO(), bson.D{{"name", bson.D{{"$nin", excludedDBs}}}}, options.ListDatabases().SetNameOnly(true))
+	dbNames, err := client.ListDatabaseNames(ctx, bson.D{{"name", dbFilter}}, options.ListDatabases().SetNameOnly(true))
 	if err != nil {
 		return nil, err
 	}
-	log.Debug().Msgf("all user databases: %+v", dbNames)
-
-	// iterate each db getting all collection's specification and adding it as a fully qualified namespace
-	namespaces := []Namespace{}
-	for _, dbName := range dbNames {
-		db := client.Database(dbName)
-		filter := bson.D{{"name", bson.D{{"$nin", bson.A{ExcludedSystemCollRegex}}}}}
-		if !includeViews {
-			filter = append(filter, bson.E{"type", bson.D{{"$ne", "view"}}})
-		}
-		specifications, err := db.ListCollectionSpecifications(context.TODO(), filter, nil)
-		if err != nil {
-			return nil, err
-		}
-		for _, spec := range specifications {
-			log.Trace().Msgf("found coll spec %+v", spec)
-			ns := Namespace{Db: dbName, Collection: spec.Name, Specification: spec}
-			namespaces = append(namespaces, ns)
+	sort.Strings(dbNames)
+	log.Debug().Msgf("user databases: %+v", dbNames)
+	return dbNames, nil
+}
+
+// Lists the names of the user collections of a single database selected by the filter, sorted. The filter's globs are pushed
+// down to listCollections, anything they cannot express is matched client side. listCollections does not return collections
+// in name order, so only the names are listed and sorted, see Specifications. Unlike mongosync, we don't use the internal
+// $listCatalog, since we need to work on old versions without that command. This means this does not run with read concern majority.
+func UserCollectionNames(ctx context.Context, client *mongo.Client, dbName string, nsFilter *Filter, includeViews bool) ([]string, error) {
+	collFilter := mergeNameConditions(bson.D{{"$nin", bson.A{ExcludedSystemCollRegex}}}, nsFilter.collectionConditions(dbName))
+	filter := bson.D{{"name", collFilter}}
+	if !includeViews {
+		filter = append(filter, bson.E{"type", bson.D{{"$ne", "view"}}})
+	}
+	listed, err := client.Database(dbName).ListCollectionNames(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(listed))
+	for _, each := range listed {
+		if !nsFilter.Match(dbName + "." + each) {
+			log.Trace().Msgf("%s.%s is not selected by the namespace filter", dbName, each)
+			continue
 		}
+		names = append(names, each)
 	}
-	return namespaces, nil
+	sort.Strings(names)
+	return names, nil
+}
+
+// Reads the specifications of some collections of a database, keyed by name. Collections dropped since they were listed are left out
+func Specifications(ctx context.Context, client *mongo.Client, dbName string, names []string) (map[string]*mongo.CollectionSpecification, error) {
+	specifications, err := client.Database(dbName).ListCollectionSpecifications(ctx, bson.D{{"name", bson.D{{"$in", names}}}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]*mongo.CollectionSpecification, len(specifications))
+	for _, spec := range specifications {
+		log.Trace().Msgf("found coll spec %+v", spec)
+		ret[spec.Name] = spec
+	}
+	return ret, nil
 }
 
 // checks to see if a collection is sharded. If it is, returns (true, <shard key>). If it is not, returns (false, nil)
-func IsSharded(client *mongo.Client, dbName string, collName string) (bool, bson.Raw) {
-	if util.IsMongos(client) {
+func IsSharded(ctx context.Context, client *mongo.Client, dbName string, collName string) (bool, bson.Raw) {
+	if util.IsMongos(ctx, client) {
 		filter := bson.D{{"_id", dbName + "." + collName}}
-		res := client.Database("config").Collection("collections").FindOne(context.TODO(), filter, nil)
+		res := client.Database("config").Collection("collections").FindOne(ctx, filter, nil)
 		if raw, err := res.Raw(); err == nil {
 			return true, raw.Lookup("key").Document()
 		}
 	}
 	return false, nil
 }
+
+// merges name conditions, appending the $nin lists of both and keeping any other operator
+func mergeNameConditions(base bson.D, extra bson.D) bson.D {
+	merged := append(bson.D{}, base...)
+	for _, condition := range extra {
+		appended := false
+		for i, each := range merged {
+			if each.Key == "$nin" && condition.Key == "$nin" {
+				merged[i].Value = append(each.Value.(bson.A), condition.Value.(bson.A)...)
+				appended = true
+			}
+		}
+		if !appended {
+			merged = append(merged, condition)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,49 @@
+package reporter
+
+import (
+	"fmt"
+	"math"
+
+	"sampler/internal/util"
+)
+
+// How far the inconsistencies found in one direction of a sample generalize to the documents it was drawn from
+type Confidence struct {
+	// two sided confidence level of the interval, e.x: 0.99
+	Level        float64 `json:"level" bson:"level"`
+	Sampled      int64   `json:"sampled" bson:"sampled"`
+	Inconsistent int64   `json:"inconsistent" bson:"inconsistent"`
+	// Wilson score interval of the proportion of inconsistent documents
+	ProportionLow  float64 `json:"proportionLow" bson:"proportionLow"`
+	ProportionHigh float64 `json:"proportionHigh" bson:"proportionHigh"`
+	Population     int64   `json:"population" bson:"population"`
+	// upper bound of the interval applied to the whole population
+	MaxInconsistent int64 `json:"maxInconsistent" bson:"maxInconsistent"`
+}
+
+// computes the confidence of inconsistent documents (missing or mismatched) out of sampled, drawn from population, at the z-value (z)
+func NewConfidence(inconsistent int64, sampled int64, population int64, z float64) Confidence {
+	low, high := util.WilsonInterval(inconsistent, sampled, z)
+	return Confidence{
+		Level:           util.ConfidenceLevel(z),
+		Sampled:         sampled,
+		Inconsistent:    inconsistent,
+		ProportionLow:   low,
+		ProportionHigh:  high,
+		Population:      population,
+		MaxInconsistent: int64(math.Ceil(high * float64(population))),
+	}
+}
+
+func (c Confidence) String() string {
+	return fmt.Sprintf("with %.1f%% confidence at most %d of %d documents are inconsistent (%d of %d sampled, proportion between %.4f%% and %.4f%%)",
+		c.Level*100, c.MaxInconsistent, c.Population, c.Inconsistent, c.Sampled, c.ProportionLow*100, c.ProportionHigh*100)
+}
+
+// The selection of a seeded sample, passing Fraction back with the same Seed selects the same documents
+type Seed struct {
+	Seed       int64   `json:"seed" bson:"seed"`
+	Fraction   float64 `json:"fraction" bson:"fraction"`
+	Size       int64   `json:"size" bson:"size"`
+	Population int64   `json:"population" bson:"population"`
+}
@@ -4,6 +4,8 @@ type DocSummary struct {
 	Missing   int
 	Different int
 	Equal     int
+	// documents counted as Equal that only differ in ways the comparison tolerates
+	Minor int
 }
 
 func (ds DocSummary) HasMismatches() bool {
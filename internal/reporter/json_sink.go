@@ -0,0 +1,86 @@
+package reporter
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Writes each report as a single line of relaxed extended JSON. Unlike the mongo sink nothing is merged,
+// so collSampleSummary lines hold the per-batch increments and must be summed by the reader
+type JSONSink struct {
+	lock   sync.Mutex
+	out    *bufio.Writer
+	flush  bool
+	closer io.Closer
+}
+
+// appends JSON lines to the file at path, creating it if it does not exist
+func NewFileSink(path string) (*JSONSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		return nil, err
+	}
+	return newJSONSink(file, false, file), nil
+}
+
+// writes JSON lines to stdout, flushing after every report so they can be piped
+func NewStdoutSink() *JSONSink {
+	return newJSONSink(os.Stdout, true, nil)
+}
+
+// writes JSON lines to out, flushing after every report when flush is set and otherwise on Close. closer is closed
+// on Close when it is not nil
+func newJSONSink(out io.Writer, flush bool, closer io.Closer) *JSONSink {
+	return &JSONSink{
+		out:    bufio.NewWriter(out),
+		flush:  flush,
+		closer: closer,
+	}
+}
+
+func (s *JSONSink) Write(ctx context.Context, rep Report) error {
+	line := bson.D{
+		{"run", rep.Run},
+		{"ns", rep.Namespace},
+		{"reason", rep.Reason},
+	}
+	if target := rep.mappedNamespace(); target != "" {
+		line = append(line, bson.E{"tgtNs", target})
+	}
+	if rep.Stratum != "" {
+		line = append(line, bson.E{"stratum", rep.Stratum})
+	}
+	line = append(line, rep.Details...)
+	line = append(line, rep.Set...)
+	raw, err := bson.MarshalExtJSON(line, false, false)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err = s.out.Write(append(raw, '\n')); err != nil {
+		return err
+	}
+	if s.flush {
+		return s.out.Flush()
+	}
+	return nil
+}
+
+func (s *JSONSink) Close(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.out.Flush(); err != nil {
+		return err
+	}
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package reporter
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sampler/internal/util"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type testCloser struct {
+	closed bool
+}
+
+func (c *testCloser) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestJSONSinkWrite(t *testing.T) {
+	out := &bytes.Buffer{}
+	closer := &testCloser{}
+	sink := newJSONSink(out, false, closer)
+	run := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	assert.Nil(t, sink.Write(context.Background(), Report{
+		Run:             run,
+		Namespace:       "shop.orders",
+		TargetNamespace: "shop.orders",
+		Reason:          COLL_SUMMARY,
+		Details:         bson.D{{"docsSampled.src", 10}},
+		Set:             bson.D{{"confidence.srcToTgt", 0.99}},
+		Direction:       util.SrcToTgt,
+		Stratum:         "eu",
+	}))
+	assert.Nil(t, sink.Write(context.Background(), Report{
+		Run:             run,
+		Namespace:       "shop.orders",
+		TargetNamespace: "store.purchases",
+		Reason:          DOC_MISSING,
+		Details:         bson.D{{"key", 1}},
+	}))
+	// written on close
+	assert.Empty(t, out.String())
+	assert.Nil(t, sink.Close(context.Background()))
+	assert.True(t, closer.closed)
+	assert.Equal(t, `{"run":{"$date":"2024-05-01T10:00:00Z"},"ns":"shop.orders","reason":"collSampleSummary","stratum":"eu","docsSampled.src":10,"confidence.srcToTgt":0.99}`+"\n"+
+		`{"run":{"$date":"2024-05-01T10:00:00Z"},"ns":"shop.orders","reason":"docMissing","tgtNs":"store.purchases","key":1}`+"\n",
+		out.String())
+}
+
+func TestJSONSinkFlushesEveryReport(t *testing.T) {
+	out := &bytes.Buffer{}
+	sink := newJSONSink(out, true, nil)
+	assert.Nil(t, sink.Write(context.Background(), Report{Namespace: "shop.orders", Reason: NS_MISSING}))
+	assert.Equal(t, 1, strings.Count(out.String(), "\n"))
+	assert.Nil(t, sink.Close(context.Background()))
+}
+
+func TestJSONSinkConcurrentWrites(t *testing.T) {
+	out := &bytes.Buffer{}
+	sink := newJSONSink(out, false, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert.Nil(t, sink.Write(context.Background(), Report{Namespace: "shop.orders", Reason: DOC_DIFF, Details: bson.D{{"key", worker*100 + j}}}))
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Nil(t, sink.Close(context.Background()))
+
+	// every line is whole
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	assert.Len(t, lines, 800)
+	for _, line := range lines {
+		var parsed bson.D
+		assert.Nil(t, bson.UnmarshalExtJSON([]byte(line), false, &parsed), line)
+	}
+}
@@ -0,0 +1,134 @@
+package reporter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Upserts reports into the report and docs collections of the meta database. Sample summaries are
+// accumulated per run and namespace, document reports are kept unique per run, namespace and _id
+type MongoSink struct {
+	metaClient mongo.Client
+	metaDBName string
+}
+
+func NewMongoSink(meta *mongo.Client, dbName string, clean bool) *MongoSink {
+	s := &MongoSink{
+		metaClient: *meta,
+		metaDBName: dbName,
+	}
+	if clean {
+		s.cleanMetaDB()
+	}
+	return s
+}
+
+func (s *MongoSink) Write(ctx context.Context, rep Report) error {
+	filter, update := upsertOf(rep)
+	log.Debug().Str("ns", rep.Namespace).Msgf("appending summary -- {filter: %s, update: %s}", filter, update)
+	opts := options.Update().SetUpsert(true)
+	_, err := s.getCollection(rep.Reason).UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		return fmt.Errorf("unable to append to doc summary  -- {filter: %s, update: %s}: %w", filter, update, err)
+	}
+	return nil
+}
+
+// returns the filter and update upserting a report into its collection
+func upsertOf(rep Report) (bson.D, bson.D) {
+	filter := bson.D{
+		{"reason", rep.Reason},
+		{"run", rep.Run},
+		{"ns", rep.Namespace},
+	}
+	// equality fields of the filter are set on upsert, so the target name is stored without a separate $set
+	if target := rep.mappedNamespace(); target != "" {
+		filter = append(filter, bson.E{"tgtNs", target})
+	}
+
+	// every stratum of a stratified sample has its own summary
+	if rep.Stratum != "" {
+		filter = append(filter, bson.E{"stratum", rep.Stratum})
+	}
+
+	var update bson.D
+	switch rep.Reason {
+
+	case COLL_SUMMARY:
+		update = bson.D{}
+		if len(rep.Details) > 0 {
+			update = append(update, bson.E{"$inc", rep.Details})
+		}
+		if len(rep.Set) > 0 {
+			update = append(update, bson.E{"$set", rep.Set})
+		}
+	case RUN:
+		// one document per run
+		filter = bson.D{{"_id", rep.Run}}
+		update = bson.D{
+			{"$set", rep.Details},
+		}
+	case NS_MISSING, NS_DIFF, COUNT_DIFF:
+		// at most one per namespace, upserting on the base filter keeps a resumed run from duplicating them
+		update = bson.D{
+			{"$set", rep.Details},
+		}
+	case NS_ERROR:
+		var doc bson.Raw
+		doc, err := bson.Marshal(rep.Details)
+		if err != nil {
+			log.Error().Err(err).Msg("[internal] cannot marshal details doc to bson.Raw")
+		}
+		filter = append(filter, bson.E{"stage", doc.Lookup("stage")})
+		update = bson.D{
+			{"$set", rep.Details},
+		}
+	case DOC_DIFF, DOC_MINOR_DIFF, DOC_MISSING:
+		var doc bson.Raw
+		doc, err := bson.Marshal(rep.Details)
+		if err != nil {
+			log.Error().Err(err).Msg("[internal] cannot marshal details doc to bson.Raw")
+		}
+		filter = append(filter, bson.E{"key", doc.Lookup("key")})
+		update = bson.D{
+			{"$set", rep.Details},
+		}
+	default:
+		// if not updating an existing doc, manually add _id so the upsert filter is unique and an insert occurs
+		filter = append(filter, bson.E{"_id", primitive.NewObjectID()})
+		update = bson.D{
+			{"$set", rep.Details},
+		}
+	}
+
+	return filter, update
+}
+
+// writes go straight to the server, nothing to flush
+func (s *MongoSink) Close(ctx context.Context) error {
+	return nil
+}
+
+func (s *MongoSink) getCollection(reason Reason) *mongo.Collection {
+	switch reason {
+	case DOC_DIFF, DOC_MINOR_DIFF, DOC_MISSING:
+		return s.metaClient.Database(s.metaDBName).Collection(DOCS_COLL)
+	case RUN:
+		return s.metaClient.Database(s.metaDBName).Collection(RUNS_COLL)
+	default:
+		return s.metaClient.Database(s.metaDBName).Collection(REPORT_COLL)
+	}
+}
+
+func (s *MongoSink) cleanMetaDB() {
+	err := s.metaClient.Database(s.metaDBName).Drop(context.TODO())
+	if err != nil {
+		log.Error().Err(err).Msg("unable to drop meta collection")
+	}
+}
@@ -0,0 +1,76 @@
+package reporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestUpsertOf(t *testing.T) {
+	run := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		rep    Report
+		filter bson.D
+		update bson.D
+	}{
+		{
+			name: "summaries accumulate per stratum",
+			rep: Report{Run: run, Namespace: "shop.orders", TargetNamespace: "shop.orders", Reason: COLL_SUMMARY, Stratum: "eu",
+				Details: bson.D{{"docsSampled.src", 10}}, Set: bson.D{{"seed", 3}}},
+			filter: bson.D{{"reason", COLL_SUMMARY}, {"run", run}, {"ns", "shop.orders"}, {"stratum", "eu"}},
+			update: bson.D{{"$inc", bson.D{{"docsSampled.src", 10}}}, {"$set", bson.D{{"seed", 3}}}},
+		},
+		{
+			name:   "one document per run",
+			rep:    Report{Run: run, Reason: RUN, Details: bson.D{{"status", RUN_RUNNING}}},
+			filter: bson.D{{"_id", run}},
+			update: bson.D{{"$set", bson.D{{"status", RUN_RUNNING}}}},
+		},
+		{
+			name:   "mapped namespaces are stored with their target",
+			rep:    Report{Run: run, Namespace: "shop.orders", TargetNamespace: "store.purchases", Reason: COUNT_DIFF, Details: bson.D{{"src", 1}}},
+			filter: bson.D{{"reason", COUNT_DIFF}, {"run", run}, {"ns", "shop.orders"}, {"tgtNs", "store.purchases"}},
+			update: bson.D{{"$set", bson.D{{"src", 1}}}},
+		},
+		{
+			name:   "documents are unique per _id",
+			rep:    Report{Run: run, Namespace: "shop.orders", Reason: DOC_MISSING, Details: bson.D{{"key", testValue(7)}, {"resolved", true}}},
+			filter: bson.D{{"reason", DOC_MISSING}, {"run", run}, {"ns", "shop.orders"}, {"key", testValue(7)}},
+			update: bson.D{{"$set", bson.D{{"key", testValue(7)}, {"resolved", true}}}},
+		},
+		{
+			name:   "errors are unique per stage",
+			rep:    Report{Run: run, Namespace: "shop.orders", Reason: NS_ERROR, Details: bson.D{{"stage", "sampleDocs"}, {"error", "boom"}}},
+			filter: bson.D{{"reason", NS_ERROR}, {"run", run}, {"ns", "shop.orders"}, {"stage", testValue("sampleDocs")}},
+			update: bson.D{{"$set", bson.D{{"stage", "sampleDocs"}, {"error", "boom"}}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, update := upsertOf(test.rep)
+			assert.Equal(t, test.filter, filter)
+			assert.Equal(t, test.update, update)
+		})
+	}
+
+	// anything else is always inserted
+	first, _ := upsertOf(Report{Run: run, Namespace: "shop.orders", Reason: INDEX_MISSING})
+	second, _ := upsertOf(Report{Run: run, Namespace: "shop.orders", Reason: INDEX_MISSING})
+	assert.Equal(t, "_id", first[len(first)-1].Key)
+	assert.IsType(t, primitive.ObjectID{}, first[len(first)-1].Value)
+	assert.NotEqual(t, first, second)
+}
+
+func TestMongoSinkCollections(t *testing.T) {
+	s := &MongoSink{metaDBName: "meta"}
+	assert.Equal(t, DOCS_COLL, s.getCollection(DOC_DIFF).Name())
+	assert.Equal(t, DOCS_COLL, s.getCollection(DOC_MINOR_DIFF).Name())
+	assert.Equal(t, DOCS_COLL, s.getCollection(DOC_MISSING).Name())
+	assert.Equal(t, RUNS_COLL, s.getCollection(RUN).Name())
+	assert.Equal(t, REPORT_COLL, s.getCollection(COLL_SUMMARY).Name())
+	assert.Equal(t, "meta", s.getCollection(NS_ERROR).Database().Name())
+}
@@ -0,0 +1,125 @@
+package reporter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Checkpoints which stages finished for each namespace of a run in the meta database's progress
+// collection, so an interrupted run can be resumed without starting over
+type Progress struct {
+	metaClient mongo.Client
+	metaDBName string
+	run        time.Time
+}
+
+// Progress of a single namespace as last checkpointed
+type NamespaceProgress struct {
+	Stages []string `bson:"stages"`
+	Done   bool     `bson:"done"`
+	// the namespace's result as of the last finished stage
+	Result bson.Raw `bson:"result"`
+}
+
+func (p NamespaceProgress) HasStage(stage string) bool {
+	for _, each := range p.Stages {
+		if each == stage {
+			return true
+		}
+	}
+	return false
+}
+
+func NewProgress(meta *mongo.Client, dbName string, run time.Time) *Progress {
+	return &Progress{
+		metaClient: *meta,
+		metaDBName: dbName,
+		run:        run,
+	}
+}
+
+// returns the checkpointed progress of every namespace in the run, keyed by namespace. Fails when the run has neither
+// progress nor a runs document, e.x: a mistyped run time
+func (p *Progress) Load(ctx context.Context) (map[string]NamespaceProgress, error) {
+	cursor, err := p.collection().Find(ctx, bson.D{{"run", p.run}})
+	if err != nil {
+		return nil, fmt.Errorf("cannot load progress of run %s: %w", p.run.UTC().Format(time.RFC3339Nano), err)
+	}
+	defer cursor.Close(ctx)
+
+	progress := map[string]NamespaceProgress{}
+	for cursor.Next(ctx) {
+		var each struct {
+			Namespace         string `bson:"ns"`
+			NamespaceProgress `bson:",inline"`
+		}
+		if err := cursor.Decode(&each); err != nil {
+			return nil, fmt.Errorf("cannot decode progress: %w", err)
+		}
+		progress[each.Namespace] = each.NamespaceProgress
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	// a run interrupted before checkpointing any namespace still has its runs document
+	if len(progress) == 0 {
+		runs, err := p.metaClient.Database(p.metaDBName).Collection(RUNS_COLL).CountDocuments(ctx, bson.D{{"_id", p.run}})
+		if err != nil {
+			return nil, fmt.Errorf("cannot look up run %s: %w", p.run.UTC().Format(time.RFC3339Nano), err)
+		}
+		if runs == 0 {
+			return nil, fmt.Errorf("no run %s to resume in %s.%s", p.run.UTC().Format(time.RFC3339Nano), p.metaDBName, RUNS_COLL)
+		}
+	}
+	return progress, nil
+}
+
+// records that stage finished for the namespace along with the namespace's result so far
+func (p *Progress) StageDone(ctx context.Context, namespace string, stage string, result any) error {
+	update := bson.D{
+		{"$addToSet", bson.D{{"stages", stage}}},
+		{"$set", bson.D{{"result", result}, {"updated", time.Now()}}},
+	}
+	return p.upsert(ctx, namespace, update)
+}
+
+// records that every stage finished for the namespace, a resumed run skips it entirely
+func (p *Progress) NamespaceDone(ctx context.Context, namespace string, result any) error {
+	update := bson.D{
+		{"$set", bson.D{{"done", true}, {"result", result}, {"updated", time.Now()}}},
+	}
+	return p.upsert(ctx, namespace, update)
+}
+
+// removes the sample summary and document reports an interrupted attempt left for the namespace, so
+// re-sampling it does not add to the previous attempt's totals
+func (p *Progress) ResetSample(ctx context.Context, namespace string) error {
+	db := p.metaClient.Database(p.metaDBName)
+	_, err := db.Collection(REPORT_COLL).DeleteMany(ctx, bson.D{{"reason", COLL_SUMMARY}, {"run", p.run}, {"ns", namespace}})
+	if err != nil {
+		return fmt.Errorf("cannot reset sample summary: %w", err)
+	}
+	_, err = db.Collection(DOCS_COLL).DeleteMany(ctx, bson.D{{"run", p.run}, {"ns", namespace}})
+	if err != nil {
+		return fmt.Errorf("cannot reset document reports: %w", err)
+	}
+	return nil
+}
+
+func (p *Progress) upsert(ctx context.Context, namespace string, update bson.D) error {
+	filter := bson.D{{"run", p.run}, {"ns", namespace}}
+	_, err := p.collection().UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("cannot checkpoint progress: %w", err)
+	}
+	return nil
+}
+
+func (p *Progress) collection() *mongo.Collection {
+	return p.metaClient.Database(p.metaDBName).Collection(PROGRESS_COLL)
+}
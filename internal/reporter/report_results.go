@@ -2,77 +2,113 @@ package reporter
 
 import (
 	"context"
+	"hash/fnv"
+	"sampler/internal/doc"
 	"sampler/internal/ns"
 	"sampler/internal/util"
 	"sampler/internal/worker"
 	"time"
+	"unicode/utf8"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Reporter struct {
-	metaClient    mongo.Client
-	metaDBName    string
+	sinks         []Sink
 	startTime     time.Time
 	reportFullDoc bool
-	queue         chan report
-	pool          *worker.Pool
+	// one queue per worker, see send
+	queues []chan Report
+	pool   *worker.Pool
 }
 
-type report struct {
-	namespace string
-	reason    Reason
-	details   bson.D
-	direction util.Direction
-}
-
-// Create new reporter -- uses its own single thread pool and listens for reports to insert
-// to the Meta DB until Reporter.Done() has been called
-func NewReporter(meta *mongo.Client, dbName string, clean bool, startTime time.Time, reportFullDoc bool) Reporter {
+// Create new reporter -- uses its own pool of numWorkers and listens for reports to write
+// to every sink until Reporter.Done() has been called
+func NewReporter(sinks []Sink, startTime time.Time, reportFullDoc bool, numWorkers int) Reporter {
 	r := Reporter{
-		metaClient:    *meta,
-		metaDBName:    dbName,
+		sinks:         sinks,
 		reportFullDoc: reportFullDoc,
 		startTime:     startTime,
-		queue:         make(chan report),
 	}
-	if clean {
-		r.cleanMetaDB()
+	for i := 0; i < numWorkers; i++ {
+		r.queues = append(r.queues, make(chan Report))
 	}
 
 	logger := log.With().Str("c", "reporter").Logger()
-	pool := worker.NewWorkerPool(logger, 1, "reporterWorkers")
+	pool := worker.NewWorkerPool(logger, numWorkers, "reporterWorkers")
 
-	pool.Start(func(iCtx context.Context, iLogger zerolog.Logger) {
-		r.processReports(iCtx, iLogger)
+	// hands every worker its own queue
+	queues := make(chan chan Report, numWorkers)
+	for _, each := range r.queues {
+		queues <- each
+	}
+	// reporters are never cancelled so reports queued before an interrupt are still written
+	pool.Start(context.Background(), func(iCtx context.Context, iLogger zerolog.Logger) {
+		r.processReports(iCtx, iLogger, <-queues)
 	})
 	r.pool = &pool
 	return r
 }
 
-// close the reporting queue
+// close the reporting queues, wait for queued reports to be written and close every sink
 func (r *Reporter) Done(ctx context.Context, logger zerolog.Logger) {
-	logger.Debug().Msg("closing reporter queue and waiting for reporters to finish")
-	close(r.queue)
+	logger.Debug().Msg("closing reporter queues and waiting for reporters to finish")
+	for _, queue := range r.queues {
+		close(queue)
+	}
 	r.pool.Done()
+	for _, sink := range r.sinks {
+		if err := sink.Close(ctx); err != nil {
+			logger.Error().Err(err).Msg("unable to close report sink")
+		}
+	}
+}
+
+// records the status of the whole run, e.x: so an interrupted run can be told apart from one that is still going
+func (r *Reporter) RunStatus(status RunStatus) {
+	reason := RUN
+	details := bson.D{
+		{"status", status},
+		{"updated", time.Now()},
+	}
+	rep := Report{
+		Reason:  reason,
+		Details: details,
+	}
+	r.send(rep)
 }
 
-func (r *Reporter) MissingNamespace(missing string, loc Location) {
+// records the seed of a seeded sample and its fixed fraction of the hash space, 0 when every namespace derives its own
+func (r *Reporter) RunSeed(seed int64, fraction float64) {
+	reason := RUN
+	details := bson.D{
+		{"seed", seed},
+		{"seedFraction", fraction},
+	}
+	rep := Report{
+		Reason:  reason,
+		Details: details,
+	}
+	r.send(rep)
+}
+
+// a namespace only on the target has no source name and is reported under its target name
+func (r *Reporter) MissingNamespace(namespace util.Pair[string], loc Location) {
 	reason := NS_MISSING
 	details := bson.D{
 		{"missingFrom", loc},
 	}
-	rep := report{
-		namespace: missing,
-		reason:    reason,
-		details:   details,
+	rep := Report{
+		Namespace:       namespace.Source,
+		TargetNamespace: namespace.Target,
+		Reason:          reason,
+		Details:         details,
 	}
-	r.queue <- rep
+	r.send(rep)
 }
 
 func (r *Reporter) MismatchNamespace(source ns.Namespace, target ns.Namespace) {
@@ -81,57 +117,77 @@ func (r *Reporter) MismatchNamespace(source ns.Namespace, target ns.Namespace) {
 		{"src", source},
 		{"tgt", target},
 	}
-	rep := report{
-		namespace: source.String(),
-		reason:    reason,
-		details:   details,
+	rep := Report{
+		Namespace:       source.String(),
+		TargetNamespace: target.String(),
+		Reason:          reason,
+		Details:         details,
+	}
+	r.send(rep)
+}
+
+// records a stage that could not be completed for a namespace, e.x: the collection was dropped or $indexStats is unauthorized
+func (r *Reporter) NamespaceError(namespace util.Pair[string], stage string, err error) {
+	reason := NS_ERROR
+	details := bson.D{
+		{"stage", stage},
+		{"error", err.Error()},
+	}
+	rep := Report{
+		Namespace:       namespace.Source,
+		TargetNamespace: namespace.Target,
+		Reason:          reason,
+		Details:         details,
 	}
-	r.queue <- rep
+	r.send(rep)
 }
 
-func (r *Reporter) MismatchCount(namespace string, src int64, target int64) {
+func (r *Reporter) MismatchCount(namespace util.Pair[string], src int64, target int64) {
 	reason := COUNT_DIFF
 	details := bson.D{
 		{"src", src},
 		{"tgt", target},
 	}
-	rep := report{
-		namespace: namespace,
-		reason:    reason,
-		details:   details,
+	rep := Report{
+		Namespace:       namespace.Source,
+		TargetNamespace: namespace.Target,
+		Reason:          reason,
+		Details:         details,
 	}
-	r.queue <- rep
+	r.send(rep)
 }
 
-func (r *Reporter) MissingIndex(namespace string, index bson.Raw, location Location) {
+func (r *Reporter) MissingIndex(namespace util.Pair[string], index bson.Raw, location Location) {
 	reason := INDEX_MISSING
 	details := bson.D{
 		{"missingFrom", location},
 		{"index", index},
 	}
-	rep := report{
-		namespace: namespace,
-		reason:    reason,
-		details:   details,
+	rep := Report{
+		Namespace:       namespace.Source,
+		TargetNamespace: namespace.Target,
+		Reason:          reason,
+		Details:         details,
 	}
-	r.queue <- rep
+	r.send(rep)
 }
 
-func (r *Reporter) MismatchIndex(namespace string, src bson.Raw, target bson.Raw) {
+func (r *Reporter) MismatchIndex(namespace util.Pair[string], src bson.Raw, target bson.Raw) {
 	reason := INDEX_DIFF
 	details := bson.D{
 		{"src", src},
 		{"tgt", target},
 	}
-	rep := report{
-		namespace: namespace,
-		reason:    reason,
-		details:   details,
+	rep := Report{
+		Namespace:       namespace.Source,
+		TargetNamespace: namespace.Target,
+		Reason:          reason,
+		Details:         details,
 	}
-	r.queue <- rep
+	r.send(rep)
 }
 
-func (r *Reporter) SampleSummary(namespace string, direction util.Direction, summary DocSummary) {
+func (r *Reporter) SampleSummary(namespace util.Pair[string], stratum string, direction util.Direction, summary DocSummary) {
 	reason := COLL_SUMMARY
 	details := bson.D{}
 
@@ -141,44 +197,150 @@ func (r *Reporter) SampleSummary(namespace string, direction util.Direction, sum
 			bson.E{"docsMissing.src", summary.Missing},
 			bson.E{"docsWithMismatches.tgtToSrc", summary.Different},
 		}...)
+		if summary.Minor > 0 {
+			details = append(details, bson.E{"docsWithMinorMismatches.tgtToSrc", summary.Minor})
+		}
 	case util.SrcToTgt:
 		details = append(details, bson.D{
 			bson.E{"docsMissing.tgt", summary.Missing},
 			bson.E{"docsWithMismatches.srcToTgt", summary.Different},
 		}...)
+		if summary.Minor > 0 {
+			details = append(details, bson.E{"docsWithMinorMismatches.srcToTgt", summary.Minor})
+		}
 	}
 
-	rep := report{
-		namespace: namespace,
-		reason:    reason,
-		details:   details,
-		direction: direction,
+	rep := Report{
+		Namespace:       namespace.Source,
+		TargetNamespace: namespace.Target,
+		Reason:          reason,
+		Details:         details,
+		Direction:       direction,
+		Stratum:         stratum,
 	}
-	r.queue <- rep
+	r.send(rep)
 }
 
-func (r *Reporter) MismatchDoc(namespace string, direction util.Direction, a, b bson.Raw) {
-	reason := DOC_DIFF
+// removes documents that were consistent on recheck from the collection's sample summary
+func (r *Reporter) ResolvedSummary(namespace util.Pair[string], stratum string, direction util.Direction, summary DocSummary) {
+	reason := COLL_SUMMARY
+	details := bson.D{}
+
+	switch direction {
+	case util.TgtToSrc:
+		details = append(details, bson.D{
+			bson.E{"docsMissing.src", -summary.Missing},
+			bson.E{"docsWithMismatches.tgtToSrc", -summary.Different},
+			bson.E{"docsResolved.tgtToSrc", summary.Missing + summary.Different},
+		}...)
+	case util.SrcToTgt:
+		details = append(details, bson.D{
+			bson.E{"docsMissing.tgt", -summary.Missing},
+			bson.E{"docsWithMismatches.srcToTgt", -summary.Different},
+			bson.E{"docsResolved.srcToTgt", summary.Missing + summary.Different},
+		}...)
+	}
+
+	rep := Report{
+		Namespace:       namespace.Source,
+		TargetNamespace: namespace.Target,
+		Reason:          reason,
+		Details:         details,
+		Direction:       direction,
+		Stratum:         stratum,
+	}
+	r.send(rep)
+}
+
+// records the confidence of a direction's final (after recheck) result in the collection's sample summary
+func (r *Reporter) SampleConfidence(namespace util.Pair[string], stratum string, direction util.Direction, confidence Confidence) {
+	reason := COLL_SUMMARY
+	set := bson.D{}
+
+	switch direction {
+	case util.TgtToSrc:
+		set = append(set, bson.E{"confidence.tgtToSrc", confidence})
+	case util.SrcToTgt:
+		set = append(set, bson.E{"confidence.srcToTgt", confidence})
+	}
+
+	rep := Report{
+		Namespace:       namespace.Source,
+		TargetNamespace: namespace.Target,
+		Reason:          reason,
+		Set:             set,
+		Direction:       direction,
+		Stratum:         stratum,
+	}
+	r.send(rep)
+}
+
+// records the selection of a seeded sample in the collection's sample summary
+func (r *Reporter) SampleSeed(namespace util.Pair[string], stratum string, seed Seed) {
+	reason := COLL_SUMMARY
+	set := bson.D{
+		{"seed", seed},
+	}
+
+	rep := Report{
+		Namespace:       namespace.Source,
+		TargetNamespace: namespace.Target,
+		Reason:          reason,
+		Set:             set,
+		Stratum:         stratum,
+	}
+	r.send(rep)
+}
+
+func (r *Reporter) MismatchDoc(namespace util.Pair[string], direction util.Direction, src, tgt bson.Raw, diffs []doc.FieldDiff) {
+	r.mismatchDoc(DOC_DIFF, namespace, direction, src, tgt, diffs)
+}
+
+// reports a document that is equivalent on both sides but only under the comparison's tolerances, e.x: a widened numeric type
+func (r *Reporter) MinorMismatchDoc(namespace util.Pair[string], direction util.Direction, src, tgt bson.Raw, diffs []doc.FieldDiff) {
+	r.mismatchDoc(DOC_MINOR_DIFF, namespace, direction, src, tgt, diffs)
+}
+
+func (r *Reporter) mismatchDoc(reason Reason, namespace util.Pair[string], direction util.Direction, src, tgt bson.Raw, diffs []doc.FieldDiff) {
 	details := bson.D{
 		{"direction", direction},
-		{"key", a.Lookup("_id")},
+		{"key", src.Lookup("_id")},
 	}
 
+	reported := bson.A{}
+	size := 0
+	for i, each := range diffs {
+		diff := fieldDiff(each)
+		raw, _ := bson.Marshal(diff)
+		if i == MAX_REPORTED_DIFFS || size+len(raw) > MAX_REPORTED_DIFFS_BYTES {
+			details = append(details, bson.E{"diffsTruncated", true})
+			break
+		}
+		size += len(raw)
+		reported = append(reported, diff)
+	}
+	details = append(details, bson.E{"diffCount", len(diffs)}, bson.E{"diffs", reported})
+
 	if r.reportFullDoc {
-		details = append(details, primitive.E{"srcDoc", a})
-		details = append(details, primitive.E{"tgtDoc", b})
+		if len(src) > MAX_REPORTED_DOC_BYTES || len(tgt) > MAX_REPORTED_DOC_BYTES {
+			details = append(details, primitive.E{"docsTruncated", true})
+		} else {
+			details = append(details, primitive.E{"srcDoc", src})
+			details = append(details, primitive.E{"tgtDoc", tgt})
+		}
 	}
 
-	rep := report{
-		namespace: namespace,
-		reason:    reason,
-		details:   details,
-		direction: direction,
+	rep := Report{
+		Namespace:       namespace.Source,
+		TargetNamespace: namespace.Target,
+		Reason:          reason,
+		Details:         details,
+		Direction:       direction,
 	}
-	r.queue <- rep
+	r.send(rep)
 }
 
-func (r *Reporter) MissingDoc(namespace string, direction util.Direction, doc bson.Raw) {
+func (r *Reporter) MissingDoc(namespace util.Pair[string], direction util.Direction, doc bson.Raw) {
 	reason := DOC_MISSING
 	details := bson.D{
 		{"key", doc.Lookup("_id")},
@@ -195,75 +357,106 @@ func (r *Reporter) MissingDoc(namespace string, direction util.Direction, doc bs
 		details = append(details, bson.E{"doc", doc})
 	}
 
-	rep := report{
-		namespace: namespace,
-		reason:    reason,
-		details:   details,
-		direction: direction,
+	rep := Report{
+		Namespace:       namespace.Source,
+		TargetNamespace: namespace.Target,
+		Reason:          reason,
+		Details:         details,
+		Direction:       direction,
 	}
-	r.queue <- rep
+	r.send(rep)
 }
 
-func (r *Reporter) report(rep report, logger zerolog.Logger) {
-	filter := bson.D{
-		{"reason", rep.reason},
-		{"run", r.startTime},
-		{"ns", rep.namespace},
-	}
-
-	var update bson.D
-	switch rep.reason {
-
-	case COLL_SUMMARY:
-		update = bson.D{
-			{"$inc", rep.details},
+// converts a single differing path into its report representation, a side the path is absent from is reported as "missing"
+func fieldDiff(diff doc.FieldDiff) bson.D {
+	details := bson.D{{"path", diff.Path}}
+	for _, side := range []struct {
+		name  string
+		value bson.RawValue
+	}{{"src", diff.Src}, {"tgt", diff.Dst}} {
+		if side.value.Type == 0 {
+			details = append(details, bson.E{side.name + "Type", MISSING_TYPE})
+			continue
 		}
-	case DOC_DIFF, DOC_MISSING:
-		var doc bson.Raw
-		doc, err := bson.Marshal(rep.details)
-		if err != nil {
-			log.Error().Err(err).Msg("[internal] cannot marshal details doc to bson.Raw")
-		}
-		filter = append(filter, bson.E{"key", doc.Lookup("key")})
-		update = bson.D{
-			{"$set", rep.details},
-		}
-	default:
-		// if not updating an existing doc, manually add _id so the upsert filter is unique and an insert occurs
-		filter = append(filter, bson.E{"_id", primitive.NewObjectID()})
-		update = bson.D{
-			{"$set", rep.details},
+		value, truncated := reportedValue(side.value)
+		details = append(details, bson.E{side.name, value}, bson.E{side.name + "Type", side.value.Type.String()})
+		if truncated {
+			details = append(details, bson.E{side.name + "Truncated", true})
 		}
 	}
+	if diff.Kind != doc.VALUE_DIFFERS {
+		details = append(details, bson.E{"kind", diff.Kind})
+	}
+	return details
+}
 
-	logger.Debug().Msgf("appending summary -- {filter: %s, update: %s}", filter, update)
-	opts := options.Update().SetUpsert(true)
-	_, err := r.getCollection(rep.reason).UpdateOne(context.TODO(), filter, update, opts)
-	if err != nil {
-		logger.Error().Err(err).Msgf("unable to append to doc summary  -- {filter: %s, update: %s}", filter, update)
+// returns a value cut to MAX_REPORTED_VALUE_BYTES and whether it was cut. Strings keep their first bytes, other values
+// (e.x: an embedded document or a whole array of an ORDER_DIFFERS) are reported as the start of their extended JSON
+func reportedValue(value bson.RawValue) (interface{}, bool) {
+	if len(value.Value) <= MAX_REPORTED_VALUE_BYTES {
+		return value, false
+	}
+	var text string
+	if value.Type == bsontype.String {
+		text = value.StringValue()
+	} else {
+		text = value.String()
+	}
+	if len(text) <= MAX_REPORTED_VALUE_BYTES {
+		return text, true
 	}
+	cut := MAX_REPORTED_VALUE_BYTES
+	// never split a UTF-8 sequence
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut], true
 }
 
-func (r *Reporter) processReports(ctx context.Context, logger zerolog.Logger) {
-	logger.Info().Msgf("starting report processing, view with filter: { run: new Date(\"%s\") }", r.startTime.UTC().Format(time.RFC3339Nano))
-	for rep := range r.queue {
-		logger = logger.With().Str("ns", rep.namespace).Logger()
-		r.report(rep, logger)
+// marks a previously reported missing or mismatched document as resolved after it was found consistent on recheck
+func (r *Reporter) ResolvedDoc(namespace util.Pair[string], direction util.Direction, doc bson.Raw, missing bool, attempt int) {
+	reason := DOC_DIFF
+	if missing {
+		reason = DOC_MISSING
+	}
+	details := bson.D{
+		{"key", doc.Lookup("_id")},
+		{"resolved", true},
+		{"resolvedOnRecheck", attempt},
+	}
+
+	rep := Report{
+		Namespace:       namespace.Source,
+		TargetNamespace: namespace.Target,
+		Reason:          reason,
+		Details:         details,
+		Direction:       direction,
 	}
+	r.send(rep)
+}
+
+// Queues a report for the worker writing every report with its routing key. Sinks upsert a report document by a filter
+// no unique index backs, so two workers writing the same document at once could each insert it (e.x: a document
+// resolved on recheck while its mismatch is still being written), and a later report could overtake an earlier one
+func (r *Reporter) send(rep Report) {
+	h := fnv.New32a()
+	h.Write([]byte(rep.routingKey()))
+	r.queues[h.Sum32()%uint32(len(r.queues))] <- rep
 }
 
-func (r *Reporter) getCollection(reason Reason) *mongo.Collection {
-	switch reason {
-	case DOC_DIFF, DOC_MISSING:
-		return r.metaClient.Database(r.metaDBName).Collection("docs")
-	default:
-		return r.metaClient.Database(r.metaDBName).Collection("report")
+func (r *Reporter) report(ctx context.Context, rep Report, logger zerolog.Logger) {
+	rep.Run = r.startTime
+	for _, sink := range r.sinks {
+		if err := sink.Write(ctx, rep); err != nil {
+			logger.Error().Err(err).Msgf("unable to write %s report", rep.Reason)
+		}
 	}
 }
 
-func (r *Reporter) cleanMetaDB() {
-	err := r.metaClient.Database(r.metaDBName).Drop(context.TODO())
-	if err != nil {
-		log.Error().Err(err).Msg("unable to drop meta collection")
+func (r *Reporter) processReports(ctx context.Context, logger zerolog.Logger, queue chan Report) {
+	logger.Info().Msgf("starting report processing, view with filter: { run: new Date(\"%s\") }", r.startTime.UTC().Format(time.RFC3339Nano))
+	for rep := range queue {
+		logger = logger.With().Str("ns", rep.Namespace).Logger()
+		r.report(ctx, rep, logger)
 	}
 }
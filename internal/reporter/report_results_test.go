@@ -0,0 +1,155 @@
+package reporter
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"sampler/internal/doc"
+	"sampler/internal/util"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func testValue(value interface{}) bson.RawValue {
+	raw, _ := bson.Marshal(bson.D{{"v", value}})
+	return bson.Raw(raw).Lookup("v")
+}
+
+func testField(doc bson.D, key string) interface{} {
+	for _, each := range doc {
+		if each.Key == key {
+			return each.Value
+		}
+	}
+	return nil
+}
+
+// reports a mismatched document and returns its details
+func testMismatchDoc(t *testing.T, fullDoc bool, src, tgt bson.D, diffs []doc.FieldDiff) bson.D {
+	r := Reporter{queues: []chan Report{make(chan Report, 1)}, reportFullDoc: fullDoc}
+	srcRaw, _ := bson.Marshal(src)
+	tgtRaw, _ := bson.Marshal(tgt)
+	r.MismatchDoc(util.Pair[string]{Source: "shop.orders", Target: "shop.orders"}, util.SrcToTgt, srcRaw, tgtRaw, diffs)
+	rep := <-r.queues[0]
+	raw, err := bson.Marshal(rep.Details)
+	assert.Nil(t, err)
+	assert.Less(t, len(raw), 16*1024*1024)
+	return rep.Details
+}
+
+func TestMismatchDocSmallValues(t *testing.T) {
+	details := testMismatchDoc(t, false, bson.D{{"_id", 1}}, bson.D{{"_id", 1}}, []doc.FieldDiff{
+		{Path: "x", Src: testValue(1), Dst: testValue("1"), Kind: doc.VALUE_DIFFERS},
+		{Path: "y", Src: testValue(2)},
+	})
+	diffs := testField(details, "diffs").(bson.A)
+	if assert.Len(t, diffs, 2) {
+		assert.Equal(t, bson.D{
+			{"path", "x"},
+			{"src", testValue(1)}, {"srcType", "32-bit integer"},
+			{"tgt", testValue("1")}, {"tgtType", "string"},
+		}, diffs[0])
+		assert.Equal(t, MISSING_TYPE, testField(diffs[1].(bson.D), "tgtType"))
+	}
+	assert.Nil(t, testField(details, "diffsTruncated"))
+}
+
+func TestMismatchDocTruncatesValues(t *testing.T) {
+	long := strings.Repeat("é", MAX_REPORTED_VALUE_BYTES)
+	array := bson.A{}
+	for i := 0; i < 1000; i++ {
+		array = append(array, i)
+	}
+	details := testMismatchDoc(t, false, bson.D{{"_id", 1}}, bson.D{{"_id", 1}}, []doc.FieldDiff{
+		{Path: "s", Src: testValue(long), Dst: testValue("short"), Kind: doc.VALUE_DIFFERS},
+		{Path: "a", Src: testValue(array), Dst: testValue(array), Kind: doc.ORDER_DIFFERS},
+	})
+	diffs := testField(details, "diffs").(bson.A)
+
+	text := diffs[0].(bson.D)
+	cut := testField(text, "src").(string)
+	assert.LessOrEqual(t, len(cut), MAX_REPORTED_VALUE_BYTES)
+	assert.True(t, utf8.ValidString(cut))
+	assert.True(t, strings.HasPrefix(long, cut))
+	assert.Equal(t, true, testField(text, "srcTruncated"))
+	assert.Equal(t, "string", testField(text, "srcType"))
+	assert.Equal(t, testValue("short"), testField(text, "tgt"))
+	assert.Nil(t, testField(text, "tgtTruncated"))
+
+	// whole arrays are reported as the start of their extended JSON
+	order := diffs[1].(bson.D)
+	assert.True(t, strings.HasPrefix(testField(order, "src").(string), `[{"$numberInt":"0"}`))
+	assert.Equal(t, true, testField(order, "tgtTruncated"))
+	assert.Equal(t, "array", testField(order, "srcType"))
+}
+
+func TestMismatchDocCapsDiffs(t *testing.T) {
+	diffs := []doc.FieldDiff{}
+	for i := 0; i < MAX_REPORTED_DIFFS+10; i++ {
+		diffs = append(diffs, doc.FieldDiff{Path: "f", Src: testValue(i), Dst: testValue(-i)})
+	}
+	details := testMismatchDoc(t, false, bson.D{{"_id", 1}}, bson.D{{"_id", 1}}, diffs)
+	assert.Equal(t, true, testField(details, "diffsTruncated"))
+	assert.Equal(t, MAX_REPORTED_DIFFS+10, testField(details, "diffCount"))
+	assert.Len(t, testField(details, "diffs"), MAX_REPORTED_DIFFS)
+
+	// deeply nested paths are long even when their values are cut
+	path := strings.Repeat("nested.", 100*1024)
+	diffs = []doc.FieldDiff{}
+	for i := 0; i < MAX_REPORTED_DIFFS; i++ {
+		diffs = append(diffs, doc.FieldDiff{Path: path, Src: testValue(i), Dst: testValue(-i)})
+	}
+	details = testMismatchDoc(t, false, bson.D{{"_id", 1}}, bson.D{{"_id", 1}}, diffs)
+	assert.Equal(t, true, testField(details, "diffsTruncated"))
+	assert.Len(t, testField(details, "diffs"), MAX_REPORTED_DIFFS_BYTES/len(path))
+}
+
+func TestMismatchDocFullDocs(t *testing.T) {
+	small := testMismatchDoc(t, true, bson.D{{"_id", 1}, {"x", 1}}, bson.D{{"_id", 1}, {"x", 2}}, nil)
+	assert.NotNil(t, testField(small, "srcDoc"))
+	assert.NotNil(t, testField(small, "tgtDoc"))
+
+	large := bson.D{{"_id", 1}, {"x", strings.Repeat("x", MAX_REPORTED_DOC_BYTES)}}
+	details := testMismatchDoc(t, true, large, large, nil)
+	assert.Nil(t, testField(details, "srcDoc"))
+	assert.Equal(t, true, testField(details, "docsTruncated"))
+}
+
+func TestSendRoutesReportsOfADocumentToOneWorker(t *testing.T) {
+	r := Reporter{}
+	for i := 0; i < 8; i++ {
+		r.queues = append(r.queues, make(chan Report, 100))
+	}
+	namespace := util.Pair[string]{Source: "shop.orders", Target: "shop.orders"}
+	// the queue a report was sent to
+	received := func() int {
+		for i, queue := range r.queues {
+			select {
+			case <-queue:
+				return i
+			default:
+			}
+		}
+		return -1
+	}
+
+	queues := map[int]bool{}
+	for id := 0; id < 32; id++ {
+		raw, _ := bson.Marshal(bson.D{{"_id", id}})
+		r.MismatchDoc(namespace, util.SrcToTgt, raw, raw, nil)
+		mismatch := received()
+		r.ResolvedDoc(namespace, util.SrcToTgt, raw, false, 1)
+		assert.Equal(t, mismatch, received(), id)
+		queues[mismatch] = true
+	}
+	// documents are still spread over the workers
+	assert.Greater(t, len(queues), 1)
+
+	summary := Report{Namespace: "shop.orders", Reason: COLL_SUMMARY, Stratum: "eu"}
+	r.send(summary)
+	first := received()
+	r.send(summary)
+	assert.Equal(t, first, received())
+}
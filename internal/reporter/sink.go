@@ -0,0 +1,51 @@
+package reporter
+
+import (
+	"context"
+	"time"
+
+	"sampler/internal/util"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// A single result to be persisted, every sink receives the same reports
+type Report struct {
+	Run       time.Time
+	Namespace string
+	// the namespace's name on the target, only reported when it is mapped to a different name
+	TargetNamespace string
+	Reason          Reason
+	Details         bson.D
+	// fields replaced rather than accumulated, only used by reasons whose details are counters (e.x: COLL_SUMMARY)
+	Set       bson.D
+	Direction util.Direction
+	// stratum of a stratified sample a COLL_SUMMARY belongs to, empty when the namespace is sampled as a whole
+	Stratum string
+}
+
+// returns the target namespace when it differs from the source namespace, otherwise an empty string
+func (r Report) mappedNamespace() string {
+	if r.TargetNamespace == r.Namespace {
+		return ""
+	}
+	return r.TargetNamespace
+}
+
+// Names the report document sinks write a report into, for document reports the namespace and _id, otherwise the namespace
+// and stratum. Reports with the same key are written in order by a single reporter worker
+func (r Report) routingKey() string {
+	key := r.Namespace + "\x00" + r.Stratum
+	for _, each := range r.Details {
+		if value, ok := each.Value.(bson.RawValue); ok && each.Key == "key" {
+			key += "\x00" + value.String()
+		}
+	}
+	return key
+}
+
+// A destination for reports. Sinks must be safe for concurrent use by multiple reporter workers
+type Sink interface {
+	Write(ctx context.Context, rep Report) error
+	Close(ctx context.Context) error
+}
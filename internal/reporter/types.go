@@ -2,6 +2,7 @@ package reporter
 
 type Location string
 type Reason string
+type RunStatus string
 
 const (
 	Source Location = "src"
@@ -19,6 +20,38 @@ const (
 	COUNT_DIFF Reason = "countMismatch"
 	INDEX_DIFF Reason = "indexMismatch"
 	DOC_DIFF   Reason = "docMismatch"
+
+	// documents that only differ in ways the comparison tolerates, e.x: a numeric type change with --numericEquivalence
+	DOC_MINOR_DIFF Reason = "docMinorMismatch"
+
+	NS_ERROR Reason = "namespaceError"
+
+	RUN Reason = "run"
+)
+
+const (
+	RUN_RUNNING     RunStatus = "running"
+	RUN_COMPLETED   RunStatus = "completed"
+	RUN_INTERRUPTED RunStatus = "interrupted"
 )
 
-const NUM_REPORTERS uint = 1
+// collections of the meta database
+const (
+	REPORT_COLL   = "report"
+	DOCS_COLL     = "docs"
+	RUNS_COLL     = "runs"
+	PROGRESS_COLL = "progress"
+)
+
+// caps the number of differing paths stored per document to keep report documents well under 16MB
+const MAX_REPORTED_DIFFS int = 100
+
+// caps the bytes of a single reported value, longer strings are cut and other values reported as cut extended JSON
+const MAX_REPORTED_VALUE_BYTES int = 1024
+
+// caps the bytes of every differing path of a document together, and of each full document with --fulldoc
+const MAX_REPORTED_DIFFS_BYTES int = 4 * 1024 * 1024
+const MAX_REPORTED_DOC_BYTES int = 4 * 1024 * 1024
+
+// type reported for a path that does not exist on one side of a docMismatch
+const MISSING_TYPE string = "missing"
@@ -0,0 +1,56 @@
+package throttle
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A token bucket refilled at rate tokens per second holding at most one second of tokens. Taking more tokens than the
+// bucket holds leaves it in debt, so large takes delay the takers after them instead of waiting forever
+type bucket struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// returns nil when rate is not positive, a nil bucket never waits
+func newBucket(rate float64) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// takes n tokens, waiting until the bucket is out of debt. Returns ctx's error if it is done first
+func (b *bucket) take(ctx context.Context, n float64) error {
+	if b == nil || n <= 0 {
+		return nil
+	}
+	b.lock.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= n
+	wait := time.Duration(0)
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.lock.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,62 @@
+package throttle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewBucketUnlimited(t *testing.T) {
+	b := newBucket(0)
+	assert.Nil(t, b)
+	assert.Nil(t, b.take(context.Background(), 1e9))
+}
+
+func TestBucketTakesWithoutWaiting(t *testing.T) {
+	b := newBucket(100)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	// a full bucket holds a second of tokens, taking them does not wait even with a done context
+	assert.Nil(t, b.take(cancelled, 100))
+	assert.InDelta(t, 0, b.tokens, 1)
+	assert.Nil(t, b.take(cancelled, 0))
+}
+
+func TestBucketDebt(t *testing.T) {
+	b := newBucket(1000)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	// taking more than the bucket holds leaves it in debt and would wait it out
+	assert.ErrorIs(t, b.take(cancelled, 1500), context.Canceled)
+	assert.InDelta(t, -500, b.tokens, 5)
+
+	// the debt is still owed by the next taker
+	assert.ErrorIs(t, b.take(cancelled, 1), context.Canceled)
+	assert.InDelta(t, -501, b.tokens, 5)
+}
+
+func TestBucketRefill(t *testing.T) {
+	b := newBucket(1000)
+	b.tokens = -1000
+	b.last = time.Now().Add(-time.Second)
+	// a second refills rate tokens
+	assert.Nil(t, b.take(context.Background(), 0.5))
+	assert.InDelta(t, -0.5, b.tokens, 5)
+
+	// but never more than a second of them
+	b.tokens = 0
+	b.last = time.Now().Add(-time.Hour)
+	assert.Nil(t, b.take(context.Background(), 1))
+	assert.InDelta(t, 999, b.tokens, 1)
+}
+
+func TestBucketWaitsOutDebt(t *testing.T) {
+	b := newBucket(100)
+	assert.Nil(t, b.take(context.Background(), 100))
+	start := time.Now()
+	// 5 tokens in debt at 100 per second
+	assert.Nil(t, b.take(context.Background(), 5))
+	assert.GreaterOrEqual(t, time.Since(start), 45*time.Millisecond)
+}
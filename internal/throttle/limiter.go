@@ -0,0 +1,137 @@
+package throttle
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Budgets of the queries sent to a single cluster, a zero value does not limit
+type Options struct {
+	// queries in flight at once across every pool
+	MaxQueries int
+	// queries started per second, including every getMore
+	OpsPerSec float64
+	// documents returned per second
+	DocsPerSec float64
+}
+
+// Throttles the queries sent to a single cluster across every pool. A nil Limiter does not limit
+type Limiter struct {
+	lock sync.Mutex
+	// configured cap on queries in flight, 0 when uncapped
+	max int
+	// current cap, lowered by Backoff while the cluster is under pressure
+	capacity int
+	inFlight int
+	// closed and replaced whenever a slot may have freed up
+	released chan struct{}
+	ops      *bucket
+	docs     *bucket
+}
+
+// returns a limiter enforcing the options, nil when they do not limit anything
+func NewLimiter(opts Options) *Limiter {
+	if opts.MaxQueries <= 0 && opts.OpsPerSec <= 0 && opts.DocsPerSec <= 0 {
+		return nil
+	}
+	return &Limiter{
+		max:      opts.MaxQueries,
+		capacity: opts.MaxQueries,
+		released: make(chan struct{}),
+		ops:      newBucket(opts.OpsPerSec),
+		docs:     newBucket(opts.DocsPerSec),
+	}
+}
+
+// blocks until the ops budget allows another query and a query slot is free, returns ctx's error if it is done first
+func (l *Limiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	if err := l.ops.take(ctx, 1); err != nil {
+		return err
+	}
+	for {
+		l.lock.Lock()
+		if l.max <= 0 || l.inFlight < l.capacity {
+			l.inFlight++
+			l.lock.Unlock()
+			return nil
+		}
+		released := l.released
+		l.lock.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.inFlight--
+	l.notify()
+}
+
+// charges the documents a query returned against the docs budget, waiting while it is in debt
+func (l *Limiter) Fetched(ctx context.Context, docs int) error {
+	if l == nil {
+		return nil
+	}
+	return l.docs.take(ctx, float64(docs))
+}
+
+// advances a cursor like cursor.Next, holding a slot while the next batch is fetched with a getMore and charging the
+// batch against the docs budget
+func (l *Limiter) Next(ctx context.Context, cursor *mongo.Cursor) bool {
+	if l == nil || cursor.RemainingBatchLength() > 0 {
+		return cursor.Next(ctx)
+	}
+	if err := l.Acquire(ctx); err != nil {
+		return false
+	}
+	next := cursor.Next(ctx)
+	l.Release()
+	if next {
+		// the document Next moved to is no longer part of the remaining batch
+		if err := l.Fetched(ctx, cursor.RemainingBatchLength()+1); err != nil {
+			return false
+		}
+	}
+	return next
+}
+
+// halves the cap on queries in flight, never below one. Returns the new cap
+func (l *Limiter) Backoff() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.capacity > 1 {
+		l.capacity /= 2
+	}
+	return l.capacity
+}
+
+// raises the cap on queries in flight by one, up to the configured cap. Returns the new cap and whether it was raised
+func (l *Limiter) Recover() (int, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.capacity >= l.max {
+		return l.capacity, false
+	}
+	l.capacity++
+	l.notify()
+	return l.capacity, true
+}
+
+// wakes up every waiting Acquire, must hold the lock
+func (l *Limiter) notify() {
+	close(l.released)
+	l.released = make(chan struct{})
+}
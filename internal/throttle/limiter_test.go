@@ -0,0 +1,90 @@
+package throttle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLimiterUnlimited(t *testing.T) {
+	l := NewLimiter(Options{})
+	assert.Nil(t, l)
+	assert.Nil(t, l.Acquire(context.Background()))
+	assert.Nil(t, l.Fetched(context.Background(), 1e6))
+	l.Release()
+}
+
+func TestLimiterMaxQueries(t *testing.T) {
+	l := NewLimiter(Options{MaxQueries: 2})
+	assert.Nil(t, l.Acquire(context.Background()))
+	assert.Nil(t, l.Acquire(context.Background()))
+
+	// every slot is taken
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, l.Acquire(ctx), context.DeadlineExceeded)
+
+	// a release wakes a waiting acquire
+	acquired := make(chan error)
+	go func() {
+		acquired <- l.Acquire(context.Background())
+	}()
+	l.Release()
+	assert.Nil(t, <-acquired)
+	assert.Equal(t, 2, l.inFlight)
+}
+
+func TestLimiterBackoff(t *testing.T) {
+	l := NewLimiter(Options{MaxQueries: 8})
+	assert.Equal(t, 4, l.Backoff())
+	assert.Equal(t, 2, l.Backoff())
+	assert.Equal(t, 1, l.Backoff())
+	// never below one
+	assert.Equal(t, 1, l.Backoff())
+}
+
+func TestLimiterRecover(t *testing.T) {
+	l := NewLimiter(Options{MaxQueries: 3})
+	l.Backoff()
+	capacity, raised := l.Recover()
+	assert.Equal(t, 2, capacity)
+	assert.True(t, raised)
+	capacity, raised = l.Recover()
+	assert.Equal(t, 3, capacity)
+	assert.True(t, raised)
+	// never above the configured cap
+	capacity, raised = l.Recover()
+	assert.Equal(t, 3, capacity)
+	assert.False(t, raised)
+}
+
+func TestLimiterRecoverWakesAcquire(t *testing.T) {
+	l := NewLimiter(Options{MaxQueries: 2})
+	l.Backoff()
+	assert.Nil(t, l.Acquire(context.Background()))
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- l.Acquire(context.Background())
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired beyond the backed off cap")
+	case <-time.After(20 * time.Millisecond):
+	}
+	l.Recover()
+	assert.Nil(t, <-acquired)
+}
+
+func TestLimiterFetchedChargesDocs(t *testing.T) {
+	l := NewLimiter(Options{DocsPerSec: 100})
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Nil(t, l.Fetched(cancelled, 100))
+	// the next batch waits for the docs budget
+	assert.ErrorIs(t, l.Fetched(cancelled, 50), context.Canceled)
+	// queries are not capped
+	assert.Nil(t, l.Acquire(context.Background()))
+}
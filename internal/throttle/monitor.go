@@ -0,0 +1,99 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Thresholds past which a cluster is considered under pressure, a zero threshold is not checked
+type Pressure struct {
+	// operations queued for the read lock in serverStatus globalLock.currentQueue.readers
+	MaxQueuedReaders int
+	// how far the most lagged secondary is behind the primary in replSetGetStatus
+	MaxReplLag time.Duration
+}
+
+// Polls the cluster every interval, halving the limiter's cap on queries in flight whenever it is under pressure and
+// raising it by one after every healthy poll. Signals a cluster does not report (e.x: replication lag through a mongos)
+// are skipped. Returns when ctx is done
+func Monitor(ctx context.Context, logger zerolog.Logger, client *mongo.Client, limiter *Limiter, pressure Pressure, interval time.Duration) {
+	if limiter == nil || limiter.max <= 0 {
+		logger.Warn().Msg("adaptive throttling needs a cap on queries in flight, not monitoring")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reasons := checkPressure(ctx, logger, client, pressure)
+		if len(reasons) > 0 {
+			logger.Warn().Strs("pressure", reasons).Msgf("backing off to %d queries in flight", limiter.Backoff())
+			continue
+		}
+		if capacity, raised := limiter.Recover(); raised {
+			logger.Debug().Msgf("recovering to %d queries in flight", capacity)
+		}
+	}
+}
+
+// returns a description of every threshold the cluster is past
+func checkPressure(ctx context.Context, logger zerolog.Logger, client *mongo.Client, pressure Pressure) []string {
+	reasons := []string{}
+	if pressure.MaxQueuedReaders > 0 {
+		status, err := client.Database("admin").RunCommand(ctx, bson.D{{"serverStatus", 1}}).Raw()
+		if err != nil {
+			logger.Debug().Err(err).Msg("cannot read serverStatus")
+		} else if value, err := status.LookupErr("globalLock", "currentQueue", "readers"); err == nil {
+			if readers, ok := value.AsInt64OK(); ok && readers > int64(pressure.MaxQueuedReaders) {
+				reasons = append(reasons, fmt.Sprintf("%d queued readers", readers))
+			}
+		}
+	}
+	if pressure.MaxReplLag > 0 {
+		lag, err := replicationLag(ctx, client)
+		if err != nil {
+			logger.Debug().Err(err).Msg("cannot read replication lag")
+		} else if lag > pressure.MaxReplLag {
+			reasons = append(reasons, fmt.Sprintf("%s replication lag", lag))
+		}
+	}
+	return reasons
+}
+
+// returns how far the most lagged secondary is behind the primary
+func replicationLag(ctx context.Context, client *mongo.Client) (time.Duration, error) {
+	var status struct {
+		Members []struct {
+			State      string    `bson:"stateStr"`
+			OptimeDate time.Time `bson:"optimeDate"`
+		} `bson:"members"`
+	}
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{"replSetGetStatus", 1}}).Decode(&status); err != nil {
+		return 0, err
+	}
+	var primary time.Time
+	for _, each := range status.Members {
+		if each.State == "PRIMARY" {
+			primary = each.OptimeDate
+		}
+	}
+	if primary.IsZero() {
+		return 0, fmt.Errorf("replica set has no primary")
+	}
+	lag := time.Duration(0)
+	for _, each := range status.Members {
+		if each.State == "SECONDARY" && primary.Sub(each.OptimeDate) > lag {
+			lag = primary.Sub(each.OptimeDate)
+		}
+	}
+	return lag, nil
+}
@@ -3,11 +3,15 @@ package util
 import (
 	"context"
 	"errors"
+	"fmt"
 	"math"
+	"strconv"
 	"strings"
 
 	"github.com/rs/zerolog/log"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -41,6 +45,15 @@ func Max64(a int64, b int64) int64 {
 	}
 }
 
+func Min(a int, b int) int {
+	switch a < b {
+	case true:
+		return a
+	default:
+		return b
+	}
+}
+
 func Min64(a int64, b int64) int64 {
 	switch a < b {
 	case true:
@@ -60,13 +73,32 @@ func GetSampleSize(p int64, z float64, eps float64) int64 {
 	return int64(math.Round(n_prime))
 }
 
+// Wilson score interval of a binomial proportion, for the number of successes (k) out of trials (n) and the z-value
+// from a z-table (z). Unlike the normal approximation it stays inside [0, 1] and is not empty when k is 0 or n
+func WilsonInterval(k int64, n int64, z float64) (float64, float64) {
+	if n <= 0 {
+		return 0, 1
+	}
+	trials := float64(n)
+	p := float64(k) / trials
+	z2 := z * z
+	center := (p + z2/(2*trials)) / (1 + z2/trials)
+	margin := z / (1 + z2/trials) * math.Sqrt(p*(1-p)/trials+z2/(4*trials*trials))
+	return math.Max(0, center-margin), math.Min(1, center+margin)
+}
+
+// two sided confidence level of a z-value (z), e.x: 2.58 is 99%
+func ConfidenceLevel(z float64) float64 {
+	return math.Erf(z / math.Sqrt2)
+}
+
 func CleanPath(path string) string {
 	cleaned, _ := strings.CutSuffix(path, "/")
 	return cleaned
 }
 
-func IsMongos(client *mongo.Client) bool {
-	result := client.Database("admin").RunCommand(context.TODO(), bson.D{{"isdbgrid", 1}})
+func IsMongos(ctx context.Context, client *mongo.Client) bool {
+	result := client.Database("admin").RunCommand(ctx, bson.D{{"isdbgrid", 1}})
 	res, err := result.Raw()
 	if err != nil {
 		code := res.Lookup("code").AsInt64()
@@ -87,3 +119,34 @@ func SplitNamespace(ns string) (string, string, error) {
 	}
 	return db, coll, nil
 }
+
+// returns the cluster's current operationTime, only replica sets and sharded clusters report one
+func ClusterTime(ctx context.Context, client *mongo.Client) (primitive.Timestamp, error) {
+	res, err := client.Database("admin").RunCommand(ctx, bson.D{{"ping", 1}}).Raw()
+	if err != nil {
+		return primitive.Timestamp{}, err
+	}
+	opTime, err := res.LookupErr("operationTime")
+	if err != nil || opTime.Type != bsontype.Timestamp {
+		return primitive.Timestamp{}, errors.New("no operationTime in server response, snapshot reads require a replica set or sharded cluster")
+	}
+	t, i := opTime.Timestamp()
+	return primitive.Timestamp{T: t, I: i}, nil
+}
+
+// parses a cluster time in the form <seconds>[,<increment>]
+func ParseTimestamp(ts string) (primitive.Timestamp, error) {
+	secs, inc, found := strings.Cut(ts, ",")
+	t, err := strconv.ParseUint(strings.TrimSpace(secs), 10, 32)
+	if err != nil {
+		return primitive.Timestamp{}, fmt.Errorf("malformed cluster time %q: %w", ts, err)
+	}
+	var i uint64
+	if found {
+		i, err = strconv.ParseUint(strings.TrimSpace(inc), 10, 32)
+		if err != nil {
+			return primitive.Timestamp{}, fmt.Errorf("malformed cluster time increment %q: %w", ts, err)
+		}
+	}
+	return primitive.Timestamp{T: uint32(t), I: uint32(i)}, nil
+}
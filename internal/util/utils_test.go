@@ -0,0 +1,31 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWilsonInterval(t *testing.T) {
+	// no failures still leaves an upper bound of about z^2 / n
+	low, high := WilsonInterval(0, 1000, 2.58)
+	assert.Equal(t, 0.0, low)
+	assert.InDelta(t, 0.00661, high, 0.00001)
+
+	low, high = WilsonInterval(10, 100, 1.96)
+	assert.InDelta(t, 0.0552, low, 0.0001)
+	assert.InDelta(t, 0.1744, high, 0.0001)
+
+	low, high = WilsonInterval(50, 50, 1.96)
+	assert.Less(t, low, 1.0)
+	assert.Equal(t, 1.0, high)
+
+	low, high = WilsonInterval(0, 0, 1.96)
+	assert.Equal(t, 0.0, low)
+	assert.Equal(t, 1.0, high)
+}
+
+func TestConfidenceLevel(t *testing.T) {
+	assert.InDelta(t, 0.99, ConfidenceLevel(2.58), 0.0005)
+	assert.InDelta(t, 0.95, ConfidenceLevel(1.96), 0.0005)
+}
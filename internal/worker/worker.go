@@ -30,8 +30,8 @@ func NewWorkerPool(logger zerolog.Logger, numWorkers int, workerName string, key
 }
 
 // Starts worker pool with a given function to be processed by Pool.num workers
-// takes in ctx and logger to capture worker num and ctx generated in this function
-func (p *Pool) Start(process func(context.Context, zerolog.Logger)) {
+// takes in ctx and logger to capture worker num, every worker is handed ctx so cancelling it stops the pool
+func (p *Pool) Start(ctx context.Context, process func(context.Context, zerolog.Logger)) {
 	for i := 0; i < p.num; i++ {
 		workerNum := i
 		workerLogger := p.logger.With().Int(p.key, workerNum).Logger()
@@ -40,7 +40,7 @@ func (p *Pool) Start(process func(context.Context, zerolog.Logger)) {
 		go func(logger zerolog.Logger, num int, name string) {
 			defer p.wg.Done()
 			defer logger.Debug().Msgf("%s finished", name)
-			process(context.TODO(), logger)
+			process(ctx, logger)
 		}(workerLogger, i, p.name)
 	}
 }
@@ -8,9 +8,12 @@ package main
 
 import (
 	"context"
+	"os"
+	"os/signal"
 	"sampler/internal/cfg"
 	"sampler/internal/comparer"
 	"sampler/internal/logger"
+	"syscall"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
@@ -19,6 +22,7 @@ import (
 )
 
 var sampler comparer.Comparer
+var config cfg.Configuration
 
 func connectMongo(config cfg.MongoOptions) *mongo.Client {
 	opts := config.MakeClientOptions()
@@ -30,25 +34,55 @@ func connectMongo(config cfg.MongoOptions) *mongo.Client {
 }
 
 func init() {
-	startTime := time.Now()
-	config := cfg.Init()
-	logger.Init(config.Verbosity, config.LogFile, startTime)
+	config = cfg.Init()
+	// runs are keyed by their start time, which the meta database only stores to the millisecond
+	startTime := time.Now().Truncate(time.Millisecond)
+	if !config.ResumeRun.IsZero() {
+		startTime = config.ResumeRun
+	}
+	logger.Init(config.Verbosity, config.LogFile, startTime, config.HasSink(cfg.StdoutSink))
 
 	log.Debug().Msgf("%#v", config)
 
 	source := connectMongo(config.Source)
 	target := connectMongo(config.Target)
+	// the meta cluster is only needed when reporting to mongo
 	var meta *mongo.Client
-	if config.Meta.URI != "" {
-		meta = connectMongo(config.Meta)
-	} else {
-		meta = target
+	if config.HasSink(cfg.MongoSink) {
+		if config.Meta.URI != "" {
+			meta = connectMongo(config.Meta)
+		} else {
+			meta = target
+		}
 	}
 
-	sampler = comparer.NewComparer(config, source, target, meta, startTime)
+	var err error
+	sampler, err = comparer.NewComparer(config, source, target, meta, startTime)
+	if err != nil {
+		log.Fatal().Err(err).Msg("cannot start comparison")
+	}
 }
 
+// exits with EXIT_DATA_MISMATCH or EXIT_METADATA_MISMATCH when differences were found, EXIT_INTERRUPTED when
+// cancelled by a signal and tool errors exit with EXIT_TOOL_ERROR
 func main() {
-	ctx := context.Background()
-	sampler.Compare(ctx)
+	// the first SIGINT/SIGTERM cancels the run and lets queued reports drain, a second one exits immediately
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		log.Warn().Msgf("received %s, stopping comparison (interrupt again to exit immediately)", sig)
+		cancel()
+	}()
+
+	result := sampler.Compare(ctx)
+	if config.SummaryJSON != "" {
+		if err := result.WriteJSON(config.SummaryJSON); err != nil {
+			log.Error().Err(err).Msg("unable to write summary json")
+			os.Exit(comparer.EXIT_TOOL_ERROR)
+		}
+	}
+	os.Exit(result.ExitCode())
 }